@@ -0,0 +1,236 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits for the peers that a client knows about and connects to
+const MAX_ADDRESS_BOOK int = 1000
+const DEFAULT_TARGET_OUTBOUND int = 8
+const DEFAULT_MAX_INBOUND int = 16
+const MAX_ADDR_PER_MESSAGE int = 100
+
+// Addresses are dropped after too many failed connection attempts,
+// and not retried within ADDRESS_RETRY_INTERVAL of the last attempt.
+const MAX_ADDRESS_FAILURES int = 3
+const ADDRESS_RETRY_INTERVAL time.Duration = 10 * time.Second
+
+type AddressBookEntry struct {
+	Peer        PeerAddress
+	Score       int
+	Failures    int
+	LastSeen    time.Time
+	LastAttempt time.Time
+}
+
+/**
+ * The peers a client has heard about.  Peers gain score for successful
+ * connections and lose it for failed ones; when the book is full, the
+ * entry with the lowest score is evicted.
+ */
+type AddressBook struct {
+	MaxSize int
+	entries map[string]*AddressBookEntry
+	mu      sync.Mutex
+}
+
+func NewAddressBook() *AddressBook {
+	var b AddressBook
+	b.MaxSize = MAX_ADDRESS_BOOK
+	b.entries = make(map[string]*AddressBookEntry)
+	return &b
+}
+
+// Adds a peer that has not been heard of before.
+func (b *AddressBook) Add(peer PeerAddress) bool {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+
+	if entry, ok := (*b).entries[peer.Key()]; ok {
+		if peer.Endpoint != "" {
+			entry.Peer.Endpoint = peer.Endpoint
+		}
+		return false
+	}
+	if len((*b).entries) >= (*b).MaxSize {
+		b.evictWorst()
+	}
+	(*b).entries[peer.Key()] = &AddressBookEntry{Peer: peer}
+	return true
+}
+
+func (b *AddressBook) Good(key string) {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	if entry, ok := (*b).entries[key]; ok {
+		entry.Score++
+		entry.Failures = 0
+		entry.LastSeen = time.Now()
+	}
+}
+
+// Penalizes a peer after a failed attempt, dropping it after too many failures.
+func (b *AddressBook) Bad(key string) {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	if entry, ok := (*b).entries[key]; ok {
+		entry.Score--
+		entry.Failures++
+		if entry.Failures >= MAX_ADDRESS_FAILURES {
+			delete((*b).entries, key)
+		}
+	}
+}
+
+/**
+ * Picks up to n peers to connect to, best score first, skipping excluded
+ * peers and those attempted recently.  The picked peers are marked as
+ * attempted.
+ */
+func (b *AddressBook) Candidates(n int, exclude map[string]bool) []PeerAddress {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+
+	now := time.Now()
+	entries := make([]*AddressBookEntry, 0)
+	for address, entry := range (*b).entries {
+		if !exclude[address] && now.Sub(entry.LastAttempt) > ADDRESS_RETRY_INTERVAL {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+		return entries[i].Peer.Key() < entries[j].Peer.Key()
+	})
+
+	candidates := make([]PeerAddress, 0, n)
+	for i := 0; i < len(entries) && i < n; i++ {
+		entries[i].LastAttempt = now
+		candidates = append(candidates, entries[i].Peer)
+	}
+	return candidates
+}
+
+// A random selection of up to n known peers, to share in an ADDR message.
+func (b *AddressBook) Sample(n int) []PeerAddress {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	sample := make([]PeerAddress, 0, len((*b).entries))
+	for _, entry := range (*b).entries {
+		sample = append(sample, entry.Peer)
+	}
+	rand.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	if len(sample) > n {
+		sample = sample[:n]
+	}
+	return sample
+}
+
+func (b *AddressBook) Remove(key string) {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	delete((*b).entries, key)
+}
+
+func (b *AddressBook) Size() int {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	return len((*b).entries)
+}
+
+func (b *AddressBook) evictWorst() {
+	var worst *AddressBookEntry
+	for _, entry := range (*b).entries {
+		if worst == nil || entry.Score < worst.Score ||
+			(entry.Score == worst.Score && entry.LastSeen.Before(worst.LastSeen)) {
+			worst = entry
+		}
+	}
+	if worst != nil {
+		delete((*b).entries, worst.Peer.Key())
+	}
+}
+
+/**
+ * The connections of a client, split into those it opened (outbound) and
+ * those opened by other clients (inbound), along with the address book
+ * used to find new peers.
+ */
+type PeerManager struct {
+	Book           *AddressBook
+	Bootstrap      []PeerAddress
+	TargetOutbound int
+	MaxInbound     int
+	Outbound       map[string]bool
+	Inbound        map[string]bool
+	mu             sync.Mutex
+}
+
+func NewPeerManager() *PeerManager {
+	var p PeerManager
+	p.Book = NewAddressBook()
+	p.Bootstrap = make([]PeerAddress, 0)
+	p.TargetOutbound = DEFAULT_TARGET_OUTBOUND
+	p.MaxInbound = DEFAULT_MAX_INBOUND
+	p.Outbound = make(map[string]bool)
+	p.Inbound = make(map[string]bool)
+	return &p
+}
+
+// The number of outbound connections still needed to reach the target.
+func (p *PeerManager) MissingOutbound() int {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	return (*p).TargetOutbound - len((*p).Outbound)
+}
+
+// Peers that are connected either way, which should not be dialed again.
+func (p *PeerManager) Connected() map[string]bool {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	connected := make(map[string]bool)
+	for address := range (*p).Outbound {
+		connected[address] = true
+	}
+	for address := range (*p).Inbound {
+		connected[address] = true
+	}
+	return connected
+}
+
+func (p *PeerManager) AddOutbound(address string) {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	(*p).Outbound[address] = true
+}
+
+/**
+ * Records a connection opened by another client.  Returns false if the
+ * client already has as many inbound connections as it allows.
+ */
+func (p *PeerManager) AddInbound(address string) bool {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	if (*p).Outbound[address] || (*p).Inbound[address] {
+		return true
+	}
+	if len((*p).Inbound) >= (*p).MaxInbound {
+		return false
+	}
+	(*p).Inbound[address] = true
+	return true
+}
+
+func (p *PeerManager) Remove(address string) {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	delete((*p).Outbound, address)
+	delete((*p).Inbound, address)
+}
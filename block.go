@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -24,17 +25,50 @@ type BalanceType struct {
 	Balance uint32
 }
 
+// Gold locked by a validator for proof-of-stake.
+type StakeType struct {
+	Id    string
+	Stake uint32
+}
+
+// Rewards earned by mining a block, which cannot be spent until
+// COINBASE_MATURITY blocks have been built on top of it.
+type ImmatureRewardType struct {
+	Id     string
+	Amount uint32
+	Height uint32
+}
+
 type Block struct {
-	PrevBlockHash  string
-	Target         big.Int
-	Proof          uint32
-	Balances       []BalanceType
-	NextNonce      []NextNonceType
-	Transactions   []TransactionType
-	ChainLength    uint32
-	Timestamp      time.Time
-	RewardAddr     string
-	CoinbaseReward uint32
+	PrevBlockHash   string
+	Target          big.Int
+	Proof           uint32
+	ExtraNonce      uint32
+	Slot            uint64
+	LeaderKey       *rsa.PublicKey
+	VrfProof        []byte
+	Signature       []byte
+	Balances        []BalanceType
+	Stakes          []StakeType
+	ImmatureRewards []ImmatureRewardType
+	NextNonce       []NextNonceType
+	Transactions    []TransactionType
+	ChainLength     uint32
+	Timestamp       time.Time
+	RewardAddr      string
+	CoinbaseReward  uint32
+}
+
+// Copies the fields a consensus engine sets while sealing from a sealed copy of the block.
+func (block *Block) copySeal(sealed *Block) {
+	block.Proof = sealed.Proof
+	block.ExtraNonce = sealed.ExtraNonce
+	block.Timestamp = sealed.Timestamp
+	block.Slot = sealed.Slot
+	block.RewardAddr = sealed.RewardAddr
+	block.LeaderKey = sealed.LeaderKey
+	block.VrfProof = sealed.VrfProof
+	block.Signature = sealed.Signature
 }
 
 func (block *Block) FindTransactionIndex(id string) int {
@@ -70,11 +104,32 @@ func (block *Block) FindBalanceIndex(id string) int {
 	return index
 }
 
+func (block *Block) FindStakeIndex(id string) int {
+	index := int(-1)
+	for i, v := range block.Stakes {
+		if v.Id == id {
+			index = i
+			break
+		}
+	}
+	return index
+}
+
 func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseReward uint32) *Block {
 	var block Block
 	block.Target = *target
 	block.Proof = 0
 
+	// Changed whenever every value of Proof has been tried, so that the
+	// search can go on with a new header.
+	block.ExtraNonce = 0
+
+	// Filled in by the proof-of-stake engine instead of the proof.
+	block.Slot = 0
+	block.LeaderKey = nil
+	block.VrfProof = nil
+	block.Signature = nil
+
 	if prevBlock != nil {
 		hashHexStr := prevBlock.GetHash()
 		block.PrevBlockHash = hashHexStr
@@ -86,6 +141,16 @@ func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseRewa
 		block.Balances = append(block.Balances, (*prevBlock).Balances...)
 	}
 
+	block.ImmatureRewards = make([]ImmatureRewardType, 0)
+	if prevBlock != nil && (*prevBlock).ImmatureRewards != nil {
+		block.ImmatureRewards = append(block.ImmatureRewards, (*prevBlock).ImmatureRewards...)
+	}
+
+	block.Stakes = make([]StakeType, 0)
+	if prevBlock != nil && (*prevBlock).Stakes != nil {
+		block.Stakes = append(block.Stakes, (*prevBlock).Stakes...)
+	}
+
 	block.NextNonce = make([]NextNonceType, 0)
 	if prevBlock != nil && (*prevBlock).NextNonce != nil {
 		block.NextNonce = append(block.NextNonce, (*prevBlock).NextNonce...)
@@ -101,6 +166,7 @@ func NewBlock(rewardAddr string, prevBlock *Block, target *big.Int, coinbaseRewa
 	block.ChainLength = 0
 	if prevBlock != nil {
 		block.ChainLength = (*prevBlock).ChainLength + 1
+		block.lockRewards(prevBlock)
 	}
 
 	block.Timestamp = time.Now()
@@ -128,30 +194,86 @@ func BytesToBlock(data []byte) *Block {
 	return &block
 }
 
-func (block *Block) GetHash() string {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
+/**
+ * The part of a block covered by its hash.  Transactions are committed to
+ * through TxRoot, so a header alone is enough to check the proof-of-work.
+ */
+type BlockHeader struct {
+	PrevBlockHash  string
+	Target         big.Int
+	Proof          uint32
+	ExtraNonce     uint32
+	Slot           uint64
+	LeaderKey      *rsa.PublicKey
+	VrfProof       []byte
+	Signature      []byte
+	TxRoot         string
+	ChainLength    uint32
+	Timestamp      time.Time
+	RewardAddr     string
+	CoinbaseReward uint32
+}
 
-	blockData := BlockToBytes(&block4hash)
-	var blockHash [32]byte
+func (block *Block) Header() BlockHeader {
+	var header BlockHeader
+	header.PrevBlockHash = (*block).PrevBlockHash
+	header.Target = (*block).Target
+	header.Proof = (*block).Proof
+	header.ExtraNonce = (*block).ExtraNonce
+	header.Slot = (*block).Slot
+	header.LeaderKey = (*block).LeaderKey
+	header.VrfProof = (*block).VrfProof
+	header.Signature = (*block).Signature
+	header.TxRoot = block.TxRoot()
+	header.ChainLength = (*block).ChainLength
+	header.Timestamp = (*block).Timestamp
+	header.RewardAddr = (*block).RewardAddr
+	header.CoinbaseReward = (*block).CoinbaseReward
+	return header
+}
 
-	blockHash = sha256.Sum256(blockData)
-	return hex.EncodeToString(blockHash[:])
+// Hash of the IDs of all transactions in the block, in order.
+func (block *Block) TxRoot() string {
+	hasher := sha256.New()
+	for _, v := range (*block).Transactions {
+		hasher.Write([]byte(v.Id))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
 
+func (header *BlockHeader) GetHash() string {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return ""
+	}
+	headerHash := sha256.Sum256(data)
+	return hex.EncodeToString(headerHash[:])
 }
 
-func (block *Block) GetHashStr() string {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
+func (header *BlockHeader) hasValidProof() bool {
+	return header.meetsTarget(&(*header).Target)
+}
 
-	blockData := BlockToBytes(&block4hash)
-	var blockHash [32]byte
+// Determines whether the hash of the header is below a target, which may differ from its own.
+func (header *BlockHeader) meetsTarget(target *big.Int) bool {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return false
+	}
+	header_hash := sha256.Sum256(data)
+	header_value := big.NewInt(0)
+	header_value.SetBytes(header_hash[:])
 
-	blockHash = sha256.Sum256(blockData)
-	return hex.EncodeToString(blockHash[:])
+	return header_value.Cmp(target) < 0
+}
 
+func (block *Block) GetHash() string {
+	header := block.Header()
+	return header.GetHash()
+}
+
+func (block *Block) GetHashStr() string {
+	return block.GetHash()
 }
 
 func (block *Block) IsGenesisBlock() bool {
@@ -159,25 +281,22 @@ func (block *Block) IsGenesisBlock() bool {
 }
 
 func (block *Block) hasValidProof() bool {
-	block4hash := *block
-	block4hash.Balances = nil
-	block4hash.NextNonce = nil
-	data := BlockToBytes(&block4hash)
-	block_hash := sha256.Sum256(data)
-	block_value := big.NewInt(0)
-	block_value.SetBytes(block_hash[:])
-
-	return block_value.Cmp(&(*block).Target) < 0
+	header := block.Header()
+	return header.hasValidProof()
 }
 
 func (block *Block) AddTransaction(tx *Transaction) bool {
+	return block.addTransaction(tx, true)
+}
+
+func (block *Block) addTransaction(tx *Transaction, checkSignature bool) bool {
 	if (*block).Contains(tx) {
 		fmt.Printf("Duplicate transaction %s", tx.Id())
 		return false
 	} else if (*tx).Sig == nil {
 		fmt.Printf("Unsigned transaction %s", tx.Id())
 		return false
-	} else if !tx.ValidSignature() {
+	} else if checkSignature && !tx.ValidSignature() {
 		fmt.Printf("Invalid signature for transaction %s", tx.Id())
 		return false
 	} else if !block.HasSufficientFund(tx) {
@@ -212,6 +331,11 @@ func (block *Block) AddTransaction(tx *Transaction) bool {
 	(*block).Balances[senderBalanceIndex].Balance = senderBalance - tx.TotalOutput()
 
 	for _, output := range (*tx).Info.Outputs {
+		// Gold sent to the stake address is locked as the sender's stake.
+		if output.Address == STAKE_ADDRESS {
+			block.AddStake((*tx).Info.From, output.Amount)
+			continue
+		}
 		var oldBalance uint32 = (*block).BalanceOf(output.Address)
 		oldBalanceId := block.FindBalanceIndex(output.Address)
 		if oldBalanceId == -1 {
@@ -226,6 +350,15 @@ func (block *Block) AddTransaction(tx *Transaction) bool {
 }
 
 func (block *Block) Rerun(prevBlock *Block) bool {
+	return block.rerun(prevBlock, true)
+}
+
+// Reruns a block known to be valid, without checking the signatures of its transactions.
+func (block *Block) RerunAssumeValid(prevBlock *Block) bool {
+	return block.rerun(prevBlock, false)
+}
+
+func (block *Block) rerun(prevBlock *Block, checkSignatures bool) bool {
 
 	if prevBlock == nil {
 		return false
@@ -243,25 +376,24 @@ func (block *Block) Rerun(prevBlock *Block) bool {
 		block.NextNonce = append(block.NextNonce, (*prevBlock).NextNonce...)
 	}
 
-	// Adding coinbase reward for prevBlock.
-	if (*prevBlock).RewardAddr != "" {
-		var winnerBalance uint32 = (*prevBlock).BalanceOf((*prevBlock).RewardAddr)
-		index := block.FindBalanceIndex((*prevBlock).RewardAddr)
+	block.ImmatureRewards = make([]ImmatureRewardType, 0)
+	if prevBlock != nil && (*prevBlock).ImmatureRewards != nil {
+		block.ImmatureRewards = append(block.ImmatureRewards, (*prevBlock).ImmatureRewards...)
+	}
 
-		if index == -1 {
-			newBalance := BalanceType{Id: (*prevBlock).RewardAddr, Balance: winnerBalance + prevBlock.CoinbaseReward}
-			(*block).Balances = append((*block).Balances, newBalance)
-		} else {
-			(*block).Balances[index].Balance = winnerBalance + prevBlock.CoinbaseReward
-		}
+	block.Stakes = make([]StakeType, 0)
+	if prevBlock != nil && (*prevBlock).Stakes != nil {
+		block.Stakes = append(block.Stakes, (*prevBlock).Stakes...)
 	}
 
+	block.lockRewards(prevBlock)
+
 	// Re-enter all transactions
 	txMap := make([]TransactionType, len((*block).Transactions))
 	copy(txMap, (*block).Transactions)
 	(*block).Transactions = make([]TransactionType, 0)
 	for _, v := range txMap {
-		if !block.AddTransaction(&v.Tx) {
+		if !block.addTransaction(&v.Tx, checkSignatures) {
 			return false
 		}
 	}
@@ -278,6 +410,86 @@ func (block *Block) BalanceOf(address string) uint32 {
 	}
 }
 
+// Gets the gold of a user that has been earned by mining, but that
+// cannot be spent until the reward matures.
+func (block *Block) ImmatureBalanceOf(address string) uint32 {
+	var total uint32 = 0
+	for _, v := range block.ImmatureRewards {
+		if v.Id == address {
+			total += v.Amount
+		}
+	}
+	return total
+}
+
+// Gets the gold a validator has locked as stake.
+func (block *Block) StakeOf(address string) uint32 {
+	index := block.FindStakeIndex(address)
+	if index > -1 {
+		return block.Stakes[index].Stake
+	} else {
+		return 0
+	}
+}
+
+// The gold locked as stake by all validators.
+func (block *Block) TotalStake() uint64 {
+	var total uint64 = 0
+	for _, v := range block.Stakes {
+		total += uint64(v.Stake)
+	}
+	return total
+}
+
+/**
+ * Locks gold as a validator's stake.  Staked gold is no longer part of the
+ * validator's balance, and cannot be spent.
+ */
+func (block *Block) AddStake(address string, amount uint32) {
+	index := block.FindStakeIndex(address)
+	if index == -1 {
+		newStake := StakeType{Id: address, Stake: amount}
+		(*block).Stakes = append((*block).Stakes, newStake)
+	} else {
+		(*block).Stakes[index].Stake += amount
+	}
+}
+
+/**
+ * The coinbase reward and fees for prevBlock are locked until the block
+ * has enough confirmations, in case prevBlock is orphaned.  Rewards that
+ * have matured by this block's height are paid out.
+ */
+func (block *Block) lockRewards(prevBlock *Block) {
+	if (*prevBlock).RewardAddr != "" {
+		reward := ImmatureRewardType{Id: (*prevBlock).RewardAddr, Amount: prevBlock.TotalRewards(), Height: (*prevBlock).ChainLength}
+		(*block).ImmatureRewards = append((*block).ImmatureRewards, reward)
+	}
+	block.MatureRewards()
+}
+
+/**
+ * Moves any rewards that have reached COINBASE_MATURITY confirmations
+ * into the spendable balances of their owners.
+ */
+func (block *Block) MatureRewards() {
+	stillImmature := make([]ImmatureRewardType, 0)
+	for _, reward := range (*block).ImmatureRewards {
+		if (*block).ChainLength < reward.Height+COINBASE_MATURITY {
+			stillImmature = append(stillImmature, reward)
+			continue
+		}
+		index := block.FindBalanceIndex(reward.Id)
+		if index == -1 {
+			newBalance := BalanceType{Id: reward.Id, Balance: reward.Amount}
+			(*block).Balances = append((*block).Balances, newBalance)
+		} else {
+			(*block).Balances[index].Balance += reward.Amount
+		}
+	}
+	(*block).ImmatureRewards = stillImmature
+}
+
 func (block *Block) HasSufficientFund(tx *Transaction) bool {
 	var totalOutput uint32 = (*tx).TotalOutput()
 	return totalOutput <= (*block).BalanceOf(tx.Info.From)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"spartangold/utils"
+	"time"
 )
 
 // Network message constants
@@ -10,22 +11,87 @@ const POST_TRANSACTION string = "POST_TRANSACTION"
 const PROOF_FOUND string = "PROOF_FOUND"
 const START_MINING string = "START_MINING"
 
+// Network message constants for announcing and requesting inventory
+const INV string = "INV"
+const GETDATA string = "GETDATA"
+const NOTFOUND string = "NOTFOUND"
+
+// Network message constants for compact block relay
+const CMPCTBLOCK string = "CMPCTBLOCK"
+const GETBLOCKTXN string = "GETBLOCKTXN"
+const BLOCKTXN string = "BLOCKTXN"
+
+// Network message constants for the handshake on new connections
+const VERSION string = "VERSION"
+const VERACK string = "VERACK"
+
+// Network message constants for peer discovery
+const GETADDR string = "GETADDR"
+const ADDR string = "ADDR"
+
+// Network message constants for headers-first synchronization
+const GET_HEAD string = "GET_HEAD"
+const HEAD string = "HEAD"
+const GET_HEADERS string = "GET_HEADERS"
+const HEADERS string = "HEADERS"
+const GET_BLOCKS string = "GET_BLOCKS"
+
+// Network message constants for checkpoint finality
+const CHECKPOINT_VOTE string = "CHECKPOINT_VOTE"
+const GET_CHECKPOINT string = "GET_CHECKPOINT"
+const CHECKPOINT string = "CHECKPOINT"
+
+// Local events emitted by a node when its head moves
+const BLOCK_CONNECTED string = "BLOCK_CONNECTED"
+const BLOCK_DISCONNECTED string = "BLOCK_DISCONNECTED"
+
 // Constants for mining
 const NUM_ROUNDS_MINING uint32 = 2000
 
+// Hashes per second shared by all miners in the hashrate simulation
+const SIMULATED_TOTAL_HASHRATE float64 = 100000
+
+// Hashes per second shared by all miners in attack simulations.  Blocks
+// come slower, so that forks are caused by the attacker rather than by
+// propagation delays.
+const SIMULATED_ATTACK_HASHRATE float64 = 15000
+
 // Constants related to proof-of-work target
 const POW_BASE_TARGET_STR string = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
 const POW_LEADING_ZEROES uint32 = 15
 
+// Consensus engines a network can run
+const CONSENSUS_POW string = "pow"
+const CONSENSUS_POS string = "pos"
+
+// Constants for proof-of-stake.  Outputs paid to STAKE_ADDRESS lock the
+// sender's gold as stake.  A slot has a leader POS_ACTIVE_SLOT_PERCENT of
+// the time on average, and blocks may be up to POS_MAX_CLOCK_DRIFT slots
+// ahead of a node's clock.
+const STAKE_ADDRESS string = "STAKE"
+const POS_SLOT_DURATION time.Duration = 500 * time.Millisecond
+const POS_ACTIVE_SLOT_PERCENT uint64 = 25
+const POS_MAX_CLOCK_DRIFT uint64 = 2
+
 // Constants for mining rewards and default transaction fees
 const COINBASE_AMT_ALLOWED uint32 = 25
 const DEFAULT_TX_FEE uint32 = 1
 
+// Coinbase rewards and fees can only be spent once the block that earned
+// them has this many blocks on top of it, so that a reward from a block
+// that is later orphaned is never spent.
+const COINBASE_MATURITY uint32 = 10
+
 // If a block is 6 blocks older than the current block, it is considered
 // confirmed, for no better reason than that is what Bitcoin does.
 // Note that the genesis block is always considered to be confirmed.
 const CONFIRMED_DEPTH uint32 = 6
 
+// With checkpoint finality, validators vote on every CHECKPOINT_INTERVAL-th
+// block once it has FINALITY_VOTE_DEPTH blocks on top of it.
+const CHECKPOINT_INTERVAL uint32 = 5
+const FINALITY_VOTE_DEPTH uint32 = 2
+
 // Produces a new genesis block, giving the specified client balances
 func MakeGenesisDefault(starting_balances map[string]uint32) *Block {
 	if starting_balances == nil {
@@ -42,3 +108,12 @@ func MakeGenesisDefault(starting_balances map[string]uint32) *Block {
 
 	return genesis
 }
+
+// Produces a new genesis block for proof-of-stake, with gold already locked by the validators.
+func MakeGenesisStaked(starting_balances map[string]uint32, starting_stakes map[string]uint32) *Block {
+	genesis := MakeGenesisDefault(starting_balances)
+	for validator_address, validator_stake := range starting_stakes {
+		genesis.AddStake(validator_address, validator_stake)
+	}
+	return genesis
+}
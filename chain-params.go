@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A block that every node must have at the height.
+type Checkpoint struct {
+	Height uint32
+	Hash   string
+}
+
+/**
+ * Parameters of the chain that a node is shipped with.  Branches that
+ * conflict with a checkpoint are rejected.  Blocks that are ancestors of
+ * the assume-valid block are not checked for transaction signatures during
+ * the initial sync, since the block was checked before the node was
+ * released, which speeds up catching up with a long chain.
+ */
+type ChainParams struct {
+	Checkpoints []Checkpoint
+	AssumeValid string
+}
+
+// Parameters with no checkpoints, where every block is fully checked.
+func DefaultChainParams() *ChainParams {
+	var p ChainParams
+	p.Checkpoints = make([]Checkpoint, 0)
+	p.AssumeValid = ""
+	return &p
+}
+
+func NewChainParams(checkpoints []Checkpoint, assumeValid string) *ChainParams {
+	var p ChainParams
+	p.Checkpoints = append([]Checkpoint{}, checkpoints...)
+	sort.Slice(p.Checkpoints, func(i, j int) bool {
+		return p.Checkpoints[i].Height < p.Checkpoints[j].Height
+	})
+	p.AssumeValid = assumeValid
+	return &p
+}
+
+/**
+ * Checks a new block, or header, against the checkpoints.  A block at the
+ * height of a checkpoint must be the checkpoint, a block above it must have
+ * the checkpoint as its ancestor, as far as its ancestors are known, and
+ * once the last checkpoint is known, no new block may fork off below it.
+ */
+func (p *ChainParams) CheckBlock(height uint32, blockId string, prevHash string, blocks map[string]*Block) error {
+	if len((*p).Checkpoints) == 0 {
+		return nil
+	}
+	var below *Checkpoint
+	for i, checkpoint := range (*p).Checkpoints {
+		if checkpoint.Height == height && checkpoint.Hash != blockId {
+			return fmt.Errorf("block %v conflicts with the checkpoint at height %d", blockId, height)
+		}
+		if checkpoint.Height < height {
+			below = &(*p).Checkpoints[i]
+		}
+	}
+	// The checkpoints are sorted, so the chain matching the highest one below the block matches them all.
+	if below != nil {
+		ancestor := blocks[prevHash]
+		for ancestor != nil && (*ancestor).ChainLength > (*below).Height {
+			ancestor = blocks[(*ancestor).PrevBlockHash]
+		}
+		if ancestor != nil && ancestor.GetHash() != (*below).Hash {
+			return fmt.Errorf("block %v is not on the chain of the checkpoint at height %d", blockId, (*below).Height)
+		}
+	}
+	last := (*p).Checkpoints[len((*p).Checkpoints)-1]
+	if _, ok := blocks[last.Hash]; ok && height <= last.Height && blockId != last.Hash {
+		return fmt.Errorf("block %v forks off below the checkpoint at height %d", blockId, last.Height)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+// Builds a chain of the length on the parent, with the extra nonce telling forks apart.
+func testChain(blocks map[string]*Block, parent *Block, length int, fork uint32) []*Block {
+	chain := make([]*Block, 0, length)
+	for i := 0; i < length; i++ {
+		block := &Block{PrevBlockHash: parent.GetHash(), ChainLength: parent.ChainLength + 1, ExtraNonce: fork}
+		blocks[block.GetHash()] = block
+		chain = append(chain, block)
+		parent = block
+	}
+	return chain
+}
+
+func TestChainParamsCheckBlock(t *testing.T) {
+	blocks := make(map[string]*Block)
+	genesis := &Block{}
+	blocks[genesis.GetHash()] = genesis
+	main := testChain(blocks, genesis, 6, 0)
+	fork := testChain(blocks, genesis, 6, 1)
+	unknownParent := &Block{PrevBlockHash: "unknown", ChainLength: 5}
+
+	params := NewChainParams([]Checkpoint{
+		{Height: 4, Hash: main[3].GetHash()},
+		{Height: 2, Hash: main[1].GetHash()},
+	}, "")
+
+	tests := []struct {
+		name    string
+		params  *ChainParams
+		block   *Block
+		wantErr bool
+	}{
+		{"no checkpoints", DefaultChainParams(), fork[4], false},
+		{"the checkpoint itself", params, main[3], false},
+		{"a block on the checkpoint's chain", params, main[5], false},
+		{"a block below a checkpoint not received yet", NewChainParams([]Checkpoint{{Height: 4, Hash: "later"}}, ""), fork[0], false},
+		{"another block at a checkpoint's height", params, fork[1], true},
+		{"a block between checkpoints on another chain", params, fork[2], true},
+		{"a block above the checkpoints on another chain", params, fork[5], true},
+		{"a block whose ancestors are unknown", params, unknownParent, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block := tt.block
+			err := tt.params.CheckBlock(block.ChainLength, block.GetHash(), block.PrevBlockHash, blocks)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckBlock() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("no fork below the last checkpoint once it is known", func(t *testing.T) {
+		late := &Block{PrevBlockHash: main[1].GetHash(), ChainLength: 3, ExtraNonce: 2}
+		if err := params.CheckBlock(late.ChainLength, late.GetHash(), late.PrevBlockHash, blocks); err == nil {
+			t.Fatal("CheckBlock() accepted a fork below the last checkpoint")
+		}
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"spartangold/utils"
 	"sync"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 )
@@ -22,13 +23,25 @@ type Client struct {
 	Blocks                      map[string]*Block
 	PendingOutgoingTransactions map[string]*Transaction
 	PendingReceivedTransactions map[string]*Transaction
-	PendingBlocks               map[string]*utils.Set[*Block]
+	PendingBlocks               *OrphanPool
+	Sync                        *ChainSync
+	Inventory                   *Inventory
+	CompactBlocks               *CompactBlocks
+	Peers                       *PeerManager
+	Misbehavior                 *MisbehaviorTracker
+	Engine                      ConsensusEngine
+	Finality                    *FinalityGadget
+	Params                      *ChainParams
+	ConfirmedDepth              uint32
+	Mempool                     *utils.Set[*Transaction]
 	LastBlock                   *Block
 	LastConfirmedBlock          *Block
 	ReceivedBlock               *Block
 	Nonce                       uint32
-	Net                         *FakeNet
+	Net                         Transport
+	Messenger                   *Messenger
 	Emitter                     *emission.Emitter
+	Inbox                       *Inbox
 	mu                          sync.Mutex
 }
 
@@ -37,7 +50,7 @@ type Message struct {
 	PrevBlockHash string
 }
 
-func NewClient(name string, Net *FakeNet, startingBlock *Block) *Client {
+func NewClient(name string, Net Transport, startingBlock *Block) *Client {
 	var c Client
 	c.Net = Net
 	c.Name = name
@@ -45,6 +58,7 @@ func NewClient(name string, Net *FakeNet, startingBlock *Block) *Client {
 	c.PrivKey, c.PubKey = utils.GenerateKeypair()
 
 	c.Address = utils.CalcAddress(c.PubKey)
+	c.Messenger = NewMessenger(c.Address, c.PrivKey, Net)
 	// Establishes order of transactions.  Incremented with each
 	// new output transaction from this client.  This feature
 	// avoids replay attacks.
@@ -60,9 +74,35 @@ func NewClient(name string, Net *FakeNet, startingBlock *Block) *Client {
 	// A map of all block hashes to the accepted blocks.
 	c.Blocks = make(map[string]*Block)
 
-	// A map of missing block IDS to the list of blocks depending
-	// on the missing blocks.
-	c.PendingBlocks = make(map[string]*utils.Set[*Block])
+	// Blocks depending on missing blocks, indexed by the missing block IDs.
+	c.PendingBlocks = NewOrphanPool()
+
+	// Progress of catching up with the rest of the network.
+	c.Sync = NewChainSync()
+
+	// The transactions and blocks known to each peer.
+	c.Inventory = NewInventory()
+
+	// Compact blocks waiting for transactions that were not in the mempool.
+	c.CompactBlocks = NewCompactBlocks()
+
+	// The peers this client has heard about and is connected to.
+	c.Peers = NewPeerManager()
+
+	// Scores of misbehaving peers, and the peers banned for it.
+	c.Misbehavior = NewMisbehaviorTracker()
+
+	// How blocks are sealed and verified, and which chain wins.
+	c.Engine = NewPowEngine(NUM_ROUNDS_MINING)
+
+	// Checkpoints and the assume-valid block the client was shipped with.
+	c.Params = DefaultChainParams()
+
+	// Blocks are confirmed once this many blocks are built on top of them.
+	c.ConfirmedDepth = CONFIRMED_DEPTH
+
+	// Transactions seen on the network that are not in the current chain.
+	c.Mempool = utils.NewSet[*Transaction]()
 
 	if startingBlock != nil {
 		c.SetGenesisBlock(startingBlock)
@@ -70,8 +110,30 @@ func NewClient(name string, Net *FakeNet, startingBlock *Block) *Client {
 
 	// Setting up listeners to receive messages from other clients.
 	c.Emitter = emission.NewEmitter()
-	c.Emitter.On(PROOF_FOUND, c.ReceiveBlockBytes)
-	c.Emitter.On(MISSING_BLOCK, c.ProvideMissingBlock)
+	c.Inbox = NewInbox(c.Emitter)
+	c.HandleMessage(PROOF_FOUND, func(from string, bs []byte) {
+		c.ReceiveBlockBytes(from, bs)
+	})
+	c.HandleMessage(MISSING_BLOCK, c.ProvideMissingBlock)
+	c.HandleMessage(VERSION, c.ReceiveVersion)
+	c.HandleMessage(VERACK, c.ReceiveVerack)
+	c.HandleMessage(GETADDR, c.ProvideAddresses)
+	c.HandleMessage(ADDR, c.ReceiveAddresses)
+	c.HandleMessage(INV, c.ReceiveInv)
+	c.HandleMessage(GETDATA, c.ProvideData)
+	c.HandleMessage(NOTFOUND, c.ReceiveNotFound)
+	c.HandleMessage(CMPCTBLOCK, c.ReceiveCompactBlock)
+	c.HandleMessage(GETBLOCKTXN, c.ProvideBlockTxn)
+	c.HandleMessage(BLOCKTXN, c.ReceiveBlockTxn)
+	c.HandleMessage(GET_HEAD, c.ProvideHead)
+	c.HandleMessage(HEAD, c.ReceiveHead)
+	c.HandleMessage(GET_HEADERS, c.ProvideHeaders)
+	c.HandleMessage(HEADERS, c.ReceiveHeaders)
+	c.HandleMessage(GET_BLOCKS, c.ProvideBlocks)
+	c.HandleMessage(CHECKPOINT_VOTE, c.ReceiveCheckpointVote)
+	c.HandleMessage(GET_CHECKPOINT, c.ProvideCheckpoint)
+	c.HandleMessage(CHECKPOINT, c.ReceiveCheckpoint)
+	c.HandleMessage(POST_TRANSACTION, c.AddTransactionBytes)
 	return &c
 }
 
@@ -98,9 +160,15 @@ func (c *Client) ConfirmedBalance() uint32 {
 	return (*c).LastConfirmedBlock.BalanceOf((*c).Address)
 }
 
+// Mining rewards and fees earned by the client that have not yet matured,
+// looking at the last block seen.  This gold is not counted as confirmed.
+func (c *Client) ImmatureBalance() uint32 {
+	return (*c).LastBlock.ImmatureBalanceOf((*c).Address)
+}
+
 /**
  * Any gold received in the last confirmed block or before is considered
- * spendable, but any gold received more recently is not yet available.
+ * spendable, as long as any mining reward has matured, but any gold received more recently is not yet available.
  * However, any gold given by the client to other clients in unconfirmed
  * transactions is treated as unavailable.
  */
@@ -112,6 +180,13 @@ func (c *Client) AvailableGold() uint32 {
 	return c.ConfirmedBalance() - pendingSpent
 }
 
+// Like AvailableGold, for callers that do not hold the client's lock.
+func (c *Client) SpendableGold() uint32 {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	return c.AvailableGold()
+}
+
 /**
  * Broadcasts a transaction from the client giving gold to the clients
  * specified in 'outputs'. A transaction fee may be specified, which can
@@ -134,13 +209,23 @@ func (c *Client) PostTransaction(outputs []Output, fee uint32) *Transaction {
 	tx.Sign((*c).PrivKey)
 	(*c).PendingOutgoingTransactions[tx.Id()] = tx
 	(*c).Nonce++
-	data := TransactionToBytes(tx)
-	// Create and broadcast the transaction.
-	(*c).Net.Broadcast(POST_TRANSACTION, data)
+	// Announce the transaction to peers, who will request it.
+	(*c).Mempool.Add(tx)
+	(*c).Inventory.MarkSeen(tx.Id())
+	(*c).Net.ItemSeen((*c).Address, tx.Id())
+	c.Announce(InvItem{Type: INV_TX, Id: tx.Id()})
 
 	return tx
 }
 
+/**
+ * Locks gold as stake, so that the client can lead slots under
+ * proof-of-stake.  Staked gold cannot be spent again.
+ */
+func (c *Client) Stake(amount uint32, fee uint32) *Transaction {
+	return c.PostTransaction([]Output{{Address: STAKE_ADDRESS, Amount: amount}}, fee)
+}
+
 /**
  * Validates and adds a block to the list of blocks, possibly updating the head
  * of the blockchain.  Any transactions in the block are rerun in order to
@@ -151,10 +236,13 @@ func (c *Client) PostTransaction(outputs []Output, fee uint32) *Transaction {
  * If any blocks cannot be connected to an existing block but seem otherwise valid,
  * they are added to a list of pending blocks and a request is sent out to get the
  * missing blocks from other clients.*/
-func (c *Client) ReceiveBlock(b Block) *Block {
+func (c *Client) ReceiveBlock(from string, b Block) *Block {
 	(*c).mu.Lock()
 	defer (*c).mu.Unlock()
 
+	// Incoming blocks are also a chance to clean up the orphan pool.
+	c.RetryMissingBlocks()
+
 	block := &b
 	blockId := block.GetHash()
 
@@ -162,74 +250,605 @@ func (c *Client) ReceiveBlock(b Block) *Block {
 		return nil
 	}
 
-	if !block.hasValidProof() && !block.IsGenesisBlock() {
-		c.Log(fmt.Sprintf("Block %v does not have a valid proof\n", blockId))
-		return nil
+	if !block.IsGenesisBlock() {
+		if err := (*c).Engine.VerifySeal(block, nil); err != nil {
+			c.Log(fmt.Sprintf("Block %v does not have a valid seal: %v\n", blockId, err))
+			c.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("block %v without a valid seal", blockId))
+			return nil
+		}
 	}
 
 	//var prevBlock *Block = nil
+	if err := (*c).Params.CheckBlock((*block).ChainLength, blockId, (*block).PrevBlockHash, (*c).Blocks); err != nil {
+		c.Log(fmt.Sprintf("Rejected block: %v", err))
+		c.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
+		return nil
+	}
+
 	prevBlock, received := (*c).Blocks[(*block).PrevBlockHash]
 	if !received && !block.IsGenesisBlock() {
-
-		stuckBlocks, received := (*c).PendingBlocks[(*block).PrevBlockHash]
-		if !received {
-			c.RequestMissingBlock(block)
-			// TODO: Define a set
-			stuckBlocks = utils.NewSet[*Block]()
+		// Parents that are already being downloaded during a sync are not requested.
+		if (*c).PendingBlocks.Add(block, from) && !(*c).Sync.Expects((*block).PrevBlockHash) &&
+			(*c).PendingBlocks.ShouldRequest((*block).PrevBlockHash) {
+			c.RequestMissingBlock((*block).PrevBlockHash)
 		}
-		stuckBlocks.Add(block)
-		(*c).PendingBlocks[(*block).PrevBlockHash] = stuckBlocks
 		return nil
-
 	}
 
 	if !block.IsGenesisBlock() {
-		if !block.Rerun(prevBlock) {
+		// Engines may check the seal against the parent, e.g. its validators.
+		if err := (*c).Engine.VerifySeal(block, prevBlock); err != nil {
+			c.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("block %v with an invalid seal: %v", blockId, err))
+			return nil
+		}
+		// Blocks below the assume-valid block are not checked for signatures during a sync.
+		var valid bool
+		if (*c).Sync.IsAssumedValid(blockId) {
+			valid = block.RerunAssumeValid(prevBlock)
+		} else {
+			valid = block.Rerun(prevBlock)
+		}
+		if !valid {
+			c.Penalize(from, PENALTY_INVALID_BLOCK, fmt.Sprintf("block %v with invalid transactions", blockId))
 			return nil
 		}
 	}
 
 	blockId = block.GetHash()
 	(*c).Blocks[blockId] = block
+	(*c).Inventory.MarkSeen(blockId)
+	(*c).Net.ItemSeen((*c).Address, blockId)
+	c.Announce(InvItem{Type: INV_BLOCK, Id: blockId})
 
-	if (*(*c).LastBlock).ChainLength < (*block).ChainLength {
-		(*c).LastBlock = block
-		c.SetLastConfirmed()
+	// Chains that do not include the final checkpoint are never adopted.
+	if (*c).Engine.Weight(block).Cmp((*c).Engine.Weight((*c).LastBlock)) > 0 && c.OnFinalChain(block) {
+		c.SetLastBlock(block)
 	}
-
-	unstuckBlocks, received := (*c).PendingBlocks[blockId]
-	var unstuckBlocksArr []*Block
-	if received {
-		unstuckBlocksArr = unstuckBlocks.ToArray()
+	if (*c).Finality != nil {
+		if (*c).Finality.FinalizeHeld(c.descendsFrom) {
+			checkpointId, height := (*c).Finality.Finalized()
+			c.Log(fmt.Sprintf("checkpoint %v at height %d is final", checkpointId, height))
+			c.ApplyFinality()
+		} else if checkpointId, _ := (*c).Finality.Finalized(); checkpointId == blockId {
+			c.ApplyFinality()
+		}
 	}
 
-	delete((*c).PendingBlocks, blockId)
+	if (*c).Sync.IsSyncing() {
+		(*c).Sync.BlockReceived(blockId)
+		c.RequestBlocks()
+	}
 
-	for _, uBlock := range unstuckBlocksArr {
-		c.Log(fmt.Sprintf("processing unstuck block %v", uBlock.GetHashStr()))
-		// Need to change the "" into empty []byte
-		go c.ReceiveBlock(*uBlock)
+	unstuckBlocks := (*c).PendingBlocks.RemoveChildren(blockId)
+	for _, uBlock := range unstuckBlocks {
+		c.Log(fmt.Sprintf("processing unstuck block %v", uBlock.Block.GetHashStr()))
+		go c.ReceiveBlock(uBlock.Peer, *uBlock.Block)
 	}
 	c.Log(fmt.Sprintf("block %s received", block.GetHashStr()))
 	return block
 }
 
-func (c *Client) ReceiveBlockBytes(bs []byte) *Block {
+func (c *Client) ReceiveBlockBytes(from string, bs []byte) *Block {
 
 	block := BytesToBlock(bs)
-	return c.ReceiveBlock(*block)
+	if block == nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block")
+		return nil
+	}
+	(*c).Inventory.MarkKnown(from, block.GetHash())
+	return c.ReceiveBlock(from, *block)
 }
 
-// Request the previous block from the network.
-func (c *Client) RequestMissingBlock(block *Block) {
-	c.Log(fmt.Sprintf("Asking for missing block: %v", (*block).PrevBlockHash))
-	var msg = Message{(*c).Address, (*block).PrevBlockHash}
+// Request a missing block from the network.
+func (c *Client) RequestMissingBlock(blockId string) {
+	c.Log(fmt.Sprintf("Asking for missing block: %v", blockId))
+	var msg = Message{(*c).Address, blockId}
 	jsonByte, err := json.Marshal(msg)
 	if err != nil {
 		fmt.Println("RequestMissingBlock() Marshal Panic:")
 		panic(err)
 	}
-	(*c).Net.Broadcast(MISSING_BLOCK, jsonByte)
+	(*c).Messenger.Broadcast(MISSING_BLOCK, jsonByte)
+}
+
+// Drops expired orphans and asks again for missing blocks whose request timed out.
+func (c *Client) RetryMissingBlocks() {
+	if expired := (*c).PendingBlocks.Expire(); expired > 0 {
+		c.Log(fmt.Sprintf("Dropped %d expired orphan blocks", expired))
+	}
+	for _, blockId := range (*c).PendingBlocks.DueRequests() {
+		c.RequestMissingBlock(blockId)
+	}
+	for _, blockId := range (*c).CompactBlocks.Expire() {
+		if peer, item, ok := (*c).Inventory.Expired(blockId); ok {
+			c.RequestData(peer, []InvItem{item})
+		}
+	}
+	if (*c).Sync.IsSyncing() {
+		c.RequestBlocks()
+	}
+}
+
+/**
+ * Registers a handler for a network message, ignoring messages from banned
+ * peers.  The handler is given the payload of the message once its
+ * envelope has been checked, and peers sending invalid envelopes are penalized.
+ */
+func (c *Client) HandleMessage(msg string, handler func(from string, data []byte)) {
+	(*c).Emitter.On(msg, func(from string, data []byte) {
+		if (*c).Misbehavior.IsBanned(from) {
+			return
+		}
+		envelope, err := (*c).Messenger.Open(from, msg, data)
+		if err != nil {
+			c.Penalize(from, PENALTY_INVALID_ENVELOPE, fmt.Sprintf("%v message: %v", msg, err))
+			return
+		}
+		handler(envelope.Sender, envelope.Payload)
+	})
+}
+
+// Starts the handshake on a new connection by sending the versions this client supports.
+func (c *Client) SendVersion(peer string) {
+	jsonByte, err := json.Marshal(VersionMessage{Version: PROTOCOL_VERSION, MinVersion: MIN_PROTOCOL_VERSION})
+	if err != nil {
+		fmt.Println("SendVersion() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(peer, VERSION, jsonByte)
+}
+
+// Answers a peer's handshake, using the highest version both sides support.
+func (c *Client) ReceiveVersion(from string, data []byte) {
+	if version, ok := c.negotiateVersion(from, data); ok {
+		(*c).Messenger.SetVersion(from, version)
+		jsonByte, err := json.Marshal(VersionMessage{Version: version, MinVersion: MIN_PROTOCOL_VERSION})
+		if err != nil {
+			fmt.Println("ReceiveVersion() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Send(from, VERACK, jsonByte)
+	}
+}
+
+// Completes the handshake with the version chosen by the peer.
+func (c *Client) ReceiveVerack(from string, data []byte) {
+	if version, ok := c.negotiateVersion(from, data); ok {
+		(*c).Messenger.SetVersion(from, version)
+		// Checkpoints finalized before the connection are learned from the peer.
+		if (*c).Finality != nil {
+			(*c).Messenger.Send(from, GET_CHECKPOINT, []byte{})
+		}
+	}
+}
+
+func (c *Client) negotiateVersion(from string, data []byte) (uint32, bool) {
+	var theirs VersionMessage
+	if err := json.Unmarshal(data, &theirs); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed version message")
+		return 0, false
+	}
+	version, err := NegotiateVersion(theirs)
+	if err != nil {
+		c.Log(fmt.Sprintf("Disconnecting %v: %v", from, err))
+		c.disconnectPeer(from)
+		return 0, false
+	}
+	return version, true
+}
+
+/**
+ * Adds to the misbehavior score of a peer, disconnecting and banning
+ * the peer once the score reaches the threshold.
+ */
+func (c *Client) Penalize(from string, penalty int, reason string) {
+	if from == (*c).Address {
+		return
+	}
+	if (*c).Misbehavior.Misbehaving(from, penalty, reason) {
+		c.Log(fmt.Sprintf("Banning %v: %v", from, reason))
+		c.disconnectPeer(from)
+	}
+}
+
+// Bans a peer for the given duration and disconnects from it.
+func (c *Client) BanPeer(address string, duration time.Duration, reason string) {
+	(*c).Misbehavior.Ban(address, duration, reason)
+	c.disconnectPeer(address)
+}
+
+func (c *Client) UnbanPeer(address string) {
+	(*c).Misbehavior.Unban(address)
+}
+
+func (c *Client) BannedPeers() []BanEntry {
+	return (*c).Misbehavior.BanList()
+}
+
+func (c *Client) disconnectPeer(address string) {
+	(*c).Net.Disconnect((*c).Address, address)
+	(*c).Messenger.Forget(address)
+	(*c).Peers.Remove(address)
+	(*c).Peers.Book.Remove(address)
+}
+
+/**
+ * Joins the network through the bootstrap peers, asking each peer that
+ * is connected to for more peers until the target number of outbound
+ * connections is reached.
+ */
+func (c *Client) StartDiscovery(bootstrap ...PeerAddress) {
+	(*c).Peers.Bootstrap = append((*c).Peers.Bootstrap, bootstrap...)
+	for _, peer := range bootstrap {
+		(*c).Peers.Book.Add(peer)
+	}
+	c.FillOutbound()
+}
+
+// Opens outbound connections to the best peers in the address book.
+func (c *Client) FillOutbound() {
+	missing := (*c).Peers.MissingOutbound()
+	if missing <= 0 {
+		return
+	}
+	exclude := (*c).Peers.Connected()
+	exclude[(*c).Address] = true
+	for _, ban := range (*c).Misbehavior.BanList() {
+		exclude[ban.Address] = true
+	}
+	for _, peer := range (*c).Peers.Book.Candidates(missing, exclude) {
+		address, err := (*c).Net.Connect((*c).Address, peer)
+		if err != nil {
+			c.Log(fmt.Sprintf("Could not connect to %v: %v", peer.Key(), err))
+			(*c).Peers.Book.Bad(peer.Key())
+			continue
+		}
+		if address != peer.Key() {
+			// Bootstrap peers may only be known by their endpoint.
+			(*c).Peers.Book.Remove(peer.Key())
+			(*c).Peers.Book.Add(PeerAddress{Address: address, Endpoint: peer.Endpoint})
+		}
+		(*c).Peers.AddOutbound(address)
+		(*c).Peers.Book.Good(address)
+		c.SendVersion(address)
+		jsonByte, err := json.Marshal(c.SelfAddress())
+		if err != nil {
+			fmt.Println("FillOutbound() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Send(address, GETADDR, jsonByte)
+	}
+}
+
+// This client's own peer address, which peers can pass on to others.
+func (c *Client) SelfAddress() PeerAddress {
+	return PeerAddress{Address: (*c).Address, Endpoint: (*c).Net.Endpoint((*c).Address)}
+}
+
+/**
+ * Shares known peers, including this client, with a peer asking for them.
+ * Peers asking on a new connection are counted as inbound, and are
+ * disconnected if there are too many.  The request carries the peer's
+ * own address, which is added to the address book.
+ */
+func (c *Client) ProvideAddresses(from string, data []byte) {
+	if !(*c).Peers.AddInbound(from) {
+		c.Log(fmt.Sprintf("Too many inbound peers, disconnecting %v", from))
+		(*c).Net.Disconnect((*c).Address, from)
+		return
+	}
+	peers := (*c).Peers.Book.Sample(MAX_ADDR_PER_MESSAGE - 1)
+	var requester PeerAddress
+	if err := json.Unmarshal(data, &requester); err == nil && requester.Address == from {
+		(*c).Peers.Book.Add(requester)
+	}
+	peers = append(peers, c.SelfAddress())
+	jsonByte, err := json.Marshal(peers)
+	if err != nil {
+		fmt.Println("ProvideAddresses() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, ADDR, jsonByte)
+}
+
+func (c *Client) ReceiveAddresses(from string, data []byte) {
+	var peers []PeerAddress
+	if err := json.Unmarshal(data, &peers); err != nil {
+		c.Log(fmt.Sprintf("Invalid addresses from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed addresses")
+		return
+	}
+	if len(peers) > MAX_ADDR_PER_MESSAGE {
+		peers = peers[:MAX_ADDR_PER_MESSAGE]
+	}
+	for _, peer := range peers {
+		if peer.Address != "" && peer.Address != (*c).Address {
+			(*c).Peers.Book.Add(peer)
+		}
+	}
+	c.FillOutbound()
+}
+
+// Announces a transaction or block to every peer that does not know about it yet.
+func (c *Client) Announce(item InvItem) {
+	jsonByte, err := json.Marshal([]InvItem{item})
+	if err != nil {
+		fmt.Println("Announce() Marshal Panic:")
+		panic(err)
+	}
+	for _, peer := range (*c).Inventory.PeersToAnnounce((*c).Net.Peers((*c).Address), item.Id) {
+		(*c).Messenger.Send(peer, INV, jsonByte)
+	}
+}
+
+// Requests the announced items that have not been seen yet from the peer.
+func (c *Client) ReceiveInv(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		c.Log(fmt.Sprintf("Invalid inventory from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed inventory")
+		return
+	}
+	compact := (*c).Messenger.Version(from) >= COMPACT_BLOCKS_VERSION
+	wanted := make([]InvItem, 0)
+	for _, item := range items {
+		(*c).Inventory.MarkKnown(from, item.Id)
+		if !c.HasInventory(item) && (*c).Inventory.ShouldRequest(from, item) {
+			if item.Type == INV_BLOCK && compact {
+				item.Type = INV_CMPCT_BLOCK
+			}
+			wanted = append(wanted, item)
+		}
+	}
+	if len(wanted) > 0 {
+		c.RequestData(from, wanted)
+	}
+}
+
+// Asks a peer for items, falling back on other peers that announced them if they do not arrive in time.
+func (c *Client) RequestData(peer string, items []InvItem) {
+	jsonByte, err := json.Marshal(items)
+	if err != nil {
+		fmt.Println("RequestData() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(peer, GETDATA, jsonByte)
+	time.AfterFunc(GETDATA_TIMEOUT, c.RetryRequests)
+}
+
+// Asks for the items whose request timed out again, from the next peers that announced them.
+func (c *Client) RetryRequests() {
+	for peer, items := range (*c).Inventory.DueRetries() {
+		c.RequestData(peer, items)
+	}
+}
+
+// Sends the requested items to the peer, replying with NOTFOUND for any that are unknown.
+func (c *Client) ProvideData(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		c.Log(fmt.Sprintf("Invalid data request from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed data request")
+		return
+	}
+	notFound := make([]InvItem, 0)
+	for _, item := range items {
+		if block, ok := (*c).Blocks[item.Id]; ok && item.Type == INV_BLOCK {
+			(*c).Messenger.Send(from, PROOF_FOUND, BlockToBytes(block))
+		} else if block, ok := (*c).Blocks[item.Id]; ok && item.Type == INV_CMPCT_BLOCK {
+			(*c).Messenger.Send(from, CMPCTBLOCK, CompactBlockToBytes(block))
+		} else if tx := c.FindTransaction(item.Id); tx != nil && item.Type == INV_TX {
+			(*c).Messenger.Send(from, POST_TRANSACTION, TransactionToBytes(tx))
+		} else {
+			notFound = append(notFound, item)
+			continue
+		}
+		(*c).Inventory.MarkKnown(from, item.Id)
+	}
+	if len(notFound) == 0 {
+		return
+	}
+	jsonByte, err := json.Marshal(notFound)
+	if err != nil {
+		fmt.Println("ProvideData() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, NOTFOUND, jsonByte)
+}
+
+func (c *Client) ReceiveNotFound(from string, data []byte) {
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		c.Log(fmt.Sprintf("Invalid not found message from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed not found message")
+		return
+	}
+	retries := make(map[string][]InvItem)
+	for _, item := range items {
+		if peer, retry, ok := (*c).Inventory.NotFound(from, item.Id); ok {
+			retries[peer] = append(retries[peer], retry)
+		}
+	}
+	for peer, retry := range retries {
+		c.RequestData(peer, retry)
+	}
+}
+
+func (c *Client) HasInventory(item InvItem) bool {
+	if item.Type == INV_BLOCK {
+		_, ok := (*c).Blocks[item.Id]
+		return ok || (*c).PendingBlocks.Contains(item.Id) || (*c).CompactBlocks.Waiting(item.Id)
+	}
+	return c.FindTransaction(item.Id) != nil
+}
+
+// Looks up a transaction that has not been confirmed yet by its ID.
+func (c *Client) FindTransaction(txId string) *Transaction {
+	if tx, ok := (*c).Mempool.Get(txId); ok {
+		return tx
+	}
+	if tx, ok := (*c).PendingOutgoingTransactions[txId]; ok {
+		return tx
+	}
+	return nil
+}
+
+/**
+ * Starts catching up with the network by asking all peers for their head.
+ * Headers are then downloaded from the first peer that is ahead, and the
+ * blocks are fetched from every peer that has them.
+ */
+func (c *Client) StartSync() {
+	if !(*c).Sync.IsSyncing() {
+		time.AfterFunc(SYNC_CHECK_INTERVAL, c.CheckSync)
+	}
+	(*c).Sync.Start()
+	c.Log("Starting sync")
+	(*c).Messenger.Broadcast(GET_HEAD, []byte{})
+}
+
+// Keeps a sync going when peers stop answering, checking again until it is over.
+func (c *Client) CheckSync() {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	if peer := (*c).Sync.CheckProgress((*c).LastBlock.ChainLength); peer != "" {
+		c.Log(fmt.Sprintf("Sync peer timed out, asking %v for headers", peer[0:10]))
+		c.RequestHeaders(peer)
+	}
+	if (*c).Sync.IsSyncing() {
+		c.RequestBlocks()
+		time.AfterFunc(SYNC_CHECK_INTERVAL, c.CheckSync)
+	}
+}
+
+// Replies to a peer with the header of the last block.
+func (c *Client) ProvideHead(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	header := (*c).LastBlock.Header()
+	jsonByte, err := json.Marshal(&header)
+	if err != nil {
+		fmt.Println("ProvideHead() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, HEAD, jsonByte)
+}
+
+func (c *Client) ReceiveHead(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var header BlockHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		c.Log(fmt.Sprintf("Invalid head from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed head")
+		return
+	}
+	if header.ChainLength > 0 && (*c).Engine.VerifyHeader(&header) != nil {
+		c.Log(fmt.Sprintf("Head from %v does not have a valid seal", from))
+		c.Penalize(from, PENALTY_INVALID_PROOF, "head without a valid seal")
+		return
+	}
+	if (*c).Sync.AddPeerHead(from, &header, (*c).LastBlock.ChainLength) {
+		c.RequestHeaders(from)
+	}
+}
+
+func (c *Client) RequestHeaders(peer string) {
+	request := HeadersRequest{Locator: (*c).Sync.Locator((*c).Blocks, (*c).LastBlock)}
+	jsonByte, err := json.Marshal(request)
+	if err != nil {
+		fmt.Println("RequestHeaders() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(peer, GET_HEADERS, jsonByte)
+}
+
+// Sends a peer the headers that follow the locator on the current chain.
+func (c *Client) ProvideHeaders(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var request HeadersRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		c.Log(fmt.Sprintf("Invalid headers request from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed headers request")
+		return
+	}
+	headers := HeadersAfter((*c).Blocks, (*c).LastBlock, request.Locator, MAX_HEADERS_BATCH)
+	jsonByte, err := json.Marshal(headers)
+	if err != nil {
+		fmt.Println("ProvideHeaders() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, HEADERS, jsonByte)
+}
+
+func (c *Client) ReceiveHeaders(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var headers []BlockHeader
+	if err := json.Unmarshal(data, &headers); err != nil {
+		c.Log(fmt.Sprintf("Invalid headers from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed headers")
+		return
+	}
+	for i := range headers {
+		if err := (*c).Params.CheckBlock(headers[i].ChainLength, headers[i].GetHash(), headers[i].PrevBlockHash, (*c).Blocks); err != nil {
+			c.Log(fmt.Sprintf("Rejected headers from %v: %v", from, err))
+			c.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
+			return
+		}
+	}
+	more, err := (*c).Sync.AddHeaders(from, headers, (*c).Blocks, (*c).Engine)
+	if err == ErrNotSyncPeer {
+		return
+	}
+	if err != nil {
+		c.Log(fmt.Sprintf("Rejected headers from %v: %v", from, err))
+		c.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
+		return
+	}
+	if (*c).Params.AssumeValid != "" {
+		(*c).Sync.AssumeValid((*c).Params.AssumeValid)
+	}
+	c.Log(fmt.Sprintf("Received %d headers from %v", len(headers), from[0:10]))
+	if more {
+		c.RequestHeaders(from)
+	} else {
+		c.RequestBlocks()
+	}
+}
+
+// Asks peers for the next blocks to download during a sync.
+func (c *Client) RequestBlocks() {
+	for peer, blockIds := range (*c).Sync.NextDownloads((*c).Blocks) {
+		jsonByte, err := json.Marshal(blockIds)
+		if err != nil {
+			fmt.Println("RequestBlocks() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Send(peer, GET_BLOCKS, jsonByte)
+	}
+}
+
+// Sends a peer each of the requested blocks that is known.
+func (c *Client) ProvideBlocks(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var blockIds []string
+	if err := json.Unmarshal(data, &blockIds); err != nil {
+		c.Log(fmt.Sprintf("Invalid blocks request from %v", from))
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed blocks request")
+		return
+	}
+	for _, blockId := range blockIds {
+		if block, ok := (*c).Blocks[blockId]; ok {
+			(*c).Messenger.Send(from, PROOF_FOUND, BlockToBytes(block))
+		}
+	}
 }
 
 /**
@@ -242,7 +861,10 @@ func (c *Client) ResendPendingTransactions() {
 			fmt.Println("ResendPendingTransactions() Marshal Panic:")
 			panic(err)
 		}
-		(*c).Net.Broadcast(POST_TRANSACTION, jsonByte)
+		for _, peer := range (*c).Net.Peers((*c).Address) {
+			(*c).Inventory.MarkKnown(peer, tx.Id())
+			(*c).Messenger.Send(peer, POST_TRANSACTION, jsonByte)
+		}
 	}
 }
 
@@ -250,20 +872,104 @@ func (c *Client) ResendPendingTransactions() {
  * Takes an object representing a request for a missing block.
  * If the client has the block, it will send the block to the
  * client that requested it.*/
-func (c *Client) ProvideMissingBlock(data []byte) {
+func (c *Client) ProvideMissingBlock(from string, data []byte) {
 	(*c).mu.Lock()
 	defer (*c).mu.Unlock()
 	var msg Message
 	err := json.Unmarshal(data, &msg)
 	if err != nil {
-		fmt.Println("ProvideMissingBlock() unmarshal Panic:")
-		panic(err)
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed missing block request")
+		return
 	}
 	if val, received := (*c).Blocks[msg.PrevBlockHash]; received {
 		c.Log(fmt.Sprintf("Providing missing block %v", val.GetHashStr()))
 		data := BlockToBytes(val)
-		(*c).Net.SendMessage(msg.Address, PROOF_FOUND, data)
+		(*c).Messenger.Send(from, PROOF_FOUND, data)
+	}
+}
+
+/**
+ * Moves the head of the blockchain to the specified block.  If the block is
+ * on a different branch, the blocks back to the fork point are disconnected
+ * and their transactions returned to the mempool before the new branch is
+ * connected.
+ */
+func (c *Client) SetLastBlock(block *Block) {
+	reorg := FindReorg((*c).Blocks, (*c).LastBlock, block)
+	(*c).LastBlock = block
+	if reorg != nil {
+		if reorg.Depth() > 0 {
+			c.Log(fmt.Sprintf("Reorg of depth %d from fork point %v, %d transactions returned to mempool",
+				reorg.Depth(), reorg.ForkPoint.GetHashStr(), len(reorg.OrphanedTransactions())))
+			(*c).Net.ChainReorged((*c).Address, reorg.Depth())
+		}
+		for _, b := range reorg.Disconnected {
+			c.DisconnectBlock(b)
+		}
+		for _, b := range reorg.Connected {
+			c.ConnectBlock(b)
+		}
+	}
+	c.SetLastConfirmed()
+	c.VoteCheckpoint()
+}
+
+// Updates the pending transactions for a block joining the current chain.
+func (c *Client) ConnectBlock(block *Block) {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i].Tx
+		(*c).Mempool.Remove(tx)
+		if tx.Pays((*c).Address) {
+			(*c).PendingReceivedTransactions[tx.Id()] = tx
+		}
+	}
+	go (*c).Emitter.Emit(BLOCK_CONNECTED, BlockToBytes(block))
+}
+
+// Returns the transactions of a block leaving the current chain to the mempool.
+func (c *Client) DisconnectBlock(block *Block) {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i].Tx
+		(*c).Mempool.Add(tx)
+		if tx.Info.From == (*c).Address {
+			(*c).PendingOutgoingTransactions[tx.Id()] = tx
+		}
+		if tx.Pays((*c).Address) {
+			(*c).PendingReceivedTransactions[tx.Id()] = tx
+		}
+	}
+	go (*c).Emitter.Emit(BLOCK_DISCONNECTED, BlockToBytes(block))
+}
+
+// Stores a transaction seen on the network until it is included in a block.
+func (c *Client) AddTransaction(tx *Transaction) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	txId := tx.Id()
+	(*c).Inventory.MarkSeen(txId)
+	(*c).Net.ItemSeen((*c).Address, txId)
+	if (*c).Mempool.ContainsKey(txId) {
+		return
 	}
+	(*c).Mempool.Add(tx)
+	if tx.Pays((*c).Address) {
+		(*c).PendingReceivedTransactions[txId] = tx
+	}
+	c.Announce(InvItem{Type: INV_TX, Id: txId})
+}
+
+func (c *Client) AddTransactionBytes(from string, data []byte) {
+	tx := BytesToTransaction(data)
+	if tx == nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed transaction")
+		return
+	}
+	(*c).Inventory.MarkKnown(from, tx.Id())
+	if tx.Sig == nil || !tx.ValidSignature() {
+		c.Penalize(from, PENALTY_INVALID_SIGNATURE, fmt.Sprintf("invalid signature for transaction %v", tx.Id()))
+		return
+	}
+	c.AddTransaction(tx)
 }
 
 /**
@@ -274,21 +980,255 @@ func (c *Client) ProvideMissingBlock(data []byte) {
 func (c *Client) SetLastConfirmed() {
 	block := (*c).LastBlock
 	confirmedBlockHeight := uint32(0)
-	if (*block).ChainLength > CONFIRMED_DEPTH {
-		confirmedBlockHeight = (*block).ChainLength - CONFIRMED_DEPTH
+	if (*block).ChainLength > (*c).ConfirmedDepth {
+		confirmedBlockHeight = (*block).ChainLength - (*c).ConfirmedDepth
 	}
 	for (*block).ChainLength > confirmedBlockHeight {
 		block = (*c).Blocks[(*block).PrevBlockHash]
 	}
+	// A final checkpoint is confirmed even if it is not that deep yet.
+	if (*c).Finality != nil {
+		checkpointId, _ := (*c).Finality.Finalized()
+		if checkpoint, ok := (*c).Blocks[checkpointId]; ok && checkpoint.ChainLength > (*block).ChainLength && c.OnFinalChain((*c).LastBlock) {
+			block = checkpoint
+		}
+	}
 	(*c).LastConfirmedBlock = block
 	// Update pending transactions according to the new last confirmed block.
-	for id, tx := range (*c).PendingOutgoingTransactions {
-		if (*c).LastConfirmedBlock.Contains(tx) {
-			delete((*c).PendingOutgoingTransactions, id)
+	// The confirmed chain may have grown by several blocks at once, so all
+	// of it is checked, until no pending transactions are left.
+	for ; block != nil; block = (*c).Blocks[block.PrevBlockHash] {
+		if len((*c).PendingOutgoingTransactions) == 0 && len((*c).PendingReceivedTransactions) == 0 {
+			break
+		}
+		for _, v := range block.Transactions {
+			delete((*c).PendingOutgoingTransactions, v.Id)
+			delete((*c).PendingReceivedTransactions, v.Id)
+		}
+		if block.IsGenesisBlock() {
+			break
 		}
 	}
 }
 
+/**
+ * Turns on checkpoint finality, with the registered validators that vote
+ * on checkpoints.  If the client is one of them, it votes as its chain grows.
+ */
+func (c *Client) EnableFinality(validators []string) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	(*c).Finality = NewFinalityGadget(validators)
+}
+
+// Votes for the checkpoint of the current chain, unless the client has already voted in its epoch.
+func (c *Client) VoteCheckpoint() {
+	if (*c).Finality == nil || !(*c).Finality.IsValidator((*c).Address) {
+		return
+	}
+	height := CheckpointHeight((*c).LastBlock)
+	if height == 0 || !(*c).Finality.StartVote(height) {
+		return
+	}
+	checkpoint := (*c).LastBlock
+	for checkpoint.ChainLength > height {
+		checkpoint = (*c).Blocks[checkpoint.PrevBlockHash]
+	}
+	vote := NewCheckpointVote(checkpoint, (*c).PrivKey)
+	c.Log(fmt.Sprintf("voting for checkpoint %v at height %d", vote.Checkpoint, height))
+	c.addCheckpointVote((*c).Address, vote)
+}
+
+func (c *Client) ReceiveCheckpointVote(from string, data []byte) {
+	var vote CheckpointVote
+	if err := json.Unmarshal(data, &vote); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed checkpoint vote")
+		return
+	}
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	if (*c).Finality == nil {
+		return
+	}
+	c.addCheckpointVote(from, &vote)
+}
+
+// Replies to a peer with the votes that made the latest checkpoint final.
+func (c *Client) ProvideCheckpoint(from string, data []byte) {
+	if (*c).Finality == nil {
+		return
+	}
+	certificate := (*c).Finality.FinalCertificate()
+	if len(certificate) == 0 {
+		return
+	}
+	jsonByte, err := json.Marshal(certificate)
+	if err != nil {
+		fmt.Println("ProvideCheckpoint() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, CHECKPOINT, jsonByte)
+}
+
+func (c *Client) ReceiveCheckpoint(from string, data []byte) {
+	var certificate []CheckpointVote
+	if err := json.Unmarshal(data, &certificate); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed checkpoint")
+		return
+	}
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	if (*c).Finality == nil {
+		return
+	}
+	for i := range certificate {
+		c.addCheckpointVote(from, &certificate[i])
+	}
+}
+
+// Records a checkpoint vote, relaying it to peers if it is new.
+func (c *Client) addCheckpointVote(from string, vote *CheckpointVote) {
+	added, finalized, err := (*c).Finality.AddVote(vote, c.descendsFrom)
+	if err == ErrEquivocation {
+		c.Log(fmt.Sprintf("Validator %v voted for two checkpoints at height %d", vote.Validator, vote.Height))
+		return
+	} else if err != nil {
+		c.Penalize(from, PENALTY_INVALID_VOTE, err.Error())
+		return
+	}
+	if added {
+		jsonByte, err := json.Marshal(vote)
+		if err != nil {
+			fmt.Println("addCheckpointVote() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Broadcast(CHECKPOINT_VOTE, jsonByte)
+	}
+	if finalized {
+		c.Log(fmt.Sprintf("checkpoint %v at height %d is final", vote.Checkpoint, vote.Height))
+		c.ApplyFinality()
+	} else if added {
+		// Held checkpoints may only be missing their blocks.
+		for _, checkpointId := range (*c).Finality.Held() {
+			if _, ok := (*c).Blocks[checkpointId]; !ok && (*c).PendingBlocks.ShouldRequest(checkpointId) {
+				c.RequestMissingBlock(checkpointId)
+			}
+		}
+	}
+}
+
+// Determines whether the checkpoint is a known block with the ancestor at the ancestor's height.
+func (c *Client) descendsFrom(checkpoint string, ancestor string, ancestorHeight uint32) bool {
+	block, ok := (*c).Blocks[checkpoint]
+	if !ok {
+		return false
+	}
+	for block.ChainLength > ancestorHeight {
+		block = (*c).Blocks[block.PrevBlockHash]
+		if block == nil {
+			return false
+		}
+	}
+	return block.ChainLength == ancestorHeight && block.GetHash() == ancestor
+}
+
+/**
+ * Moves the client onto the chain of the final checkpoint, if it is not on
+ * it already, and confirms the checkpoint.  A checkpoint that has not been
+ * received yet is requested.
+ */
+func (c *Client) ApplyFinality() {
+	checkpointId, _ := (*c).Finality.Finalized()
+	if checkpointId == "" {
+		return
+	}
+	checkpoint, ok := (*c).Blocks[checkpointId]
+	if !ok {
+		if (*c).PendingBlocks.ShouldRequest(checkpointId) {
+			c.RequestMissingBlock(checkpointId)
+		}
+		return
+	}
+	if c.OnFinalChain((*c).LastBlock) {
+		c.SetLastConfirmed()
+		return
+	}
+	best := checkpoint
+	for _, block := range (*c).Blocks {
+		if (*c).Engine.Weight(block).Cmp((*c).Engine.Weight(best)) > 0 && c.OnFinalChain(block) {
+			best = block
+		}
+	}
+	c.Log(fmt.Sprintf("Switching to the chain of final checkpoint %v", checkpointId))
+	c.SetLastBlock(best)
+}
+
+// Determines whether the chain ending at the block includes the final checkpoint, if there is one.
+func (c *Client) OnFinalChain(block *Block) bool {
+	if (*c).Finality == nil {
+		return true
+	}
+	checkpointId, height := (*c).Finality.Finalized()
+	if checkpointId == "" {
+		return true
+	}
+	for block.ChainLength > height {
+		block = (*c).Blocks[block.PrevBlockHash]
+		if block == nil {
+			return false
+		}
+	}
+	return block.ChainLength == height && block.GetHash() == checkpointId
+}
+
+/**
+ * Determines whether a transaction is in the client's current chain, or,
+ * if confirmed is set, in the part of the chain that is confirmed.
+ */
+func (c *Client) ChainContains(tx *Transaction, confirmed bool) bool {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	block := (*c).LastBlock
+	if confirmed {
+		block = (*c).LastConfirmedBlock
+	}
+	for ; block != nil; block = (*c).Blocks[block.PrevBlockHash] {
+		if block.Contains(tx) {
+			return true
+		}
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+	return false
+}
+
+// Determines whether a block is the client's last confirmed block or one of its ancestors.
+func (c *Client) OnConfirmedChain(blockId string) bool {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	for block := (*c).LastConfirmedBlock; block != nil; block = (*c).Blocks[block.PrevBlockHash] {
+		if block.GetHash() == blockId {
+			return true
+		}
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+	return false
+}
+
+// Copies the client's blocks and head, for analysing a simulation once it is over.
+func (c *Client) ChainView() ChainView {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	blocks := make(map[string]*Block, len((*c).Blocks))
+	for blockId, block := range (*c).Blocks {
+		blocks[blockId] = block
+	}
+	return ChainView{Name: (*c).Name, Address: (*c).Address, Blocks: blocks, Head: (*c).LastBlock}
+}
+
 // Utility method that displays all confirmed balances for all clients
 func (c *Client) ShowAllBalances() {
 
@@ -298,6 +1238,9 @@ func (c *Client) ShowAllBalances() {
 		fmt.Printf("	%v", balance)
 		fmt.Println("")
 	}
+	for _, reward := range (*(*c).LastConfirmedBlock).ImmatureRewards {
+		fmt.Printf("	%v	%v (immature until %d)\n", reward.Id, reward.Amount, reward.Height+COINBASE_MATURITY)
+	}
 }
 
 // Logs messages to stdout
@@ -310,6 +1253,15 @@ func (c *Client) Log(msg string) {
 	fmt.Printf("	%s\n", msg)
 }
 
+// Print out the blocks that are waiting on a missing parent block.
+func (c *Client) ShowOrphans() {
+	fmt.Println("ORPHANS:")
+	for _, orphan := range (*c).PendingBlocks.Contents() {
+		fmt.Printf("%v	height %d	parent %v	from %v	at %v\n", orphan.Id, orphan.ChainLength,
+			orphan.PrevBlockHash, orphan.Peer, orphan.Received.Format(time.RFC3339))
+	}
+}
+
 // Print out the blocks in the blockchain from the current head to the genesis block.
 func (c *Client) ShowBlockchain() {
 
@@ -328,3 +1280,122 @@ func (c *Client) GetAddress() string {
 func (c *Client) GetEmitter() *emission.Emitter {
 	return (*c).Emitter
 }
+func (c *Client) GetInbox() *Inbox {
+	return (*c).Inbox
+}
+
+/**
+ * Rebuilds a block sent in compact form from the transactions this node
+ * already has, asking the peer for any that are missing.  If the block
+ * cannot be rebuilt, the full block is requested instead.
+ */
+func (c *Client) ReceiveCompactBlock(from string, data []byte) {
+	var compact CompactBlock
+	if err := json.Unmarshal(data, &compact); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed compact block")
+		return
+	}
+	blockId := compact.Header.GetHash()
+	(*c).Inventory.MarkKnown(from, blockId)
+	if err := (*c).Engine.VerifyHeader(&compact.Header); err != nil {
+		c.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("compact block %v without a valid seal: %v", blockId, err))
+		return
+	}
+
+	(*c).mu.Lock()
+	_, received := (*c).Blocks[blockId]
+	known := c.knownTransactions()
+	(*c).mu.Unlock()
+	if received {
+		return
+	}
+
+	block, missing, err := (*c).CompactBlocks.Reconstruct(from, &compact, known)
+	if err != nil {
+		c.Log(fmt.Sprintf("Could not rebuild compact block %v: %v", blockId, err))
+		c.requestFullBlock(from, blockId)
+		return
+	}
+	if block == nil {
+		jsonByte, err := json.Marshal(BlockTxnRequest{BlockId: blockId, Indexes: missing})
+		if err != nil {
+			fmt.Println("ReceiveCompactBlock() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Send(from, GETBLOCKTXN, jsonByte)
+		return
+	}
+	c.ReceiveBlock(from, *block)
+}
+
+// Sends the transactions of a block that a peer could not find in its mempool.
+func (c *Client) ProvideBlockTxn(from string, data []byte) {
+	(*c).mu.Lock()
+	defer (*c).mu.Unlock()
+	var req BlockTxnRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block transactions request")
+		return
+	}
+	block, ok := (*c).Blocks[req.BlockId]
+	if !ok {
+		jsonByte, err := json.Marshal([]InvItem{{Type: INV_BLOCK, Id: req.BlockId}})
+		if err != nil {
+			fmt.Println("ProvideBlockTxn() Marshal Panic:")
+			panic(err)
+		}
+		(*c).Messenger.Send(from, NOTFOUND, jsonByte)
+		return
+	}
+	txn := BlockTxn{BlockId: req.BlockId, Transactions: make([]Transaction, 0, len(req.Indexes))}
+	for _, index := range req.Indexes {
+		if index < 0 || index >= len((*block).Transactions) {
+			c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "block transaction index out of range")
+			return
+		}
+		txn.Transactions = append(txn.Transactions, (*block).Transactions[index].Tx)
+	}
+	jsonByte, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("ProvideBlockTxn() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(from, BLOCKTXN, jsonByte)
+}
+
+// Completes a compact block with the missing transactions sent by the peer.
+func (c *Client) ReceiveBlockTxn(from string, data []byte) {
+	var txn BlockTxn
+	if err := json.Unmarshal(data, &txn); err != nil {
+		c.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block transactions")
+		return
+	}
+	if !(*c).CompactBlocks.Waiting(txn.BlockId) {
+		return
+	}
+	block, err := (*c).CompactBlocks.Fill(from, txn)
+	if err != nil {
+		c.Log(fmt.Sprintf("Could not complete compact block %v: %v", txn.BlockId, err))
+		c.requestFullBlock(from, txn.BlockId)
+		return
+	}
+	c.ReceiveBlock(from, *block)
+}
+
+func (c *Client) requestFullBlock(peer string, blockId string) {
+	jsonByte, err := json.Marshal([]InvItem{{Type: INV_BLOCK, Id: blockId}})
+	if err != nil {
+		fmt.Println("requestFullBlock() Marshal Panic:")
+		panic(err)
+	}
+	(*c).Messenger.Send(peer, GETDATA, jsonByte)
+}
+
+// Transactions that blocks sent in compact form may refer to.
+func (c *Client) knownTransactions() []*Transaction {
+	known := (*c).Mempool.ToArray()
+	for _, tx := range (*c).PendingOutgoingTransactions {
+		known = append(known, tx)
+	}
+	return known
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Peers speaking at least this protocol version are sent compact blocks.
+const COMPACT_BLOCKS_VERSION uint32 = 2
+
+// Short IDs are this many bytes of a hash of the block and transaction IDs.
+const SHORT_TX_ID_BYTES int = 6
+
+// Limits on blocks waiting for missing transactions
+const MAX_PARTIAL_BLOCKS int = 50
+const COMPACT_BLOCK_TIMEOUT time.Duration = 5 * time.Second
+
+/**
+ * A block sent as its header and short IDs of its transactions, which the
+ * receiver looks up in its own mempool.  Only the transactions it does not
+ * have need to be sent afterwards.
+ */
+type CompactBlock struct {
+	Header   BlockHeader
+	ShortIds []string
+}
+
+// Asks for the transactions at the given positions in a compact block.
+type BlockTxnRequest struct {
+	BlockId string
+	Indexes []int
+}
+
+// The transactions requested for a compact block, in the order requested.
+type BlockTxn struct {
+	BlockId      string
+	Transactions []Transaction
+}
+
+/**
+ * Short IDs are salted with the block ID, so that a collision between two
+ * transactions in one block does not carry over to other blocks.
+ */
+func ShortTxId(blockId string, txId string) string {
+	hashed := sha256.Sum256([]byte(blockId + txId))
+	return hex.EncodeToString(hashed[:SHORT_TX_ID_BYTES])
+}
+
+func NewCompactBlock(block *Block) *CompactBlock {
+	var compact CompactBlock
+	compact.Header = block.Header()
+	blockId := compact.Header.GetHash()
+	compact.ShortIds = make([]string, 0, len((*block).Transactions))
+	for _, tx := range (*block).Transactions {
+		compact.ShortIds = append(compact.ShortIds, ShortTxId(blockId, tx.Id))
+	}
+	return &compact
+}
+
+type partialBlock struct {
+	Header       BlockHeader
+	Peer         string
+	Transactions []*Transaction
+	Missing      []int
+	Received     time.Time
+}
+
+// Rebuilds a block from its header and transactions, checking the transactions against the header.
+func blockFromHeader(header BlockHeader, txs []*Transaction) (*Block, error) {
+	var block Block
+	block.PrevBlockHash = header.PrevBlockHash
+	block.Target = header.Target
+	block.Proof = header.Proof
+	block.ExtraNonce = header.ExtraNonce
+	block.Slot = header.Slot
+	block.LeaderKey = header.LeaderKey
+	block.VrfProof = header.VrfProof
+	block.Signature = header.Signature
+	block.ChainLength = header.ChainLength
+	block.Timestamp = header.Timestamp
+	block.RewardAddr = header.RewardAddr
+	block.CoinbaseReward = header.CoinbaseReward
+	block.Transactions = make([]TransactionType, 0, len(txs))
+	for _, tx := range txs {
+		block.Transactions = append(block.Transactions, TransactionType{Id: tx.Id(), Tx: *tx})
+	}
+	if block.TxRoot() != header.TxRoot {
+		return nil, errors.New("reconstructed transactions do not match the header")
+	}
+	return &block, nil
+}
+
+/**
+ * Reconstructs compact blocks from the transactions a node already has,
+ * keeping the blocks that are still missing transactions until the
+ * sender provides them.
+ */
+type CompactBlocks struct {
+	Reconstructed int
+	Fallbacks     int
+	partial       map[string]*partialBlock
+	mu            sync.Mutex
+}
+
+func NewCompactBlocks() *CompactBlocks {
+	var cb CompactBlocks
+	cb.partial = make(map[string]*partialBlock)
+	return &cb
+}
+
+/**
+ * Matches the short IDs of a compact block against the known transactions.
+ * Returns the block if every transaction was found, or else the positions
+ * of the missing transactions, which should be requested from the peer.
+ * Short IDs matching more than one transaction count as missing.
+ */
+func (cb *CompactBlocks) Reconstruct(peer string, compact *CompactBlock, known []*Transaction) (*Block, []int, error) {
+	(*cb).mu.Lock()
+	defer (*cb).mu.Unlock()
+
+	blockId := compact.Header.GetHash()
+	byShortId := make(map[string]*Transaction)
+	collisions := make(map[string]bool)
+	for _, tx := range known {
+		shortId := ShortTxId(blockId, tx.Id())
+		if other, ok := byShortId[shortId]; ok && other.Id() != tx.Id() {
+			collisions[shortId] = true
+		}
+		byShortId[shortId] = tx
+	}
+
+	seen := make(map[string]bool)
+	txs := make([]*Transaction, len(compact.ShortIds))
+	missing := make([]int, 0)
+	for i, shortId := range compact.ShortIds {
+		if seen[shortId] {
+			return nil, nil, errors.New("duplicate short transaction ID")
+		}
+		seen[shortId] = true
+		if tx, ok := byShortId[shortId]; ok && !collisions[shortId] {
+			txs[i] = tx
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		if len((*cb).partial) >= MAX_PARTIAL_BLOCKS {
+			return nil, nil, errors.New("too many blocks waiting for transactions")
+		}
+		(*cb).partial[blockId] = &partialBlock{
+			Header:       compact.Header,
+			Peer:         peer,
+			Transactions: txs,
+			Missing:      missing,
+			Received:     time.Now(),
+		}
+		return nil, missing, nil
+	}
+
+	block, err := blockFromHeader(compact.Header, txs)
+	if err != nil {
+		(*cb).Fallbacks++
+		return nil, nil, err
+	}
+	(*cb).Reconstructed++
+	return block, nil, nil
+}
+
+/**
+ * Completes a block waiting for transactions with those sent by the peer.
+ * Returns an error if the block was not waiting for them, or if the
+ * completed block does not match its header.
+ */
+func (cb *CompactBlocks) Fill(peer string, txn BlockTxn) (*Block, error) {
+	(*cb).mu.Lock()
+	defer (*cb).mu.Unlock()
+
+	partial, ok := (*cb).partial[txn.BlockId]
+	if !ok || partial.Peer != peer {
+		return nil, errors.New("transactions for a block that was not requested")
+	}
+	delete((*cb).partial, txn.BlockId)
+	if len(txn.Transactions) != len(partial.Missing) {
+		(*cb).Fallbacks++
+		return nil, errors.New("wrong number of transactions for the block")
+	}
+	for i, index := range partial.Missing {
+		partial.Transactions[index] = &txn.Transactions[i]
+	}
+	block, err := blockFromHeader(partial.Header, partial.Transactions)
+	if err != nil {
+		(*cb).Fallbacks++
+		return nil, err
+	}
+	(*cb).Reconstructed++
+	return block, nil
+}
+
+// Forgets partial blocks whose transactions never arrived, returning their IDs.
+func (cb *CompactBlocks) Expire() []string {
+	(*cb).mu.Lock()
+	defer (*cb).mu.Unlock()
+
+	expired := make([]string, 0)
+	now := time.Now()
+	for blockId, partial := range (*cb).partial {
+		if now.Sub(partial.Received) > COMPACT_BLOCK_TIMEOUT {
+			delete((*cb).partial, blockId)
+			expired = append(expired, blockId)
+		}
+	}
+	return expired
+}
+
+func (cb *CompactBlocks) Waiting(blockId string) bool {
+	(*cb).mu.Lock()
+	defer (*cb).mu.Unlock()
+	_, ok := (*cb).partial[blockId]
+	return ok
+}
+
+func CompactBlockToBytes(block *Block) []byte {
+	data, err := json.Marshal(NewCompactBlock(block))
+	if err != nil {
+		return nil
+	}
+	return data
+}
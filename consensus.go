@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"math"
+	"math/big"
+	"runtime"
+	"spartangold/utils"
+	"time"
+)
+
+/**
+ * Decides how blocks are sealed, which blocks are valid, and which chain
+ * wins.  Proof-of-work is the default engine, and others can be swapped
+ * in without changing how nodes handle blocks.
+ */
+type ConsensusEngine interface {
+	// Sets the consensus fields of a new block built on the parent.
+	Prepare(block *Block, parent *Block)
+
+	// Does one round of work towards sealing the block built on the parent,
+	// using the miner's key if the engine needs it.  Returns whether the
+	// block is now sealed, and the amount of work done, e.g. the number of
+	// hashes computed.
+	Seal(ctx context.Context, block *Block, parent *Block, key *rsa.PrivateKey) (bool, uint64)
+
+	// Checks the seal of a block.  The parent is nil if it is not known
+	// yet, in which case only the checks not depending on it are made.
+	VerifySeal(block *Block, parent *Block) error
+
+	// Checks a header on its own, for headers-first sync.
+	VerifyHeader(header *BlockHeader) error
+
+	// The fork-choice weight of the chain ending at the block.  The chain
+	// with the greatest weight is the main chain.
+	Weight(block *Block) *big.Int
+}
+
+/**
+ * Proof-of-work: a block is sealed by finding a Proof, and extra nonce if
+ * the proofs run out, that makes the hash of its header lower than the
+ * target.  Each call to Seal tries Rounds proofs, split between Workers.
+ */
+type PowEngine struct {
+	Target  *big.Int
+	Rounds  uint32
+	Workers int
+}
+
+func NewPowEngine(rounds uint32) *PowEngine {
+	var e PowEngine
+	e.Target = utils.CalcTarget(POW_LEADING_ZEROES, POW_BASE_TARGET_STR)
+	e.Rounds = rounds
+	e.Workers = runtime.NumCPU()
+	return &e
+}
+
+func (e *PowEngine) Prepare(block *Block, parent *Block) {
+	(*block).Target.Set((*e).Target)
+	(*block).Proof = 0
+	(*block).ExtraNonce = 0
+}
+
+func (e *PowEngine) Seal(ctx context.Context, block *Block, parent *Block, key *rsa.PrivateKey) (bool, uint64) {
+	start := (*block).Proof
+	// The last batch before the proofs run out may be shorter.
+	rounds := (*e).Rounds
+	if remaining := uint64(math.MaxUint32) - uint64(start) + 1; remaining < uint64(rounds) {
+		rounds = uint32(remaining)
+	}
+	proof, found, hashes := SearchProof(ctx, block.Header(), start, rounds, (*e).Workers)
+	if found {
+		(*block).Proof = proof
+	} else if uint64(start)+uint64(rounds) > math.MaxUint32 {
+		(*block).ExtraNonce++
+		(*block).Timestamp = time.Now()
+		(*block).Proof = 0
+	} else {
+		(*block).Proof = start + rounds
+	}
+	return found, hashes
+}
+
+func (e *PowEngine) VerifySeal(block *Block, parent *Block) error {
+	header := block.Header()
+	return e.VerifyHeader(&header)
+}
+
+func (e *PowEngine) VerifyHeader(header *BlockHeader) error {
+	if header.Target.Cmp((*e).Target) != 0 {
+		return errors.New("block does not use the network's target")
+	}
+	if !header.hasValidProof() {
+		return errors.New("proof does not meet the target")
+	}
+	return nil
+}
+
+// Every block has the same target, so the longest chain has the most work.
+func (e *PowEngine) Weight(block *Block) *big.Int {
+	return new(big.Int).SetUint64(uint64((*block).ChainLength))
+}
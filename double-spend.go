@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Constants for the double-spend attack scenario
+const DOUBLE_SPEND_POLL time.Duration = 100 * time.Millisecond
+const DOUBLE_SPEND_SETTLE time.Duration = 10 * time.Second
+const DOUBLE_SPEND_GIVE_UP uint32 = 6
+const DOUBLE_SPEND_AMOUNT uint32 = 50
+
+// The outcome of one double-spend attempt.
+type DoubleSpendResult struct {
+	AttackerShare float64
+	Depth         uint32
+	Confirmed     bool
+	Released      bool
+	Success       bool
+	PrivateHeight uint32
+	PublicHeight  uint32
+	Elapsed       time.Duration
+}
+
+/**
+ * Runs one double-spend attack.  The attacker pays a merchant, who waits
+ * until the payment is in its LastConfirmedBlock, with depth blocks on top.
+ * Meanwhile, a colluding miner with the share attackerShare of the hashrate
+ * mines off the network on a chain where the attacker spends the same nonce
+ * to itself.  Once the merchant has confirmed the payment and the private
+ * chain is longer than the public one, the colluding miner joins the network
+ * and releases its chain.  The attack succeeds if the merchant's chain ends
+ * up with the conflicting transaction.  The attacker gives up once it falls
+ * DOUBLE_SPEND_GIVE_UP blocks behind, or when the timeout runs out.
+ */
+func RunDoubleSpend(attackerShare float64, depth uint32, totalHashrate float64, timeout time.Duration) DoubleSpendResult {
+	result := DoubleSpendResult{AttackerShare: attackerShare, Depth: depth}
+
+	net := NewFakeNet()
+	attacker := NewClient("Attacker", net, nil)
+	merchant := NewClient("Merchant", net, nil)
+	honest := []*Miner{
+		NewMiner("Honest1", net, NUM_ROUNDS_MINING, nil),
+		NewMiner("Honest2", net, NUM_ROUNDS_MINING, nil),
+	}
+	colluder := NewMiner("Colluder", net, NUM_ROUNDS_MINING, nil)
+
+	balances := make(map[string]uint32)
+	balances[attacker.GetAddress()] = 2 * DOUBLE_SPEND_AMOUNT
+	genesis := MakeGenesisDefault(balances)
+	attacker.SetGenesisBlock(genesis)
+	merchant.SetGenesisBlock(genesis)
+	merchant.ConfirmedDepth = depth
+	for _, miner := range honest {
+		miner.SetGenesisBlock(genesis)
+		miner.SetHashrate(totalHashrate * (1 - attackerShare) / float64(len(honest)))
+	}
+	colluder.SetGenesisBlock(genesis)
+	colluder.SetHashrate(totalHashrate * attackerShare)
+
+	// Only the colluding miner knows about the conflicting transaction,
+	// and it stays off the network until its chain is released.
+	conflict := NewTransaction(attacker.GetAddress(), attacker.Nonce, attacker.PubKey, nil, DEFAULT_TX_FEE,
+		[]Output{{Address: attacker.GetAddress(), Amount: DOUBLE_SPEND_AMOUNT}}, nil)
+	conflict.Sign(attacker.PrivKey)
+	colluder.AddTransaction(conflict)
+
+	net.Register(attacker, merchant)
+	for _, miner := range honest {
+		net.Register(miner)
+	}
+	payment := attacker.PostTransaction([]Output{{Address: merchant.GetAddress(), Amount: DOUBLE_SPEND_AMOUNT}}, DEFAULT_TX_FEE)
+
+	began := time.Now()
+	for _, miner := range honest {
+		miner.Initialize()
+	}
+	colluder.Initialize()
+	defer func() {
+		for _, miner := range honest {
+			miner.Stop()
+		}
+		colluder.Stop()
+	}()
+
+	var releasedAt time.Time
+	for time.Since(began) < timeout {
+		time.Sleep(DOUBLE_SPEND_POLL)
+		result.PublicHeight = 0
+		for _, miner := range honest {
+			if height := miner.LastBlock.ChainLength; height > result.PublicHeight {
+				result.PublicHeight = height
+			}
+		}
+		result.PrivateHeight = colluder.LastBlock.ChainLength
+
+		if !result.Confirmed && merchant.ChainContains(payment, true) {
+			result.Confirmed = true
+		}
+		if result.Released {
+			if merchant.ChainContains(conflict, false) {
+				result.Success = true
+				break
+			}
+			if time.Since(releasedAt) > DOUBLE_SPEND_SETTLE {
+				break
+			}
+			continue
+		}
+		if result.Confirmed && result.PrivateHeight > result.PublicHeight {
+			net.Register(colluder)
+			// The colluder was never connected, so it shakes hands with its peers first.
+			for _, peer := range net.Peers(colluder.GetAddress()) {
+				colluder.SendVersion(peer)
+			}
+			colluder.ReleaseChain()
+			result.Released = true
+			releasedAt = time.Now()
+		} else if result.PublicHeight >= result.PrivateHeight+DOUBLE_SPEND_GIVE_UP {
+			break
+		}
+	}
+	result.Elapsed = time.Since(began)
+	return result
+}
+
+/**
+ * The chance that an attacker with the share q of the hashrate ever
+ * catches up from z blocks behind, as computed in the Bitcoin paper.
+ */
+func NakamotoDoubleSpendProbability(q float64, z uint32) float64 {
+	p := 1 - q
+	if q >= p {
+		return 1
+	}
+	lambda := float64(z) * q / p
+	sum := 1.0
+	for k := 0; k <= int(z); k++ {
+		poisson := math.Exp(-lambda)
+		for i := 1; i <= k; i++ {
+			poisson *= lambda / float64(i)
+		}
+		sum -= poisson * (1 - math.Pow(q/p, float64(int(z)-k)))
+	}
+	return sum
+}
+
+/**
+ * Runs the double-spend attack a number of times for each attacker
+ * hashrate share and confirmation depth, and prints how often it succeeded
+ * next to the probability from the Bitcoin paper.  Note that the attacker
+ * here gives up, so it succeeds somewhat less often than the paper predicts.
+ */
+func SimulateDoubleSpends(shares []float64, depths []uint32, trials int, totalHashrate float64, timeout time.Duration) []DoubleSpendResult {
+	results := make([]DoubleSpendResult, 0)
+	for _, share := range shares {
+		for _, depth := range depths {
+			successes := 0
+			for i := 0; i < trials; i++ {
+				result := RunDoubleSpend(share, depth, totalHashrate, timeout)
+				results = append(results, result)
+				if result.Success {
+					successes++
+				}
+				fmt.Printf("Trial %d, %.0f%% of the hashrate, depth %d: confirmed %v, released %v, succeeded %v (private %d, public %d, after %v)\n",
+					i+1, share*100, depth, result.Confirmed, result.Released, result.Success,
+					result.PrivateHeight, result.PublicHeight, result.Elapsed.Round(time.Millisecond))
+			}
+			fmt.Printf("%.0f%% of the hashrate, depth %d: %d of %d double spends succeeded (%.1f%%), %.1f%% expected\n",
+				share*100, depth, successes, trials, float64(successes)/float64(trials)*100,
+				NakamotoDoubleSpendProbability(share, depth)*100)
+		}
+	}
+	return results
+}
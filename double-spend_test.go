@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNakamotoDoubleSpendProbability(t *testing.T) {
+	tests := []struct {
+		q    float64
+		z    uint32
+		want float64
+	}{
+		// The results printed in section 11 of the Bitcoin paper.
+		{0.1, 0, 1.0000000},
+		{0.1, 1, 0.2045873},
+		{0.1, 2, 0.0509779},
+		{0.1, 3, 0.0131722},
+		{0.1, 5, 0.0009137},
+		{0.1, 10, 0.0000012},
+		{0.3, 0, 1.0000000},
+		{0.3, 5, 0.1773523},
+		{0.3, 10, 0.0416605},
+		{0.3, 50, 0.0000006},
+		// An attacker with half the hashrate or more always catches up.
+		{0.5, 10, 1},
+		{0.6, 3, 1},
+	}
+	for _, tt := range tests {
+		if got := NakamotoDoubleSpendProbability(tt.q, tt.z); math.Abs(got-tt.want) > 5e-8 {
+			t.Errorf("NakamotoDoubleSpendProbability(%v, %d) = %.7f, want %.7f", tt.q, tt.z, got, tt.want)
+		}
+	}
+}
@@ -1,11 +1,82 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"runtime"
 	"time"
 )
 
 func main() {
+	scenario := flag.String("scenario", "", "run the scenario in this file and report whether its assertions hold, "+DEFAULT_SCENARIO+" by default")
+	metricsJson := flag.String("metrics-json", "", "write metrics on blocks, forks and transactions of the run to this JSON file")
+	metricsCsv := flag.String("metrics-csv", "", "write metrics on blocks, forks and transactions of the run to this CSV file")
+	hashrateSim := flag.Bool("hashrate-sim", false, "simulate miners with 10%, 30% and 60% of the hashrate")
+	simDuration := flag.Duration("duration", 30*time.Second, "how long the hashrate simulation runs")
+	miningApi := flag.String("mining-api", "", "address to serve Minnie's block templates on, e.g. 127.0.0.1:8334")
+	workerUrl := flag.String("worker", "", "run only an external mining worker for the node at this URL")
+	poolAddr := flag.String("pool", "", "address to run a mining pool on Minnie at, e.g. 127.0.0.1:8335")
+	poolMode := flag.String("pool-mode", PAYOUT_PPLNS, "how the pool pays workers, PPLNS or PPS")
+	poolWorkerUrl := flag.String("pool-worker", "", "run only a pool worker for the pool at this URL")
+	payout := flag.String("payout", "", "address pool rewards are paid to, for -pool-worker")
+	finality := flag.Bool("finality", false, "finalize checkpoints with the votes of the three miners")
+	selfishSim := flag.Float64("selfish-sim", 0, "simulate a selfish miner with this share of the hashrate, e.g. 0.35")
+	doubleSpendSim := flag.Int("double-spend-sim", 0, "run this many double-spend attacks for each attacker share and depth")
+	topologySim := flag.Bool("topology-sim", false, "compare fork rates over several peer topologies, running -duration each")
+	isolationSim := flag.Bool("isolation-sim", false, "cut a victim off from the network by eclipse, delay and partition for -duration each")
+	checkpoints := flag.Bool("checkpoints", false, "ship Donald with a checkpoint and assume-valid block from Minnie's chain")
+	consensus := flag.String("consensus", CONSENSUS_POW, "consensus engine the network runs, pow or pos")
+	flag.Parse()
+	if *workerUrl != "" {
+		RunMiningWorker(context.Background(), *workerUrl, runtime.NumCPU(), NUM_ROUNDS_MINING)
+		return
+	}
+	if *poolWorkerUrl != "" {
+		if *payout == "" {
+			fmt.Println("A -payout address is needed to run a pool worker")
+			return
+		}
+		RunPoolWorker(context.Background(), *poolWorkerUrl, *payout, runtime.NumCPU(), NUM_ROUNDS_MINING)
+		return
+	}
+	if *scenario != "" {
+		runScenarioFile(*scenario, *metricsJson, *metricsCsv)
+		return
+	}
+	if *hashrateSim {
+		SimulateHashrateShares([]float64{0.1, 0.3, 0.6}, SIMULATED_TOTAL_HASHRATE, *simDuration)
+		return
+	}
+
+	if *selfishSim > 0 {
+		SimulateSelfishMining(*selfishSim, SIMULATED_ATTACK_HASHRATE, *simDuration)
+		return
+	}
+
+	if *doubleSpendSim > 0 {
+		SimulateDoubleSpends([]float64{0.1, 0.3, 0.45}, []uint32{1, 3}, *doubleSpendSim, SIMULATED_ATTACK_HASHRATE, *simDuration)
+		return
+	}
+
+	if *topologySim {
+		SimulateTopologies(TOPOLOGY_SIM_HASHRATE, *simDuration, time.Now().UnixNano())
+		return
+	}
+
+	if *isolationSim {
+		SimulateIsolation([]string{ISOLATION_ECLIPSE, ISOLATION_DELAY, ISOLATION_PARTITION},
+			*simDuration, 0.2, SIMULATED_ATTACK_HASHRATE, *simDuration)
+		return
+	}
+
+	// The demo below is only run for the features scenarios cannot describe.
+	if *miningApi == "" && *poolAddr == "" && !*finality && !*checkpoints && *consensus == CONSENSUS_POW {
+		runScenarioFile(DEFAULT_SCENARIO, *metricsJson, *metricsCsv)
+		return
+	}
+
 	net := NewFakeNet()
 
 	// Clients
@@ -26,9 +97,26 @@ func main() {
 
 	genesis := MakeGenesisDefault(initialBalances)
 
+	// Under proof-of-stake, only the miners have stake at first.
+	if *consensus == CONSENSUS_POS {
+		initialStakes := make(map[string]uint32)
+		initialStakes[minnie.GetAddress()] = 100
+		initialStakes[mickey.GetAddress()] = 100
+		genesis = MakeGenesisStaked(initialBalances, initialStakes)
+	}
+
 	// Late Miner
 	donald := NewMiner("Donald", net, NUM_ROUNDS_MINING, genesis)
 
+	if *consensus == CONSENSUS_POS {
+		for _, c := range []*Client{alice, bob, cindy} {
+			c.Engine = NewPosEngine(genesis)
+		}
+		for _, m := range []*Miner{minnie, mickey, donald} {
+			m.Engine = NewPosEngine(genesis)
+		}
+	}
+
 	// Setting genesis block for other clients and miners
 	//TODO implement inheritance between Miner and client and set this during Genesis block creation
 	alice.SetGenesisBlock(genesis)
@@ -37,29 +125,67 @@ func main() {
 	minnie.SetGenesisBlock(genesis)
 	mickey.SetGenesisBlock(genesis)
 
+	if *finality {
+		validators := []string{minnie.GetAddress(), mickey.GetAddress(), donald.GetAddress()}
+		for _, c := range []*Client{alice, bob, cindy} {
+			c.EnableFinality(validators)
+		}
+		for _, m := range []*Miner{minnie, mickey, donald} {
+			m.EnableFinality(validators)
+		}
+	}
+
 	printClientBalances := func(c *Client) {
 		fmt.Printf("Alice has %d gold\n", c.LastBlock.BalanceOf(alice.GetAddress()))
 		fmt.Printf("Bob has %d gold\n", c.LastBlock.BalanceOf(bob.GetAddress()))
 		fmt.Printf("Cindy has %d gold\n", c.LastBlock.BalanceOf(cindy.GetAddress()))
-		fmt.Printf("Minnie has %d gold\n", c.LastBlock.BalanceOf(minnie.GetAddress()))
-		fmt.Printf("Mickey has %d gold\n", c.LastBlock.BalanceOf(mickey.GetAddress()))
-		fmt.Printf("Donald has %d gold\n", c.LastBlock.BalanceOf(donald.GetAddress()))
+		fmt.Printf("Minnie has %d gold (%d immature)\n", c.LastBlock.BalanceOf(minnie.GetAddress()), c.LastBlock.ImmatureBalanceOf(minnie.GetAddress()))
+		fmt.Printf("Mickey has %d gold (%d immature)\n", c.LastBlock.BalanceOf(mickey.GetAddress()), c.LastBlock.ImmatureBalanceOf(mickey.GetAddress()))
+		fmt.Printf("Donald has %d gold (%d immature)\n", c.LastBlock.BalanceOf(donald.GetAddress()), c.LastBlock.ImmatureBalanceOf(donald.GetAddress()))
 	}
 
 	printMinerBalance := func(m *Miner) {
 		fmt.Printf("Alice has %d gold\n", m.LastBlock.BalanceOf(alice.GetAddress()))
 		fmt.Printf("Bob has %d gold\n", m.LastBlock.BalanceOf(bob.GetAddress()))
 		fmt.Printf("Cindy has %d gold\n", m.LastBlock.BalanceOf(cindy.GetAddress()))
-		fmt.Printf("Minnie has %d gold\n", m.LastBlock.BalanceOf(minnie.GetAddress()))
-		fmt.Printf("Mickey has %d gold\n", m.LastBlock.BalanceOf(mickey.GetAddress()))
-		fmt.Printf("Donald has %d gold\n", m.LastBlock.BalanceOf(donald.GetAddress()))
+		fmt.Printf("Minnie has %d gold (%d immature)\n", m.LastBlock.BalanceOf(minnie.GetAddress()), m.LastBlock.ImmatureBalanceOf(minnie.GetAddress()))
+		fmt.Printf("Mickey has %d gold (%d immature)\n", m.LastBlock.BalanceOf(mickey.GetAddress()), m.LastBlock.ImmatureBalanceOf(mickey.GetAddress()))
+		fmt.Printf("Donald has %d gold (%d immature)\n", m.LastBlock.BalanceOf(donald.GetAddress()), m.LastBlock.ImmatureBalanceOf(donald.GetAddress()))
 	}
 
 	// Showing the initial balances from Alice's perspective, for no particular reason.
 	fmt.Printf("Initial balances:")
 	printClientBalances(alice)
 
+	// Nodes start without any links, and find each other through Minnie.
+	net.SetTopology([]Edge{})
 	net.Register(alice, bob, cindy, minnie, mickey)
+	bootstrap := PeerAddress{Address: minnie.GetAddress()}
+	alice.StartDiscovery(bootstrap)
+	bob.StartDiscovery(bootstrap)
+	cindy.StartDiscovery(bootstrap)
+	mickey.StartDiscovery(bootstrap)
+
+	// External workers can mine for Minnie as well.
+	if *miningApi != "" {
+		server := NewMiningServer(minnie)
+		go func() {
+			if err := server.ListenAndServe(*miningApi); err != nil {
+				fmt.Printf("Mining API stopped: %v\n", err)
+			}
+		}()
+		defer server.Close()
+	}
+	var pool *MiningPool
+	if *poolAddr != "" {
+		pool = NewMiningPool(minnie, *poolMode)
+		go func() {
+			if err := pool.ListenAndServe(*poolAddr); err != nil {
+				fmt.Printf("Mining pool stopped: %v\n", err)
+			}
+		}()
+		defer pool.Close()
+	}
 
 	// Miners start mining.
 	minnie.Initialize()
@@ -69,15 +195,28 @@ func main() {
 	output1 := Output{Address: bob.GetAddress(), Amount: 40}
 	outputs := []Output{output1}
 
-	alice.PostTransaction(outputs, DEFAULT_TX_FEE)
+	tx := alice.PostTransaction(outputs, DEFAULT_TX_FEE)
+
+	// Mickey doubles his stake, which counts once the transaction is in a block.
+	if *consensus == CONSENSUS_POS {
+		mickey.Stake(100, DEFAULT_TX_FEE)
+	}
 
 	go func() {
 		time.Sleep(2 * time.Second)
 		fmt.Println()
 		fmt.Println("***Starting a late-to-the-party miner***")
 		fmt.Println()
+		// As if Donald's software had been released with Minnie's confirmed chain.
+		if *checkpoints {
+			confirmed := minnie.LastConfirmedBlock
+			donald.Params = NewChainParams([]Checkpoint{{Height: confirmed.ChainLength, Hash: confirmed.GetHash()}}, confirmed.GetHash())
+			fmt.Printf("Donald starts with checkpoint and assume-valid block %v at height %d\n", confirmed.GetHash(), confirmed.ChainLength)
+		}
 		net.Register(donald)
+		donald.StartDiscovery(bootstrap)
 		donald.Initialize()
+		donald.StartSync()
 	}()
 
 	// Print out the final balances after it has been running for some time.
@@ -91,6 +230,14 @@ func main() {
 	fmt.Println()
 	fmt.Printf("Donald has a chain of length %d\n", donald.CurrentBlock.ChainLength)
 
+	if *finality {
+		for _, m := range []*Miner{minnie, mickey, donald} {
+			checkpointId, height := m.Finality.Finalized()
+			fmt.Printf("%s has final checkpoint %v at height %d, and confirmed height %d\n",
+				m.Name, checkpointId, height, m.LastConfirmedBlock.ChainLength)
+		}
+	}
+
 	fmt.Println()
 	fmt.Println("Final Balances (Minnie's perspective):")
 	printMinerBalance(minnie)
@@ -103,6 +250,65 @@ func main() {
 	fmt.Println("Final Balances (Donald's perspective):")
 	printMinerBalance(donald)
 
+	if *consensus == CONSENSUS_POS {
+		fmt.Println()
+		fmt.Println("Stakes (Minnie's perspective):")
+		for _, m := range []*Miner{minnie, mickey, donald} {
+			fmt.Printf("%s has %d gold staked\n", m.Name, minnie.LastBlock.StakeOf(m.GetAddress()))
+		}
+	}
+
+	fmt.Println()
+	for _, m := range []*Miner{minnie, mickey, donald} {
+		fmt.Printf("%s hashed at %.0f hashes/s (%d hashes in total)\n",
+			m.Name, m.HashesPerSecond(), m.Hashrate.TotalHashes())
+	}
+
+	if pool != nil {
+		fmt.Println()
+		for _, balance := range pool.Balances() {
+			fmt.Printf("Pool worker %s: %d shares, %.2f gold owed, %d gold paid\n",
+				balance.Worker, balance.Shares, balance.Owed, balance.Paid)
+		}
+	}
+
+	fmt.Println()
+	txStats := net.Propagation.Stats(tx.Id())
+	fmt.Printf("Alice's transaction reached %d nodes (median delay %v, max delay %v)\n",
+		txStats.Reached, txStats.Median, txStats.Max)
+
+	if *metricsJson != "" || *metricsCsv != "" {
+		views := []ChainView{alice.ChainView(), bob.ChainView(), cindy.ChainView()}
+		for _, m := range []*Miner{minnie, mickey, donald} {
+			views = append(views, m.ChainView())
+		}
+		metrics := CollectMetrics(views, net.Propagation, net.Reorgs, 5*time.Second)
+		if err := SaveMetrics(metrics, *metricsJson, *metricsCsv); err != nil {
+			fmt.Printf("Could not save metrics: %v\n", err)
+		}
+	}
+
 	alice.ShowBlockchain()
 	fmt.Println("End!")
 }
+
+// Runs the scenario in the file, exiting with 2 if it is invalid and 1 if it fails.
+func runScenarioFile(path string, metricsJson string, metricsCsv string) {
+	s, err := LoadScenario(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	result := RunScenario(s)
+	if err := SaveMetrics(result.Metrics, metricsJson, metricsCsv); err != nil {
+		fmt.Printf("Could not save metrics: %v\n", err)
+	}
+	for _, failure := range result.Failures {
+		fmt.Printf("FAIL: %v\n", failure)
+	}
+	if !result.Passed {
+		fmt.Printf("Scenario %q failed\n", result.Name)
+		os.Exit(1)
+	}
+	fmt.Printf("Scenario %q passed\n", result.Name)
+}
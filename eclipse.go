@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Ways a victim can be cut off from the honest network
+const ISOLATION_ECLIPSE string = "eclipse"
+const ISOLATION_DELAY string = "delay"
+const ISOLATION_PARTITION string = "partition"
+
+// How long eclipsing nodes hold back blocks and transactions in the delay attack
+const ECLIPSE_RELAY_DELAY time.Duration = 3 * time.Second
+const ISOLATION_POLL time.Duration = 100 * time.Millisecond
+
+// Messages that carry blocks and transactions, which eclipsing nodes keep from their victim.
+var BLOCK_AND_TX_MESSAGES = []string{
+	INV, GETDATA, NOTFOUND, PROOF_FOUND, MISSING_BLOCK, POST_TRANSACTION,
+	CMPCTBLOCK, GETBLOCKTXN, BLOCKTXN, GET_HEAD, HEAD, GET_HEADERS, HEADERS, GET_BLOCKS,
+}
+
+// A link filter that drops the given messages, or holds them back by delay if drop is false.
+func FilterMessages(types []string, drop bool, delay time.Duration) LinkFilter {
+	filtered := make(map[string]bool)
+	for _, msg := range types {
+		filtered[msg] = true
+	}
+	return func(from string, to string, msg string) (bool, time.Duration) {
+		if !filtered[msg] {
+			return true, 0
+		}
+		if drop {
+			return false, 0
+		}
+		return true, delay
+	}
+}
+
+// The outcome of cutting a victim off from the honest network for a while.
+type IsolationResult struct {
+	Mode         string
+	Isolation    time.Duration
+	VictimHeight uint32
+	HonestHeight uint32
+	Converged    bool
+	Divergence   time.Duration
+	ReorgDepth   int
+}
+
+/**
+ * Cuts a victim miner, with the share victimShare of the hashrate, off from
+ * two honest miners for the isolation period, then reconnects it and
+ * measures how long its LastBlock takes to agree with the honest network.
+ *
+ * In an eclipse, all of the victim's links go through two attacker nodes,
+ * which drop the blocks and transactions relayed to and from it; with the
+ * delay mode they only hold them back by ECLIPSE_RELAY_DELAY.  In a
+ * partition, the victim and one of the attacker nodes are simply split
+ * from the rest of the network.  On reconnection every node is linked to
+ * every other, and the victim syncs with its new peers.
+ */
+func RunIsolation(mode string, isolation time.Duration, victimShare float64, totalHashrate float64, timeout time.Duration) IsolationResult {
+	result := IsolationResult{Mode: mode, Isolation: isolation}
+
+	net := NewFakeNet()
+	honest := []*Miner{
+		NewMiner("Honest1", net, NUM_ROUNDS_MINING, nil),
+		NewMiner("Honest2", net, NUM_ROUNDS_MINING, nil),
+	}
+	relays := []*Client{
+		NewClient("Relay1", net, nil),
+		NewClient("Relay2", net, nil),
+	}
+	victim := NewMiner("Victim", net, NUM_ROUNDS_MINING, nil)
+
+	genesis := MakeGenesisDefault(make(map[string]uint32))
+	for _, miner := range honest {
+		miner.SetGenesisBlock(genesis)
+		miner.SetHashrate(totalHashrate * (1 - victimShare) / float64(len(honest)))
+	}
+	for _, relay := range relays {
+		relay.SetGenesisBlock(genesis)
+	}
+	victim.SetGenesisBlock(genesis)
+	victim.SetHashrate(totalHashrate * victimShare)
+
+	addrs := []string{honest[0].GetAddress(), honest[1].GetAddress(), relays[0].GetAddress(), relays[1].GetAddress()}
+	switch mode {
+	case ISOLATION_PARTITION:
+		net.SetTopology(append(fullMesh(addrs[:3]), fullMesh([]string{addrs[3], victim.GetAddress()})...))
+	case ISOLATION_ECLIPSE, ISOLATION_DELAY:
+		edges := fullMesh(addrs)
+		filter := FilterMessages(BLOCK_AND_TX_MESSAGES, mode == ISOLATION_ECLIPSE, ECLIPSE_RELAY_DELAY)
+		for _, relay := range relays {
+			edges = append(edges, Edge{relay.GetAddress(), victim.GetAddress()})
+			net.SetLinkFilter(relay.GetAddress(), victim.GetAddress(), filter)
+		}
+		net.SetTopology(edges)
+	default:
+		panic(fmt.Sprintf("RunIsolation(...): unknown mode %v", mode))
+	}
+	for _, miner := range honest {
+		net.Register(miner)
+	}
+	for _, relay := range relays {
+		net.Register(relay)
+	}
+	net.Register(victim)
+
+	for _, miner := range honest {
+		miner.Initialize()
+	}
+	victim.Initialize()
+	defer func() {
+		for _, miner := range honest {
+			miner.Stop()
+		}
+		victim.Stop()
+	}()
+	time.Sleep(isolation)
+
+	oldHead := victim.LastBlock
+	result.VictimHeight = oldHead.ChainLength
+	for _, miner := range honest {
+		if height := miner.LastBlock.ChainLength; height > result.HonestHeight {
+			result.HonestHeight = height
+		}
+	}
+
+	for _, relay := range relays {
+		net.SetLinkFilter(relay.GetAddress(), victim.GetAddress(), nil)
+	}
+	net.SetTopology(fullMesh(append(addrs, victim.GetAddress())))
+	victim.StartSync()
+	reconnected := time.Now()
+
+	for time.Since(reconnected) < timeout {
+		time.Sleep(ISOLATION_POLL)
+		victimHead := victim.LastBlock.GetHash()
+		for _, miner := range honest {
+			if miner.LastBlock.GetHash() == victimHead {
+				result.Converged = true
+			}
+		}
+		if result.Converged {
+			result.Divergence = time.Since(reconnected)
+			break
+		}
+	}
+	if reorg := victim.ReorgSince(oldHead); reorg != nil {
+		result.ReorgDepth = reorg.Depth()
+	}
+	return result
+}
+
+// Links every pair of the addresses.
+func fullMesh(addrs []string) []Edge {
+	edges := make([]Edge, 0)
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			edges = append(edges, Edge{addrs[i], addrs[j]})
+		}
+	}
+	return edges
+}
+
+// Runs each kind of isolation once and prints how long the victim took to rejoin the honest chain.
+func SimulateIsolation(modes []string, isolation time.Duration, victimShare float64, totalHashrate float64, timeout time.Duration) []IsolationResult {
+	results := make([]IsolationResult, 0, len(modes))
+	for _, mode := range modes {
+		result := RunIsolation(mode, isolation, victimShare, totalHashrate, timeout)
+		results = append(results, result)
+		fmt.Printf("%s for %v: victim at height %d, honest network at height %d when reconnected\n",
+			result.Mode, result.Isolation, result.VictimHeight, result.HonestHeight)
+		if result.Converged {
+			fmt.Printf("%s: victim rejoined the honest chain after %v, rolling back %d blocks\n",
+				result.Mode, result.Divergence.Round(time.Millisecond), result.ReorgDepth)
+		} else {
+			fmt.Printf("%s: victim still diverged after %v\n", result.Mode, timeout)
+		}
+	}
+	return results
+}
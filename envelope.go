@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"spartangold/utils"
+)
+
+// Versions of the protocol this node can speak.  Peers agree on the
+// highest version both of them support during the handshake.
+const PROTOCOL_VERSION uint32 = 2
+const MIN_PROTOCOL_VERSION uint32 = 1
+
+// Identifies the network, so that nodes of different networks ignore each other.
+const NETWORK_MAGIC uint32 = 0x53474c44
+
+/**
+ * Wraps every message sent between clients.  The sender is the address of
+ * the client, and the signature covers all the other fields.  Since the
+ * address is the hash of the public key, a signed envelope proves that
+ * the message came from the client it claims to come from.
+ */
+type Envelope struct {
+	Version   uint32
+	Magic     uint32
+	Sender    string
+	PubKey    *rsa.PublicKey `json:",omitempty"`
+	Type      string
+	Payload   []byte
+	Signature []byte `json:",omitempty"`
+}
+
+// Sent by both sides of a new connection to agree on a protocol version.
+type VersionMessage struct {
+	Version    uint32
+	MinVersion uint32
+}
+
+func (e *Envelope) hash() []byte {
+	unsigned := *e
+	unsigned.Signature = nil
+	jsonByte, err := json.Marshal(&unsigned)
+	if err != nil {
+		fmt.Println("Envelope.hash() Marshal Panic:")
+		panic(err)
+	}
+	hashed := sha256.Sum256(jsonByte)
+	return hashed[:]
+}
+
+func (e *Envelope) Sign(privKey *rsa.PrivateKey) {
+	(*e).PubKey = &privKey.PublicKey
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, e.hash())
+	if err != nil {
+		fmt.Println("Envelope.Sign() Panic:")
+		panic(err)
+	}
+	(*e).Signature = signature
+}
+
+func (e *Envelope) ValidSignature() bool {
+	if (*e).Signature == nil || (*e).PubKey == nil || (*e).PubKey.N == nil {
+		return false
+	}
+	if utils.CalcAddress((*e).PubKey) != (*e).Sender {
+		return false
+	}
+	return rsa.VerifyPKCS1v15((*e).PubKey, crypto.SHA256, e.hash(), (*e).Signature) == nil
+}
+
+/**
+ * Checks that an envelope belongs to this network, uses a supported
+ * version, and matches the connection and message type it arrived on.
+ * If a signature is present, or one is required, it must be valid.
+ */
+func (e *Envelope) Validate(from string, msg string, requireSignature bool) error {
+	if (*e).Magic != NETWORK_MAGIC {
+		return errors.New("envelope is for a different network")
+	}
+	if (*e).Version < MIN_PROTOCOL_VERSION || (*e).Version > PROTOCOL_VERSION {
+		return fmt.Errorf("unsupported protocol version %d", (*e).Version)
+	}
+	if (*e).Sender != from {
+		return errors.New("envelope sender does not match the connection")
+	}
+	if (*e).Type != msg {
+		return errors.New("envelope type does not match the message")
+	}
+	if ((*e).Signature != nil || requireSignature) && !e.ValidSignature() {
+		return errors.New("invalid envelope signature")
+	}
+	return nil
+}
+
+/**
+ * Picks the highest version supported by both sides, or returns an
+ * error if the ranges of supported versions do not overlap.
+ */
+func NegotiateVersion(theirs VersionMessage) (uint32, error) {
+	version := PROTOCOL_VERSION
+	if theirs.Version < version {
+		version = theirs.Version
+	}
+	if version < MIN_PROTOCOL_VERSION || version < theirs.MinVersion {
+		return 0, fmt.Errorf("no common protocol version with peer supporting %d-%d",
+			theirs.MinVersion, theirs.Version)
+	}
+	return version, nil
+}
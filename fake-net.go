@@ -2,7 +2,10 @@ package main
 
 // Simulate a network by using events to enable simpler testing
 import (
+	"errors"
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 )
@@ -10,10 +13,41 @@ import (
 type NetClient interface {
 	GetAddress() string
 	GetEmitter() *emission.Emitter
+	GetInbox() *Inbox
+}
+
+/**
+ * Decides whether a message sent over a link is delivered, and how much
+ * longer than usual it is held back.  Used to simulate nodes that drop or
+ * delay what they relay.
+ */
+type LinkFilter func(from string, to string, msg string) (bool, time.Duration)
+
+// Messages waiting to go over one link, beyond which more are dropped
+const LINK_QUEUE_SIZE int = 1000
+
+type linkMessage struct {
+	Due  time.Time
+	From string
+	Msg  string
+	Data []byte
 }
 
 type FakeNet struct {
 	Clients map[string]NetClient
+	// Links between clients.  When nil, every client is linked to every other.
+	Edges map[string]map[string]bool
+	// Filters on the messages sent over some of the links, by sender and receiver.
+	Filters map[string]map[string]LinkFilter
+	// Each message is delayed by LinkDelay plus a random amount up to LinkJitter.
+	LinkDelay   time.Duration
+	LinkJitter  time.Duration
+	Propagation *PropagationTracker
+	Reorgs      *ReorgTracker
+	// Messages in flight on each link, by sender and receiver, and the
+	// number dropped because a link was full.
+	links   map[[2]string]chan linkMessage
+	dropped uint64
 	mu      sync.Mutex
 }
 
@@ -27,14 +61,210 @@ func (f *FakeNet) Register(clientList ...NetClient) {
 	}
 }
 
-// Broadcasts to all clients within this.clients.
-func (f *FakeNet) Broadcast(msg string, data []byte) {
+// Removes a client from the network, along with its links, as when a node goes offline.
+func (f *FakeNet) Unregister(addr string) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	delete(f.Clients, addr)
+	for peer := range f.Edges[addr] {
+		delete(f.Edges[peer], addr)
+	}
+	delete(f.Edges, addr)
+	delete(f.Filters, addr)
+}
+
+/**
+ * Replaces the links between clients with the given edges.  Messages only
+ * travel along these links, so clients rely on their neighbors to relay
+ * anything sent by clients further away.
+ */
+func (f *FakeNet) SetTopology(edges []Edge) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	f.Edges = make(map[string]map[string]bool)
+	for _, edge := range edges {
+		f.connect(edge[0], edge[1])
+	}
+}
+
+// Adds a link between two clients.
+func (f *FakeNet) Link(a string, b string) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	if f.Edges == nil {
+		return
+	}
+	f.connect(a, b)
+}
+
+// Opens a link from a client to a registered peer.
+func (f *FakeNet) Connect(from string, peer PeerAddress) (string, error) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	address := peer.Address
+	if address == "" {
+		address = peer.Endpoint
+	}
+	if _, ok := f.Clients[address]; !ok || address == from {
+		return "", errors.New("peer is not registered on the network")
+	}
+	if f.Edges != nil {
+		f.connect(from, address)
+	}
+	return address, nil
+}
+
+// Clients on the fake network are reached by their address.
+func (f *FakeNet) Endpoint(addr string) string {
+	return addr
+}
+
+// Removes the link between two clients, switching to an explicit topology if needed.
+func (f *FakeNet) Disconnect(a string, b string) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	if f.Edges == nil {
+		f.Edges = make(map[string]map[string]bool)
+		for x := range f.Clients {
+			for y := range f.Clients {
+				if x != y {
+					f.connect(x, y)
+				}
+			}
+		}
+	}
+	delete(f.Edges[a], b)
+	delete(f.Edges[b], a)
+}
+
+// Broadcasts to the neighbors of the sender within this.clients.
+// Listeners receive the address of the sender along with the data.
+// Clients that are not registered, such as nodes mining off the network, cannot send anything.
+func (f *FakeNet) Broadcast(from string, msg string, data []byte) {
 	(*f).mu.Lock()
 	defer (*f).mu.Unlock()
+	if _, ok := f.Clients[from]; !ok {
+		return
+	}
+	for _, address := range f.peers(from) {
+		f.deliver(f.Clients[address], from, msg, data)
+	}
+}
+
+// The addresses of the clients that a client can send messages to.
+func (f *FakeNet) Peers(addr string) []string {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	return f.peers(addr)
+}
+
+// Records that a client has seen a transaction or block, for measuring propagation.
+func (f *FakeNet) ItemSeen(addr string, id string) {
+	(*f).Propagation.Seen(addr, id)
+}
+
+// Records that a client's head moved to another branch, rolling back depth blocks.
+func (f *FakeNet) ChainReorged(addr string, depth int) {
+	(*f).Reorgs.Reorged(depth)
+}
+
+func (f *FakeNet) peers(addr string) []string {
+	peers := make([]string, 0)
 	for address := range f.Clients {
-		client := f.Clients[address]
-		go (client).GetEmitter().Emit(msg, data)
+		if address != addr && f.linked(addr, address) {
+			peers = append(peers, address)
+		}
 	}
+	return peers
+}
+
+func (f *FakeNet) linked(a string, b string) bool {
+	return f.Edges == nil || f.Edges[a][b]
+}
+
+func (f *FakeNet) connect(a string, b string) {
+	if f.Edges[a] == nil {
+		f.Edges[a] = make(map[string]bool)
+	}
+	if f.Edges[b] == nil {
+		f.Edges[b] = make(map[string]bool)
+	}
+	f.Edges[a][b] = true
+	f.Edges[b][a] = true
+}
+
+// Filters the messages sent both ways over the link between two clients, or removes the filter if nil.
+func (f *FakeNet) SetLinkFilter(a string, b string, filter LinkFilter) {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if filter == nil {
+			delete(f.Filters[pair[0]], pair[1])
+			continue
+		}
+		if f.Filters[pair[0]] == nil {
+			f.Filters[pair[0]] = make(map[string]LinkFilter)
+		}
+		f.Filters[pair[0]][pair[1]] = filter
+	}
+}
+
+/**
+ * Queues a message on the link from the sender to the client.  Each link
+ * with messages in flight has one goroutine delivering them in order, so
+ * the number of goroutines is bounded by the number of links.
+ */
+func (f *FakeNet) deliver(client NetClient, from string, msg string, data []byte) {
+	delay := f.LinkDelay
+	if f.LinkJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(f.LinkJitter)))
+	}
+	if filter, ok := f.Filters[from][client.GetAddress()]; ok {
+		deliver, extra := filter(from, client.GetAddress(), msg)
+		if !deliver {
+			return
+		}
+		delay += extra
+	}
+	link := [2]string{from, client.GetAddress()}
+	queue, ok := f.links[link]
+	if !ok {
+		queue = make(chan linkMessage, LINK_QUEUE_SIZE)
+		f.links[link] = queue
+		go f.sendOver(link, client, queue)
+	}
+	select {
+	case queue <- linkMessage{Due: time.Now().Add(delay), From: from, Msg: msg, Data: data}:
+	default:
+		f.dropped++
+	}
+}
+
+// Hands the messages queued on a link to the client once they are due, until the link is idle.
+func (f *FakeNet) sendOver(link [2]string, client NetClient, queue chan linkMessage) {
+	for {
+		var message linkMessage
+		(*f).mu.Lock()
+		select {
+		case message = <-queue:
+		default:
+			delete(f.links, link)
+			(*f).mu.Unlock()
+			return
+		}
+		(*f).mu.Unlock()
+		if wait := time.Until(message.Due); wait > 0 {
+			time.Sleep(wait)
+		}
+		client.GetInbox().Deliver(message.From, message.Msg, message.Data)
+	}
+}
+
+// The number of messages dropped because too many were waiting on a link.
+func (f *FakeNet) Dropped() uint64 {
+	(*f).mu.Lock()
+	defer (*f).mu.Unlock()
+	return f.dropped
 }
 
 // Tests whether a client is registered with the network.
@@ -67,7 +297,7 @@ func (f *FakeNet) SendMessage(addr string, msg string, o interface{}) {
 	(client).GetEmitter().Emit(msg, o2)
 }*/
 
-func (f *FakeNet) SendMessage(addr string, msg string, jsonByte []byte) {
+func (f *FakeNet) SendMessage(from string, addr string, msg string, jsonByte []byte) {
 
 	/*
 		jsonByte, err := json.Marshal(o)
@@ -77,13 +307,20 @@ func (f *FakeNet) SendMessage(addr string, msg string, jsonByte []byte) {
 		}*/
 	(*f).mu.Lock()
 	defer (*f).mu.Unlock()
-	client := f.Clients[addr]
-	go (client).GetEmitter().Emit(msg, jsonByte)
+	client, ok := f.Clients[addr]
+	if _, registered := f.Clients[from]; !ok || !registered || !f.linked(from, addr) {
+		return
+	}
+	f.deliver(client, from, msg, jsonByte)
 }
 
 func NewFakeNet() *FakeNet {
 	var f FakeNet
 	f.Clients = make(map[string]NetClient)
+	f.Filters = make(map[string]map[string]LinkFilter)
+	f.links = make(map[[2]string]chan linkMessage)
+	f.Propagation = NewPropagationTracker()
+	f.Reorgs = NewReorgTracker()
 
 	return &f
 }
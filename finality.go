@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"spartangold/utils"
+	"sync"
+)
+
+// Returned for a validator's second vote in an epoch, which peers relaying it are not to blame for.
+var ErrEquivocation = errors.New("validator voted for two checkpoints in one epoch")
+
+/**
+ * A validator's vote for the checkpoint of an epoch, the block at a height
+ * that is a multiple of CHECKPOINT_INTERVAL on the validator's chain.
+ */
+type CheckpointVote struct {
+	Checkpoint string
+	Height     uint32
+	Validator  string
+	PubKey     *rsa.PublicKey
+	Signature  []byte
+}
+
+func NewCheckpointVote(checkpoint *Block, privKey *rsa.PrivateKey) *CheckpointVote {
+	var vote CheckpointVote
+	vote.Checkpoint = checkpoint.GetHash()
+	vote.Height = (*checkpoint).ChainLength
+	vote.Validator = utils.CalcAddress(&privKey.PublicKey)
+	vote.PubKey = &privKey.PublicKey
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privKey, crypto.SHA256, vote.hash())
+	if err != nil {
+		fmt.Println("NewCheckpointVote() Panic:")
+		panic(err)
+	}
+	vote.Signature = signature
+	return &vote
+}
+
+func (v *CheckpointVote) hash() []byte {
+	unsigned := *v
+	unsigned.Signature = nil
+	jsonByte, err := json.Marshal(&unsigned)
+	if err != nil {
+		fmt.Println("CheckpointVote.hash() Marshal Panic:")
+		panic(err)
+	}
+	hashed := sha256.Sum256(jsonByte)
+	return hashed[:]
+}
+
+func (v *CheckpointVote) ValidSignature() bool {
+	if (*v).Signature == nil || (*v).PubKey == nil || (*v).PubKey.N == nil {
+		return false
+	}
+	if utils.CalcAddress((*v).PubKey) != (*v).Validator {
+		return false
+	}
+	return rsa.VerifyPKCS1v15((*v).PubKey, crypto.SHA256, v.hash(), (*v).Signature) == nil
+}
+
+/**
+ * Determines whether the checkpoint is known, and has the ancestor at the
+ * ancestor's height on its chain.  Supplied by the node, which has the
+ * blocks.
+ */
+type DescendsFunc func(checkpoint string, ancestor string, ancestorHeight uint32) bool
+
+/**
+ * Collects the votes of a registered set of validators on epoch
+ * checkpoints.  Once more than two-thirds of the validators have voted for
+ * the same checkpoint, and it extends the last final checkpoint, it is
+ * final: no block at or below it can be rolled back.  A checkpoint with
+ * enough votes that is not known to extend the final one is held until it
+ * is.  Each validator may vote once per epoch, and a second vote for a
+ * different checkpoint at the same height is rejected as equivocation.
+ */
+type FinalityGadget struct {
+	Validators      map[string]bool
+	FinalizedId     string
+	FinalizedHeight uint32
+	Certificate     []*CheckpointVote
+	votes           map[string]map[string]*CheckpointVote
+	votedAt         map[uint32]map[string]string
+	held            map[string]uint32
+	lastVoted       uint32
+	mu              sync.Mutex
+}
+
+func NewFinalityGadget(validators []string) *FinalityGadget {
+	var fg FinalityGadget
+	fg.Validators = make(map[string]bool)
+	for _, validator := range validators {
+		fg.Validators[validator] = true
+	}
+	fg.Certificate = make([]*CheckpointVote, 0)
+	fg.votes = make(map[string]map[string]*CheckpointVote)
+	fg.votedAt = make(map[uint32]map[string]string)
+	fg.held = make(map[string]uint32)
+	return &fg
+}
+
+func (fg *FinalityGadget) IsValidator(address string) bool {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+	return (*fg).Validators[address]
+}
+
+// The number of votes needed to finalize a checkpoint.
+func (fg *FinalityGadget) Quorum() int {
+	return 2*len((*fg).Validators)/3 + 1
+}
+
+/**
+ * Records a vote.  Returns whether the vote was new, so that it can be
+ * relayed, and whether it made its checkpoint final.  Votes for epochs that
+ * are already final are ignored.
+ */
+func (fg *FinalityGadget) AddVote(vote *CheckpointVote, descends DescendsFunc) (bool, bool, error) {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+
+	if !(*fg).Validators[(*vote).Validator] {
+		return false, false, errors.New("vote from an unregistered validator")
+	}
+	if (*vote).Height == 0 || (*vote).Height%CHECKPOINT_INTERVAL != 0 {
+		return false, false, errors.New("vote for a block that is not a checkpoint")
+	}
+	if !vote.ValidSignature() {
+		return false, false, errors.New("invalid vote signature")
+	}
+	if (*vote).Height <= (*fg).FinalizedHeight {
+		return false, false, nil
+	}
+
+	if _, ok := (*fg).votedAt[(*vote).Height]; !ok {
+		(*fg).votedAt[(*vote).Height] = make(map[string]string)
+	}
+	if previous, ok := (*fg).votedAt[(*vote).Height][(*vote).Validator]; ok {
+		if previous != (*vote).Checkpoint {
+			return false, false, ErrEquivocation
+		}
+		return false, false, nil
+	}
+	(*fg).votedAt[(*vote).Height][(*vote).Validator] = (*vote).Checkpoint
+	if _, ok := (*fg).votes[(*vote).Checkpoint]; !ok {
+		(*fg).votes[(*vote).Checkpoint] = make(map[string]*CheckpointVote)
+	}
+	(*fg).votes[(*vote).Checkpoint][(*vote).Validator] = vote
+
+	if len((*fg).votes[(*vote).Checkpoint]) < fg.Quorum() {
+		return true, false, nil
+	}
+	if (*fg).FinalizedId != "" && !descends((*vote).Checkpoint, (*fg).FinalizedId, (*fg).FinalizedHeight) {
+		(*fg).held[(*vote).Checkpoint] = (*vote).Height
+		return true, false, nil
+	}
+	fg.finalize((*vote).Checkpoint, (*vote).Height)
+	return true, true, nil
+}
+
+/**
+ * Finalizes the lowest held checkpoint that now extends the final one, such
+ * as once its block has been received.  Returns whether one was finalized.
+ */
+func (fg *FinalityGadget) FinalizeHeld(descends DescendsFunc) bool {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+
+	checkpoints := make([]string, 0, len((*fg).held))
+	for checkpoint := range (*fg).held {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return (*fg).held[checkpoints[i]] < (*fg).held[checkpoints[j]]
+	})
+	for _, checkpoint := range checkpoints {
+		if descends(checkpoint, (*fg).FinalizedId, (*fg).FinalizedHeight) {
+			fg.finalize(checkpoint, (*fg).held[checkpoint])
+			return true
+		}
+	}
+	return false
+}
+
+// The checkpoints with enough votes that are not final yet.
+func (fg *FinalityGadget) Held() []string {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+	checkpoints := make([]string, 0, len((*fg).held))
+	for checkpoint := range (*fg).held {
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints
+}
+
+func (fg *FinalityGadget) finalize(checkpoint string, height uint32) {
+	(*fg).FinalizedId = checkpoint
+	(*fg).FinalizedHeight = height
+	// The votes are kept to prove the checkpoint is final to nodes that missed them.
+	(*fg).Certificate = make([]*CheckpointVote, 0, len((*fg).votes[checkpoint]))
+	for _, v := range (*fg).votes[checkpoint] {
+		(*fg).Certificate = append((*fg).Certificate, v)
+	}
+	// Votes for older epochs are no longer needed.
+	for height, voters := range (*fg).votedAt {
+		if height <= (*fg).FinalizedHeight {
+			for _, checkpoint := range voters {
+				delete((*fg).votes, checkpoint)
+			}
+			delete((*fg).votedAt, height)
+		}
+	}
+	for checkpoint, height := range (*fg).held {
+		if height <= (*fg).FinalizedHeight {
+			delete((*fg).held, checkpoint)
+		}
+	}
+}
+
+// The latest final checkpoint, or an empty ID if there is none yet.
+func (fg *FinalityGadget) Finalized() (string, uint32) {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+	return (*fg).FinalizedId, (*fg).FinalizedHeight
+}
+
+// The votes that made the latest checkpoint final.
+func (fg *FinalityGadget) FinalCertificate() []*CheckpointVote {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+	return append([]*CheckpointVote{}, (*fg).Certificate...)
+}
+
+// Marks that this node votes in the epoch of the height, returning false if it already has.
+func (fg *FinalityGadget) StartVote(height uint32) bool {
+	(*fg).mu.Lock()
+	defer (*fg).mu.Unlock()
+	if height <= (*fg).lastVoted || height <= (*fg).FinalizedHeight {
+		return false
+	}
+	(*fg).lastVoted = height
+	return true
+}
+
+// The height of the checkpoint a validator votes for when its chain ends at the head.
+func CheckpointHeight(head *Block) uint32 {
+	if (*head).ChainLength < FINALITY_VOTE_DEPTH {
+		return 0
+	}
+	return ((*head).ChainLength - FINALITY_VOTE_DEPTH) / CHECKPOINT_INTERVAL * CHECKPOINT_INTERVAL
+}
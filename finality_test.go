@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"spartangold/utils"
+	"testing"
+)
+
+func testValidatorKeys(t *testing.T, n int) ([]*rsa.PrivateKey, []string) {
+	keys := make([]*rsa.PrivateKey, n)
+	addresses := make([]string, n)
+	for i := range keys {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		addresses[i] = utils.CalcAddress(&key.PublicKey)
+	}
+	return keys, addresses
+}
+
+func testVote(key *rsa.PrivateKey, checkpoint string, height uint32) *CheckpointVote {
+	vote := CheckpointVote{
+		Checkpoint: checkpoint,
+		Height:     height,
+		Validator:  utils.CalcAddress(&key.PublicKey),
+		PubKey:     &key.PublicKey,
+	}
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, vote.hash())
+	if err != nil {
+		panic(err)
+	}
+	vote.Signature = signature
+	return &vote
+}
+
+func TestFinalityGadgetQuorum(t *testing.T) {
+	tests := []struct {
+		validators int
+		want       int
+	}{
+		{1, 1},
+		{3, 3},
+		{4, 3},
+		{6, 5},
+		{7, 5},
+		{9, 7},
+	}
+	for _, tt := range tests {
+		fg := NewFinalityGadget(make([]string, 0))
+		for i := 0; i < tt.validators; i++ {
+			(*fg).Validators[string(rune('a'+i))] = true
+		}
+		if got := fg.Quorum(); got != tt.want {
+			t.Errorf("Quorum() with %d validators = %d, want %d", tt.validators, got, tt.want)
+		}
+	}
+}
+
+func TestFinalityGadgetAddVote(t *testing.T) {
+	keys, validators := testValidatorKeys(t, 5)
+	outsider, _ := testValidatorKeys(t, 1)
+	h := CHECKPOINT_INTERVAL
+
+	// Checkpoint "b" extends the final checkpoint "a", and "x" does not.
+	descends := func(checkpoint string, ancestor string, ancestorHeight uint32) bool {
+		return ancestor == "a" && checkpoint == "b"
+	}
+
+	type vote struct {
+		key        *rsa.PrivateKey
+		checkpoint string
+		height     uint32
+	}
+	tests := []struct {
+		name          string
+		final         string
+		votes         []vote
+		wantAdded     bool
+		wantFinalized bool
+		wantErr       error
+		wantFinal     string
+	}{
+		{
+			name:      "a vote below the quorum is relayed",
+			votes:     []vote{{keys[0], "a", h}},
+			wantAdded: true,
+		},
+		{
+			name:          "the quorum finalizes the checkpoint",
+			votes:         []vote{{keys[0], "a", h}, {keys[1], "a", h}, {keys[2], "a", h}, {keys[3], "a", h}},
+			wantAdded:     true,
+			wantFinalized: true,
+			wantFinal:     "a",
+		},
+		{
+			name:      "three of five validators are not enough",
+			votes:     []vote{{keys[0], "a", h}, {keys[1], "a", h}, {keys[2], "a", h}},
+			wantAdded: true,
+		},
+		{
+			name:  "a repeated vote is not relayed again",
+			votes: []vote{{keys[0], "a", h}, {keys[0], "a", h}},
+		},
+		{
+			name:    "voting twice in an epoch is equivocation",
+			votes:   []vote{{keys[0], "a", h}, {keys[0], "x", h}},
+			wantErr: ErrEquivocation,
+		},
+		{
+			name:          "a checkpoint extending the final one is finalized",
+			final:         "a",
+			votes:         []vote{{keys[0], "b", 2 * h}, {keys[1], "b", 2 * h}, {keys[2], "b", 2 * h}, {keys[3], "b", 2 * h}},
+			wantAdded:     true,
+			wantFinalized: true,
+			wantFinal:     "b",
+		},
+		{
+			name:      "a checkpoint not extending the final one is held",
+			final:     "a",
+			votes:     []vote{{keys[0], "x", 2 * h}, {keys[1], "x", 2 * h}, {keys[2], "x", 2 * h}, {keys[3], "x", 2 * h}},
+			wantAdded: true,
+			wantFinal: "a",
+		},
+		{
+			name:      "votes for final epochs are ignored",
+			final:     "a",
+			votes:     []vote{{keys[0], "a", h}},
+			wantFinal: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fg := NewFinalityGadget(validators)
+			if tt.final != "" {
+				(*fg).FinalizedId = tt.final
+				(*fg).FinalizedHeight = h
+			}
+			var added, finalized bool
+			var err error
+			for _, v := range tt.votes {
+				added, finalized, err = fg.AddVote(testVote(v.key, v.checkpoint, v.height), descends)
+			}
+			if added != tt.wantAdded || finalized != tt.wantFinalized || err != tt.wantErr {
+				t.Fatalf("AddVote() = (%v, %v, %v), want (%v, %v, %v)", added, finalized, err, tt.wantAdded, tt.wantFinalized, tt.wantErr)
+			}
+			if got, _ := fg.Finalized(); got != tt.wantFinal {
+				t.Fatalf("final checkpoint = %q, want %q", got, tt.wantFinal)
+			}
+		})
+	}
+
+	t.Run("invalid votes are rejected", func(t *testing.T) {
+		fg := NewFinalityGadget(validators)
+		bad := []*CheckpointVote{
+			testVote(outsider[0], "a", h),
+			testVote(keys[0], "a", h+1),
+			testVote(keys[0], "a", 0),
+		}
+		tampered := testVote(keys[1], "a", h)
+		(*tampered).Checkpoint = "x"
+		bad = append(bad, tampered)
+		for i, vote := range bad {
+			if _, _, err := fg.AddVote(vote, descends); err == nil || err == ErrEquivocation {
+				t.Errorf("vote %d: got error %v, want a penalized error", i, err)
+			}
+		}
+	})
+
+	t.Run("a held checkpoint is finalized once it extends the final one", func(t *testing.T) {
+		fg := NewFinalityGadget(validators)
+		(*fg).FinalizedId = "a"
+		(*fg).FinalizedHeight = h
+		unknown := func(string, string, uint32) bool { return false }
+		for _, key := range keys[:4] {
+			fg.AddVote(testVote(key, "b", 2*h), unknown)
+		}
+		if held := fg.Held(); len(held) != 1 || held[0] != "b" {
+			t.Fatalf("Held() = %v, want [b]", held)
+		}
+		if fg.FinalizeHeld(unknown) {
+			t.Fatal("FinalizeHeld() finalized a checkpoint that is still unknown")
+		}
+		if !fg.FinalizeHeld(descends) {
+			t.Fatal("FinalizeHeld() did not finalize the received checkpoint")
+		}
+		if got, height := fg.Finalized(); got != "b" || height != 2*h || len(fg.Held()) != 0 {
+			t.Fatalf("Finalized() = (%q, %d) with %d held, want (b, %d) with none", got, height, len(fg.Held()), 2*h)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chuckpreslar/emission"
+)
+
+// Sizes of the inbound queue and of the pool of workers handling it
+const INBOX_QUEUE_SIZE int = 1000
+const INBOX_WORKERS int = 4
+
+// When the queue is full, a message waits this long for room before being dropped.
+const INBOX_ENQUEUE_TIMEOUT time.Duration = 50 * time.Millisecond
+
+type inboundMessage struct {
+	From string
+	Msg  string
+	Data []byte
+}
+
+// Counts of messages handled and dropped by an inbox, by message type.
+type InboxStats struct {
+	Delivered   map[string]uint64
+	RateLimited map[string]uint64
+	QueueFull   map[string]uint64
+}
+
+/**
+ * Queues messages from the network for a client.  Messages over the rate
+ * limits are dropped, and the rest wait in a bounded queue that a fixed
+ * number of workers hand to the client's listeners, so a flood of messages
+ * cannot spawn an unbounded number of goroutines.  Senders are held back
+ * briefly when the queue is full, and their messages dropped if it stays full.
+ */
+type Inbox struct {
+	Limiter *RateLimiter
+	emitter *emission.Emitter
+	queue   chan inboundMessage
+	stats   InboxStats
+	mu      sync.Mutex
+}
+
+func NewInbox(emitter *emission.Emitter) *Inbox {
+	var in Inbox
+	in.Limiter = NewRateLimiter()
+	in.emitter = emitter
+	in.queue = make(chan inboundMessage, INBOX_QUEUE_SIZE)
+	in.stats.Delivered = make(map[string]uint64)
+	in.stats.RateLimited = make(map[string]uint64)
+	in.stats.QueueFull = make(map[string]uint64)
+	for i := 0; i < INBOX_WORKERS; i++ {
+		go in.work()
+	}
+	return &in
+}
+
+// Called by the network for every message sent to the client.
+func (in *Inbox) Deliver(from string, msg string, data []byte) {
+	if !(*in).Limiter.Allow(from, msg) {
+		in.count((*in).stats.RateLimited, msg)
+		return
+	}
+	message := inboundMessage{From: from, Msg: msg, Data: data}
+	select {
+	case (*in).queue <- message:
+		return
+	default:
+	}
+	timer := time.NewTimer(INBOX_ENQUEUE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case (*in).queue <- message:
+	case <-timer.C:
+		in.count((*in).stats.QueueFull, msg)
+	}
+}
+
+// A copy of the counters of delivered and dropped messages.
+func (in *Inbox) Stats() InboxStats {
+	(*in).mu.Lock()
+	defer (*in).mu.Unlock()
+	stats := InboxStats{
+		Delivered:   make(map[string]uint64),
+		RateLimited: make(map[string]uint64),
+		QueueFull:   make(map[string]uint64),
+	}
+	for msg, count := range (*in).stats.Delivered {
+		stats.Delivered[msg] = count
+	}
+	for msg, count := range (*in).stats.RateLimited {
+		stats.RateLimited[msg] = count
+	}
+	for msg, count := range (*in).stats.QueueFull {
+		stats.QueueFull[msg] = count
+	}
+	return stats
+}
+
+// The number of messages dropped for any reason.
+func (in *Inbox) Dropped() uint64 {
+	(*in).mu.Lock()
+	defer (*in).mu.Unlock()
+	var total uint64 = 0
+	for _, count := range (*in).stats.RateLimited {
+		total += count
+	}
+	for _, count := range (*in).stats.QueueFull {
+		total += count
+	}
+	return total
+}
+
+func (in *Inbox) QueueLength() int {
+	return len((*in).queue)
+}
+
+func (in *Inbox) work() {
+	for message := range (*in).queue {
+		(*in).emitter.EmitSync(message.Msg, message.From, message.Data)
+		in.count((*in).stats.Delivered, message.Msg)
+	}
+}
+
+func (in *Inbox) count(counters map[string]uint64, msg string) {
+	(*in).mu.Lock()
+	defer (*in).mu.Unlock()
+	counters[msg]++
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of inventory that can be announced
+const INV_TX string = "tx"
+const INV_BLOCK string = "block"
+
+// Requests a block in compact form, but is never announced.
+const INV_CMPCT_BLOCK string = "cmpctblock"
+
+// Limits on the inventory remembered per peer and for the node itself
+const MAX_KNOWN_INVENTORY int = 5000
+
+// An item that is not delivered within GETDATA_TIMEOUT is requested
+// again from another peer that announced it.
+const GETDATA_TIMEOUT time.Duration = 2 * time.Second
+
+// Identifies a transaction or block in INV, GETDATA and NOTFOUND messages.
+type InvItem struct {
+	Type string
+	Id   string
+}
+
+// An item being fetched, with the peers that announced it and have not failed to deliver it yet.
+type invRequest struct {
+	Item       InvItem
+	Announcers []string
+	Peer       string
+	Sent       time.Time
+}
+
+/**
+ * Tracks which inventory each peer is known to have, so that an item is
+ * announced and sent at most once per link, and which items the node has
+ * already seen or requested.
+ */
+type Inventory struct {
+	known     map[string]map[string]bool
+	seen      map[string]bool
+	requested map[string]*invRequest
+	mu        sync.Mutex
+}
+
+func NewInventory() *Inventory {
+	var inv Inventory
+	inv.known = make(map[string]map[string]bool)
+	inv.seen = make(map[string]bool)
+	inv.requested = make(map[string]*invRequest)
+	return &inv
+}
+
+// Records that a peer has an item, either because it announced or sent it,
+// or because we announced or sent it to the peer.
+func (inv *Inventory) MarkKnown(peer string, id string) {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	inv.markKnown(peer, id)
+}
+
+func (inv *Inventory) Knows(peer string, id string) bool {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	return (*inv).known[peer][id]
+}
+
+/**
+ * Filters the peers down to those that do not know about the item yet,
+ * marking the item as known to them since it is about to be announced.
+ */
+func (inv *Inventory) PeersToAnnounce(peers []string, id string) []string {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	unaware := make([]string, 0)
+	for _, peer := range peers {
+		if !(*inv).known[peer][id] {
+			inv.markKnown(peer, id)
+			unaware = append(unaware, peer)
+		}
+	}
+	return unaware
+}
+
+/**
+ * Records that a peer announced an item, and determines whether the item
+ * should be requested from it.  Items that have been seen are never
+ * requested, and an item is only requested from one peer at a time.  The
+ * other peers that announced it are asked in turn if that peer does not
+ * deliver it.
+ */
+func (inv *Inventory) ShouldRequest(peer string, item InvItem) bool {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	if (*inv).seen[item.Id] {
+		return false
+	}
+	req, ok := (*inv).requested[item.Id]
+	if !ok {
+		if len((*inv).requested) >= MAX_KNOWN_INVENTORY {
+			(*inv).requested = make(map[string]*invRequest)
+		}
+		req = &invRequest{Item: item, Announcers: make([]string, 0)}
+		(*inv).requested[item.Id] = req
+	}
+	if !containsPeer(req.Announcers, peer) {
+		req.Announcers = append(req.Announcers, peer)
+	}
+	if req.Peer != "" && time.Since(req.Sent) < GETDATA_TIMEOUT {
+		return false
+	}
+	req.Peer = peer
+	req.Sent = time.Now()
+	return true
+}
+
+// Records that the node has an item, so it is not requested again.
+func (inv *Inventory) MarkSeen(id string) {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	if len((*inv).seen) >= MAX_KNOWN_INVENTORY {
+		(*inv).seen = make(map[string]bool)
+	}
+	(*inv).seen[id] = true
+	delete((*inv).requested, id)
+}
+
+/**
+ * Handles a peer that could not serve an item we asked it for.  Returns
+ * the next peer that announced the item, and the item to ask it for, if
+ * there is one left.
+ */
+func (inv *Inventory) NotFound(peer string, id string) (string, InvItem, bool) {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	req, ok := (*inv).requested[id]
+	if !ok {
+		return "", InvItem{}, false
+	}
+	req.Announcers = removePeer(req.Announcers, peer)
+	if req.Peer != peer {
+		return "", InvItem{}, false
+	}
+	return inv.next(req)
+}
+
+/**
+ * Handles a block that could not be rebuilt from its compact form.  The
+ * full block is asked from the next peer that announced it, or from the
+ * same peer if no other one did.
+ */
+func (inv *Inventory) Expired(id string) (string, InvItem, bool) {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	req, ok := (*inv).requested[id]
+	if !ok {
+		return "", InvItem{}, false
+	}
+	if req.Peer != "" {
+		req.Announcers = append(removePeer(req.Announcers, req.Peer), req.Peer)
+	}
+	return inv.next(req)
+}
+
+// Moves the requests that timed out on to the next peer that announced each item, grouped by peer.
+func (inv *Inventory) DueRetries() map[string][]InvItem {
+	(*inv).mu.Lock()
+	defer (*inv).mu.Unlock()
+	retries := make(map[string][]InvItem)
+	for _, req := range (*inv).requested {
+		if req.Peer == "" || time.Since(req.Sent) < GETDATA_TIMEOUT {
+			continue
+		}
+		req.Announcers = removePeer(req.Announcers, req.Peer)
+		if peer, item, ok := inv.next(req); ok {
+			retries[peer] = append(retries[peer], item)
+		}
+	}
+	return retries
+}
+
+func (inv *Inventory) next(req *invRequest) (string, InvItem, bool) {
+	if len(req.Announcers) == 0 {
+		delete((*inv).requested, req.Item.Id)
+		return "", InvItem{}, false
+	}
+	req.Peer = req.Announcers[0]
+	req.Sent = time.Now()
+	return req.Peer, req.Item, true
+}
+
+func (inv *Inventory) markKnown(peer string, id string) {
+	peerKnown, ok := (*inv).known[peer]
+	if !ok || len(peerKnown) >= MAX_KNOWN_INVENTORY {
+		peerKnown = make(map[string]bool)
+		(*inv).known[peer] = peerKnown
+	}
+	peerKnown[id] = true
+}
+
+func containsPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+func removePeer(peers []string, peer string) []string {
+	kept := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if p != peer {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
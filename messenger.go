@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+/**
+ * Sends and opens the envelopes of a client's messages, remembering the
+ * protocol version agreed with each peer.  Peers that have not completed
+ * a handshake are sent the latest version.
+ */
+type Messenger struct {
+	Address           string
+	PrivKey           *rsa.PrivateKey
+	Net               Transport
+	SignMessages      bool
+	RequireSignatures bool
+	versions          map[string]uint32
+	mu                sync.Mutex
+}
+
+func NewMessenger(address string, privKey *rsa.PrivateKey, net Transport) *Messenger {
+	var ms Messenger
+	ms.Address = address
+	ms.PrivKey = privKey
+	ms.Net = net
+	ms.SignMessages = true
+	ms.RequireSignatures = true
+	ms.versions = make(map[string]uint32)
+	return &ms
+}
+
+func (ms *Messenger) Seal(version uint32, msg string, data []byte) []byte {
+	envelope := Envelope{
+		Version: version,
+		Magic:   NETWORK_MAGIC,
+		Sender:  (*ms).Address,
+		Type:    msg,
+		Payload: data,
+	}
+	if (*ms).SignMessages {
+		envelope.Sign((*ms).PrivKey)
+	}
+	jsonByte, err := json.Marshal(&envelope)
+	if err != nil {
+		fmt.Println("Seal() Marshal Panic:")
+		panic(err)
+	}
+	return jsonByte
+}
+
+// Unwraps a message received from a peer, returning an error if the envelope is not valid.
+func (ms *Messenger) Open(from string, msg string, data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if err := envelope.Validate(from, msg, (*ms).RequireSignatures); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+func (ms *Messenger) Send(to string, msg string, data []byte) {
+	(*ms).Net.SendMessage((*ms).Address, to, msg, ms.Seal(ms.Version(to), msg, data))
+}
+
+// Sends a message to all peers, sealing it once for each version in use.
+func (ms *Messenger) Broadcast(msg string, data []byte) {
+	sealed := make(map[uint32][]byte)
+	for _, peer := range (*ms).Net.Peers((*ms).Address) {
+		version := ms.Version(peer)
+		if _, ok := sealed[version]; !ok {
+			sealed[version] = ms.Seal(version, msg, data)
+		}
+		(*ms).Net.SendMessage((*ms).Address, peer, msg, sealed[version])
+	}
+}
+
+// The version agreed with the peer, or the latest version if there was no handshake.
+func (ms *Messenger) Version(peer string) uint32 {
+	(*ms).mu.Lock()
+	defer (*ms).mu.Unlock()
+	if version, ok := (*ms).versions[peer]; ok {
+		return version
+	}
+	return PROTOCOL_VERSION
+}
+
+func (ms *Messenger) SetVersion(peer string, version uint32) {
+	(*ms).mu.Lock()
+	defer (*ms).mu.Unlock()
+	(*ms).versions[peer] = version
+}
+
+func (ms *Messenger) HandshakeDone(peer string) bool {
+	(*ms).mu.Lock()
+	defer (*ms).mu.Unlock()
+	_, ok := (*ms).versions[peer]
+	return ok
+}
+
+func (ms *Messenger) Forget(peer string) {
+	(*ms).mu.Lock()
+	defer (*ms).mu.Unlock()
+	delete((*ms).versions, peer)
+}
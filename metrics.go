@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A node's name, blocks and head, as seen at the end of a simulation.
+type ChainView struct {
+	Name    string
+	Address string
+	Blocks  map[string]*Block
+	Head    *Block
+}
+
+// One measurement, labeled by the block, transaction or miner it is about.
+type Sample struct {
+	Label string
+	Value float64
+}
+
+type DistributionSummary struct {
+	Count  int
+	Mean   float64
+	Median float64
+	P90    float64
+	Max    float64
+}
+
+type MinerShare struct {
+	Name        string
+	Address     string
+	Blocks      int
+	BlockShare  float64
+	RewardShare float64
+}
+
+/**
+ * What happened during a simulation, measured on the longest chain known
+ * to any node.  Times are in seconds.  Blocks count as found when some
+ * node first saw them, and transactions as sent when they were posted.
+ * A transaction is confirmed once CONFIRMED_DEPTH blocks follow the block
+ * that includes it.  Stale blocks are those known to some node but not on
+ * the longest chain.
+ */
+type SimulationMetrics struct {
+	Reference           string
+	Duration            float64
+	ChainLength         uint32
+	BlocksSeen          int
+	StaleBlocks         int
+	StaleRate           float64
+	ReorgDepths         map[int]int
+	BlockIntervals      []Sample
+	InclusionLatency    []Sample
+	ConfirmationLatency []Sample
+	BlockPropagation    []Sample
+	TxPropagation       []Sample
+	RewardShares        []MinerShare
+	Summary             map[string]DistributionSummary
+}
+
+// Measures a simulation from the final views of its nodes and what its network recorded.
+func CollectMetrics(views []ChainView, propagation *PropagationTracker, reorgs *ReorgTracker, duration time.Duration) *SimulationMetrics {
+	metrics := &SimulationMetrics{
+		Duration:            duration.Seconds(),
+		ReorgDepths:         reorgs.Depths(),
+		BlockIntervals:      make([]Sample, 0),
+		InclusionLatency:    make([]Sample, 0),
+		ConfirmationLatency: make([]Sample, 0),
+		BlockPropagation:    make([]Sample, 0),
+		TxPropagation:       make([]Sample, 0),
+		RewardShares:        make([]MinerShare, 0),
+		Summary:             make(map[string]DistributionSummary),
+	}
+	if len(views) == 0 {
+		return metrics
+	}
+
+	var reference ChainView
+	names := make(map[string]string)
+	allBlocks := make(map[string]*Block)
+	for _, view := range views {
+		names[view.Address] = view.Name
+		if reference.Head == nil || view.Head.ChainLength > reference.Head.ChainLength {
+			reference = view
+		}
+		for blockId, block := range view.Blocks {
+			allBlocks[blockId] = block
+		}
+	}
+	metrics.Reference = reference.Name
+	metrics.ChainLength = reference.Head.ChainLength
+
+	// The longest chain, indexed by height.
+	chain := make([]*Block, reference.Head.ChainLength+1)
+	for block := reference.Head; block != nil; block = reference.Blocks[block.PrevBlockHash] {
+		chain[block.ChainLength] = block
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+	onChain := make(map[string]bool)
+	for _, block := range chain {
+		if block != nil {
+			onChain[block.GetHash()] = true
+		}
+	}
+	for blockId, block := range allBlocks {
+		if block.IsGenesisBlock() {
+			continue
+		}
+		metrics.BlocksSeen++
+		if !onChain[blockId] {
+			metrics.StaleBlocks++
+		}
+	}
+	if metrics.BlocksSeen > 0 {
+		metrics.StaleRate = float64(metrics.StaleBlocks) / float64(metrics.BlocksSeen)
+	}
+
+	found := func(block *Block) (time.Time, bool) {
+		if block == nil {
+			return time.Time{}, false
+		}
+		return propagation.FirstSeen(block.GetHash())
+	}
+	for height := 2; height < len(chain); height++ {
+		prev, okPrev := found(chain[height-1])
+		next, okNext := found(chain[height])
+		if okPrev && okNext {
+			metrics.BlockIntervals = append(metrics.BlockIntervals, Sample{strconv.Itoa(height), next.Sub(prev).Seconds()})
+		}
+	}
+	for height := 1; height < len(chain); height++ {
+		included, ok := found(chain[height])
+		if !ok {
+			continue
+		}
+		confirmed, isConfirmed := time.Time{}, false
+		if height+int(CONFIRMED_DEPTH) < len(chain) {
+			confirmed, isConfirmed = found(chain[height+int(CONFIRMED_DEPTH)])
+		}
+		for _, tx := range chain[height].Transactions {
+			sent, ok := propagation.FirstSeen(tx.Id)
+			if !ok {
+				continue
+			}
+			metrics.InclusionLatency = append(metrics.InclusionLatency, Sample{tx.Id, included.Sub(sent).Seconds()})
+			if isConfirmed {
+				metrics.ConfirmationLatency = append(metrics.ConfirmationLatency, Sample{tx.Id, confirmed.Sub(sent).Seconds()})
+			}
+		}
+	}
+
+	for _, stats := range propagation.AllStats() {
+		sample := Sample{stats.Id, stats.Median.Seconds()}
+		if _, isBlock := allBlocks[stats.Id]; isBlock {
+			metrics.BlockPropagation = append(metrics.BlockPropagation, sample)
+		} else {
+			metrics.TxPropagation = append(metrics.TxPropagation, sample)
+		}
+	}
+
+	for addr, share := range RewardShares(reference.Blocks, reference.Head) {
+		name, ok := names[addr]
+		if !ok {
+			name = addr
+		}
+		metrics.RewardShares = append(metrics.RewardShares, MinerShare{
+			Name: name, Address: addr, Blocks: share.Blocks, BlockShare: share.BlockShare, RewardShare: share.RewardShare,
+		})
+	}
+	sort.Slice(metrics.RewardShares, func(i, j int) bool {
+		return metrics.RewardShares[i].Name < metrics.RewardShares[j].Name
+	})
+
+	metrics.Summary["block_interval"] = summarize(metrics.BlockIntervals)
+	metrics.Summary["tx_inclusion_latency"] = summarize(metrics.InclusionLatency)
+	metrics.Summary["tx_confirmation_latency"] = summarize(metrics.ConfirmationLatency)
+	metrics.Summary["block_propagation"] = summarize(metrics.BlockPropagation)
+	metrics.Summary["tx_propagation"] = summarize(metrics.TxPropagation)
+	return metrics
+}
+
+func summarize(samples []Sample) DistributionSummary {
+	summary := DistributionSummary{Count: len(samples)}
+	if len(samples) == 0 {
+		return summary
+	}
+	values := make([]float64, 0, len(samples))
+	total := 0.0
+	for _, sample := range samples {
+		values = append(values, sample.Value)
+		total += sample.Value
+	}
+	sort.Float64s(values)
+	summary.Mean = total / float64(len(values))
+	summary.Median = values[len(values)/2]
+	summary.P90 = values[len(values)*9/10]
+	summary.Max = values[len(values)-1]
+	return summary
+}
+
+func (m *SimulationMetrics) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+/**
+ * Writes the metrics as rows of metric, label and value, one row per
+ * sample, so that each metric can be selected and plotted on its own.
+ */
+func (m *SimulationMetrics) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	format := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	rows := [][]string{
+		{"metric", "label", "value"},
+		{"duration", "", format((*m).Duration)},
+		{"chain_length", "", strconv.Itoa(int((*m).ChainLength))},
+		{"blocks_seen", "", strconv.Itoa((*m).BlocksSeen)},
+		{"stale_blocks", "", strconv.Itoa((*m).StaleBlocks)},
+		{"stale_rate", "", format((*m).StaleRate)},
+	}
+	depths := make([]int, 0, len((*m).ReorgDepths))
+	for depth := range (*m).ReorgDepths {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+	for _, depth := range depths {
+		rows = append(rows, []string{"reorg_depth", strconv.Itoa(depth), strconv.Itoa((*m).ReorgDepths[depth])})
+	}
+	for _, share := range (*m).RewardShares {
+		rows = append(rows,
+			[]string{"miner_blocks", share.Name, strconv.Itoa(share.Blocks)},
+			[]string{"block_share", share.Name, format(share.BlockShare)},
+			[]string{"reward_share", share.Name, format(share.RewardShare)})
+	}
+	series := []struct {
+		metric  string
+		samples []Sample
+	}{
+		{"block_interval", (*m).BlockIntervals},
+		{"tx_inclusion_latency", (*m).InclusionLatency},
+		{"tx_confirmation_latency", (*m).ConfirmationLatency},
+		{"block_propagation", (*m).BlockPropagation},
+		{"tx_propagation", (*m).TxPropagation},
+	}
+	for _, s := range series {
+		for _, sample := range s.samples {
+			rows = append(rows, []string{s.metric, sample.Label, format(sample.Value)})
+		}
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+// Writes the metrics to whichever of the JSON and CSV paths are given.
+func SaveMetrics(metrics *SimulationMetrics, jsonPath string, csvPath string) error {
+	reports := []struct {
+		path  string
+		write func(io.Writer) error
+	}{
+		{jsonPath, metrics.WriteJSON},
+		{csvPath, metrics.WriteCSV},
+	}
+	for _, report := range reports {
+		if report.path == "" {
+			continue
+		}
+		file, err := os.Create(report.path)
+		if err != nil {
+			return err
+		}
+		err = report.write(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %v", report.path, err)
+		}
+	}
+	return nil
+}
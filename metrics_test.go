@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func testSamples(values ...float64) []Sample {
+	samples := make([]Sample, 0, len(values))
+	for _, value := range values {
+		samples = append(samples, Sample{Value: value})
+	}
+	return samples
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []Sample
+		want    DistributionSummary
+	}{
+		{"no samples", nil, DistributionSummary{}},
+		{"one sample", testSamples(5), DistributionSummary{Count: 1, Mean: 5, Median: 5, P90: 5, Max: 5}},
+		{"unsorted samples", testSamples(3, 1, 2), DistributionSummary{Count: 3, Mean: 2, Median: 2, P90: 3, Max: 3}},
+		// With an even count, the higher of the middle samples is the median.
+		{"an even count", testSamples(4, 1, 3, 2), DistributionSummary{Count: 4, Mean: 2.5, Median: 3, P90: 4, Max: 4}},
+		{"ten samples", testSamples(10, 9, 8, 7, 6, 5, 4, 3, 2, 1), DistributionSummary{Count: 10, Mean: 5.5, Median: 6, P90: 10, Max: 10}},
+		{"an outlier", testSamples(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 91), DistributionSummary{Count: 11, Mean: 9.181818181818182, Median: 1, P90: 1, Max: 91}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarize(tt.samples); got != tt.want {
+				t.Fatalf("summarize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"spartangold/utils"
 	"sync"
+	"time"
 
 	"github.com/chuckpreslar/emission"
 )
@@ -22,43 +26,96 @@ type Miner struct {
 	Blocks                      map[string]*Block
 	PendingOutgoingTransactions map[string]*Transaction
 	PendingReceivedTransactions map[string]*Transaction
-	PendingBlocks               map[string]*utils.Set[*Block]
+	PendingBlocks               *OrphanPool
+	Sync                        *ChainSync
+	Inventory                   *Inventory
+	CompactBlocks               *CompactBlocks
+	Peers                       *PeerManager
+	Misbehavior                 *MisbehaviorTracker
+	Engine                      ConsensusEngine
+	Finality                    *FinalityGadget
+	Params                      *ChainParams
+	ConfirmedDepth              uint32
+	Strategy                    MiningStrategy
 	LastBlock                   *Block
 	LastConfirmedBlock          *Block
 	ReceivedBlock               *Block
 	Nonce                       uint32
-	Net                         *FakeNet
+	Net                         Transport
+	Messenger                   *Messenger
 	Emitter                     *emission.Emitter
+	Inbox                       *Inbox
 	mu                          sync.Mutex
 
 	CurrentBlock *Block
 	MiningRounds uint32
-	Transactions *utils.Set[*Transaction]
+	Hashrate     *HashrateMeter
+	throttle     *TokenBucket
+	// Blocks handed out to external workers, by template ID, oldest first.
+	templates     map[string]*Block
+	templateOrder []string
+	Transactions  *utils.Set[*Transaction]
+	searchCtx     context.Context
+	cancelSearch  context.CancelFunc
+	stopped       bool
 }
 
-func NewMiner(name string, Net *FakeNet, miningRounds uint32, startingBlock *Block /*, config BlockchainConfig*/) *Miner {
+func NewMiner(name string, Net Transport, miningRounds uint32, startingBlock *Block /*, config BlockchainConfig*/) *Miner {
 	var m Miner
 	m.Net = Net
 	m.Name = name
 	m.PrivKey, m.PubKey = utils.GenerateKeypair()
 
 	m.Address = utils.CalcAddress(m.PubKey)
+	m.Messenger = NewMessenger(m.Address, m.PrivKey, Net)
 	m.Nonce = 0
 
 	m.PendingOutgoingTransactions = make(map[string]*Transaction)
 	m.PendingReceivedTransactions = make(map[string]*Transaction)
 	m.Blocks = make(map[string]*Block)
-	m.PendingBlocks = make(map[string]*utils.Set[*Block])
+	m.PendingBlocks = NewOrphanPool()
+	m.Sync = NewChainSync()
+	m.Inventory = NewInventory()
+	m.CompactBlocks = NewCompactBlocks()
+	m.Peers = NewPeerManager()
+	m.Misbehavior = NewMisbehaviorTracker()
+	m.Engine = NewPowEngine(miningRounds)
+	m.Params = DefaultChainParams()
+	m.ConfirmedDepth = CONFIRMED_DEPTH
 
 	if startingBlock != nil {
 		m.SetGenesisBlock(startingBlock)
 	}
 
 	m.Emitter = emission.NewEmitter()
-	m.Emitter.On(PROOF_FOUND, m.ReceiveBlockBytes)
-	m.Emitter.On(MISSING_BLOCK, m.ProvideMissingBlock)
+	m.Inbox = NewInbox(m.Emitter)
+	m.HandleMessage(PROOF_FOUND, func(from string, bs []byte) {
+		m.ReceiveBlockBytes(from, bs)
+	})
+	m.HandleMessage(MISSING_BLOCK, m.ProvideMissingBlock)
+	m.HandleMessage(VERSION, m.ReceiveVersion)
+	m.HandleMessage(VERACK, m.ReceiveVerack)
+	m.HandleMessage(GETADDR, m.ProvideAddresses)
+	m.HandleMessage(ADDR, m.ReceiveAddresses)
+	m.HandleMessage(INV, m.ReceiveInv)
+	m.HandleMessage(GETDATA, m.ProvideData)
+	m.HandleMessage(NOTFOUND, m.ReceiveNotFound)
+	m.HandleMessage(CMPCTBLOCK, m.ReceiveCompactBlock)
+	m.HandleMessage(GETBLOCKTXN, m.ProvideBlockTxn)
+	m.HandleMessage(BLOCKTXN, m.ReceiveBlockTxn)
+	m.HandleMessage(GET_HEAD, m.ProvideHead)
+	m.HandleMessage(HEAD, m.ReceiveHead)
+	m.HandleMessage(GET_HEADERS, m.ProvideHeaders)
+	m.HandleMessage(HEADERS, m.ReceiveHeaders)
+	m.HandleMessage(GET_BLOCKS, m.ProvideBlocks)
+	m.HandleMessage(CHECKPOINT_VOTE, m.ReceiveCheckpointVote)
+	m.HandleMessage(GET_CHECKPOINT, m.ProvideCheckpoint)
+	m.HandleMessage(CHECKPOINT, m.ReceiveCheckpoint)
 
 	m.MiningRounds = miningRounds
+	m.Hashrate = NewHashrateMeter()
+	m.templates = make(map[string]*Block)
+	m.templateOrder = make([]string, 0)
 
 	m.Transactions = utils.NewSet[*Transaction]()
 
@@ -85,7 +142,7 @@ func (m *Miner) Initialize() {
 	m.StartNewSearch(nil)
 
 	(*m).Emitter.On(START_MINING, m.FindProof)
-	(*m).Emitter.On(POST_TRANSACTION, m.AddTransactionBytes)
+	(*m).HandleMessage(POST_TRANSACTION, m.AddTransactionBytes)
 
 	go (*m).Emitter.Emit(START_MINING, false)
 }
@@ -94,8 +151,13 @@ func (m *Miner) Initialize() {
  * Sets up the miner to start searching for a new block.
  */
 func (m *Miner) StartNewSearch(txSet *utils.Set[*Transaction]) {
-	target := utils.CalcTarget(POW_LEADING_ZEROES, POW_BASE_TARGET_STR)
-	(*m).CurrentBlock = NewBlock((*m).Address, (*m).LastBlock, target, COINBASE_AMT_ALLOWED)
+	// Any search for a proof of the previous block is abandoned.
+	if (*m).cancelSearch != nil {
+		(*m).cancelSearch()
+	}
+	(*m).searchCtx, (*m).cancelSearch = context.WithCancel(context.Background())
+
+	(*m).CurrentBlock = NewBlock((*m).Address, (*m).LastBlock, new(big.Int), COINBASE_AMT_ALLOWED)
 
 	// Merging txSet into the transaction queue.
 	// These transactions may include transactions not already included
@@ -116,44 +178,211 @@ func (m *Miner) StartNewSearch(txSet *utils.Set[*Transaction]) {
 	}
 	(*m).Transactions.Clear()
 
-	// Start looking for a proof at 0.
-	(*m).CurrentBlock.Proof = 0
-
+	// The engine fills in the target, proof or other consensus fields.
+	(*m).Engine.Prepare((*m).CurrentBlock, (*m).LastBlock)
 }
 
-// Looks for a "proof".  It breaks after some time to listen for messages.
+// Works on sealing the current block.  It breaks after some time to listen for messages.
 func (m *Miner) FindProof(oneAndDone bool) {
 
+	// The node lock is only held while reading and updating the current
+	// block, so that blocks and transactions can be received while sealing.
 	(*m).mu.Lock()
-	defer (*m).mu.Unlock()
+	ctx := (*m).searchCtx
+	current := (*m).CurrentBlock
+	block := *current
+	parent := (*m).Blocks[block.PrevBlockHash]
+	throttle := (*m).throttle
+	(*m).mu.Unlock()
 
-	pausePoint := (*m).CurrentBlock.Proof + (*m).MiningRounds
+	began := time.Now()
+	extraNonce := block.ExtraNonce
+	sealed, work := (*m).Engine.Seal(ctx, &block, parent, (*m).PrivKey)
+	if throttle != nil {
+		throttle.WaitN(float64(work))
+	}
+	(*m).Hashrate.Record(work, time.Since(began))
 
-	for (*m).CurrentBlock.Proof < pausePoint {
-		if (*m).CurrentBlock.hasValidProof() {
-			m.Print(fmt.Sprintf("found proof for block %d: %d", (*m).CurrentBlock.ChainLength, (*m).CurrentBlock.Proof))
-			m.AnnounceProof()
-			// Note: calling receiveBlock triggers a new search.
-			go m.ReceiveBlock(*(*m).CurrentBlock)
-			break
+	(*m).mu.Lock()
+	// A new block may have replaced the one being sealed in the meantime,
+	// in which case the seal is for a block no longer being mined.
+	if ctx.Err() == nil && (*m).CurrentBlock == current {
+		if block.ExtraNonce != extraNonce {
+			m.Print(fmt.Sprintf("Proofs exhausted for block %d, rolled extra nonce to %d", block.ChainLength, block.ExtraNonce))
+		}
+		current.copySeal(&block)
+		block = *current
+		if sealed {
+			m.Print(fmt.Sprintf("sealed block %d", block.ChainLength))
+			var released []*Block
+			if (*m).Strategy != nil {
+				released = (*m).Strategy.BlockFound(&block)
+			}
+			// The block is stored before it is announced, so that peers
+			// asking for it are given it.  Unless the strategy withholds
+			// it, receiveBlock announces it, and triggers a new search.
+			m.receiveBlock((*m).Address, block)
+			for _, b := range released {
+				m.PublishBlock(b)
+			}
 		}
-		(*m).CurrentBlock.Proof++
 	}
+	stopped := (*m).stopped
+	(*m).mu.Unlock()
 
 	// If we are testing, don't continue the search.
-	if !oneAndDone {
+	if !oneAndDone && !stopped {
 		// Check if anyone has found a block, and then return to mining.
 		go (*m).Emitter.Emit(START_MINING, false)
 	}
 }
 
 /**
- * Broadcast the block, with a valid proof included.
+ * Announces every block of the miner's chain, oldest first, such as a chain
+ * it mined off the network.  Every peer is told, even if the blocks were
+ * announced to it before, since announcements made while off the network
+ * never reached anyone.
+ */
+func (m *Miner) ReleaseChain() {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	chain := make([]*Block, 0)
+	for block := (*m).LastBlock; block != nil && !block.IsGenesisBlock(); block = (*m).Blocks[block.PrevBlockHash] {
+		chain = append(chain, block)
+	}
+	items := make([]InvItem, 0, len(chain))
+	for i := len(chain) - 1; i >= 0; i-- {
+		blockId := chain[i].GetHash()
+		(*m).Inventory.MarkSeen(blockId)
+		(*m).Net.ItemSeen((*m).Address, blockId)
+		items = append(items, InvItem{Type: INV_BLOCK, Id: blockId})
+	}
+	if len(items) == 0 {
+		return
+	}
+	jsonByte, err := json.Marshal(items)
+	if err != nil {
+		fmt.Println("ReleaseChain() Marshal Panic:")
+		panic(err)
+	}
+	for _, peer := range (*m).Net.Peers((*m).Address) {
+		for _, item := range items {
+			(*m).Inventory.MarkKnown(peer, item.Id)
+		}
+		(*m).Messenger.Send(peer, INV, jsonByte)
+	}
+}
+
+/**
+ * Determines whether a transaction is in the miner's current chain, or,
+ * if confirmed is set, in the part of the chain that is confirmed.
+ */
+func (m *Miner) ChainContains(tx *Transaction, confirmed bool) bool {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	block := (*m).LastBlock
+	if confirmed {
+		block = (*m).LastConfirmedBlock
+	}
+	for ; block != nil; block = (*m).Blocks[block.PrevBlockHash] {
+		if block.Contains(tx) {
+			return true
+		}
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+	return false
+}
+
+// Determines whether a block is the miner's last confirmed block or one of its ancestors.
+func (m *Miner) OnConfirmedChain(blockId string) bool {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	for block := (*m).LastConfirmedBlock; block != nil; block = (*m).Blocks[block.PrevBlockHash] {
+		if block.GetHash() == blockId {
+			return true
+		}
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+	return false
+}
+
+// Copies the miner's blocks and head, for analysing a simulation once it is over.
+func (m *Miner) ChainView() ChainView {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	blocks := make(map[string]*Block, len((*m).Blocks))
+	for blockId, block := range (*m).Blocks {
+		blocks[blockId] = block
+	}
+	return ChainView{Name: (*m).Name, Address: (*m).Address, Blocks: blocks, Head: (*m).LastBlock}
+}
+
+// Describes how the miner's chain has changed since its head was the given block.
+func (m *Miner) ReorgSince(oldHead *Block) *Reorg {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	return FindReorg((*m).Blocks, oldHead, (*m).LastBlock)
+}
+
+// Stops mining for good, although the miner still receives and relays blocks.
+func (m *Miner) Stop() {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	(*m).stopped = true
+	if (*m).cancelSearch != nil {
+		(*m).cancelSearch()
+	}
+}
+
+/**
+ * Limits the miner to a simulated hashrate, in hashes per second, so that
+ * miners with different shares of the network's power can be simulated on
+ * one machine.  The total of all the miners' hashrates should stay well
+ * below what the machine can actually compute.  A rate of 0 removes the limit.
+ */
+func (m *Miner) SetHashrate(hashesPerSecond float64) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	if hashesPerSecond <= 0 {
+		(*m).throttle = nil
+		return
+	}
+	(*m).throttle = NewTokenBucket(RateLimit{Rate: hashesPerSecond, Burst: float64((*m).MiningRounds)})
+}
+
+// Blocks and rewards on the miner's current chain, by the address that earned them.
+func (m *Miner) RewardShares() map[string]*RewardShare {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	return RewardShares((*m).Blocks, (*m).LastBlock)
+}
+
+// Hashes per second over recent mining.
+func (m *Miner) HashesPerSecond() float64 {
+	return (*m).Hashrate.Rate()
+}
+
+/**
+ * Announce the block, with a valid proof included.  Peers request
+ * the block itself if they have not seen it yet.
  */
 func (m *Miner) AnnounceProof() {
+	blockId := (*m).CurrentBlock.GetHash()
+	(*m).Inventory.MarkSeen(blockId)
+	(*m).Net.ItemSeen((*m).Address, blockId)
+	m.Announce(InvItem{Type: INV_BLOCK, Id: blockId})
+}
 
-	data := BlockToBytes((*m).CurrentBlock)
-	(*m).Net.Broadcast(PROOF_FOUND, data)
+// Announces a block the miner has stored, such as one it withheld before.
+func (m *Miner) PublishBlock(block *Block) {
+	blockId := block.GetHash()
+	(*m).Inventory.MarkSeen(blockId)
+	(*m).Net.ItemSeen((*m).Address, blockId)
+	m.Announce(InvItem{Type: INV_BLOCK, Id: blockId})
 }
 
 /**
@@ -161,9 +390,16 @@ func (m *Miner) AnnounceProof() {
  * the block will be stored. If it is also a longer chain,
  * the miner will accept it and replace the currentBlock.*/
 
-func (m *Miner) ReceiveBlock(b Block) *Block {
+func (m *Miner) ReceiveBlock(from string, b Block) *Block {
 	(*m).mu.Lock()
 	defer (*m).mu.Unlock()
+	return m.receiveBlock(from, b)
+}
+
+// Like ReceiveBlock, for callers that hold the miner's lock.
+func (m *Miner) receiveBlock(from string, b Block) *Block {
+	// Incoming blocks are also a chance to clean up the orphan pool.
+	m.RetryMissingBlocks()
 
 	block := &b
 	blockId := block.GetHash()
@@ -171,67 +407,107 @@ func (m *Miner) ReceiveBlock(b Block) *Block {
 	if _, received := (*m).Blocks[blockId]; received {
 		return nil
 	}
+	oldHead := (*m).LastBlock
+
+	if !block.IsGenesisBlock() {
+		if err := (*m).Engine.VerifySeal(block, nil); err != nil {
+			m.Print(fmt.Sprintf("Block %v does not have a valid seal: %v\n", blockId, err))
+			m.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("block %v without a valid seal", blockId))
+			return nil
+		}
+	}
 
-	if !block.hasValidProof() && !block.IsGenesisBlock() {
-		m.Print(fmt.Sprintf("Block %v does not have a valid proof\n", blockId))
+	if err := (*m).Params.CheckBlock((*block).ChainLength, blockId, (*block).PrevBlockHash, (*m).Blocks); err != nil {
+		m.Print(fmt.Sprintf("Rejected block: %v", err))
+		m.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
 		return nil
 	}
 
 	prevBlock, received := (*m).Blocks[(*block).PrevBlockHash]
 	if !received && !block.IsGenesisBlock() {
-
-		stuckBlocks, received := (*m).PendingBlocks[(*block).PrevBlockHash]
-		if !received {
-			m.RequestMissingBlock(block)
-			stuckBlocks = utils.NewSet[*Block]()
+		// Parents that are already being downloaded during a sync are not requested.
+		if (*m).PendingBlocks.Add(block, from) && !(*m).Sync.Expects((*block).PrevBlockHash) &&
+			(*m).PendingBlocks.ShouldRequest((*block).PrevBlockHash) {
+			m.RequestMissingBlock((*block).PrevBlockHash)
 		}
-		stuckBlocks.Add(block)
-		(*m).PendingBlocks[block.PrevBlockHash] = stuckBlocks
 		return nil
-
 	}
 
 	if !block.IsGenesisBlock() {
-		if !block.Rerun(prevBlock) {
+		// Engines may check the seal against the parent, e.g. its validators.
+		if err := (*m).Engine.VerifySeal(block, prevBlock); err != nil {
+			m.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("block %v with an invalid seal: %v", blockId, err))
+			return nil
+		}
+		// Blocks below the assume-valid block are not checked for signatures during a sync.
+		var valid bool
+		if (*m).Sync.IsAssumedValid(blockId) {
+			valid = block.RerunAssumeValid(prevBlock)
+		} else {
+			valid = block.Rerun(prevBlock)
+		}
+		if !valid {
+			m.Penalize(from, PENALTY_INVALID_BLOCK, fmt.Sprintf("block %v with invalid transactions", blockId))
 			return nil
 		}
 	}
 
 	blockId = block.GetHash()
 	(*m).Blocks[blockId] = block
-
-	if (*(*m).LastBlock).ChainLength < (*block).ChainLength {
-		(*m).LastBlock = block
-		m.SetLastConfirmed()
+	if (*m).Strategy == nil || !(*m).Strategy.Withholds(blockId) {
+		m.PublishBlock(block)
 	}
 
-	unstuckBlocks, received := (*m).PendingBlocks[blockId]
-	var unstuckBlocksArr []*Block
-	if received {
-		unstuckBlocksArr = unstuckBlocks.ToArray()
+	// Chains that do not include the final checkpoint are never adopted.
+	if (*m).Engine.Weight(block).Cmp((*m).Engine.Weight((*m).LastBlock)) > 0 && m.OnFinalChain(block) {
+		m.SetLastBlock(block)
+	}
+	if (*m).Finality != nil {
+		if (*m).Finality.FinalizeHeld(m.descendsFrom) {
+			checkpointId, height := (*m).Finality.Finalized()
+			m.Print(fmt.Sprintf("checkpoint %v at height %d is final", checkpointId, height))
+			m.ApplyFinality()
+		} else if checkpointId, _ := (*m).Finality.Finalized(); checkpointId == blockId {
+			m.ApplyFinality()
+		}
+	}
+	if (*m).Strategy != nil && (*block).RewardAddr != (*m).Address {
+		for _, b := range (*m).Strategy.BlockReceived(block) {
+			m.PublishBlock(b)
+		}
 	}
 
-	delete((*m).PendingBlocks, blockId)
+	if (*m).Sync.IsSyncing() {
+		(*m).Sync.BlockReceived(blockId)
+		m.RequestBlocks()
+	}
 
-	for _, uBlock := range unstuckBlocksArr {
-		m.Print(fmt.Sprintf("processing unstuck block %v", uBlock.GetHashStr()))
-		go m.ReceiveBlock(*uBlock)
+	unstuckBlocks := (*m).PendingBlocks.RemoveChildren(blockId)
+	for _, uBlock := range unstuckBlocks {
+		m.Print(fmt.Sprintf("processing unstuck block %v", uBlock.Block.GetHashStr()))
+		go m.ReceiveBlock(uBlock.Peer, *uBlock.Block)
 	}
 	m.Print(fmt.Sprintf("block %s received", block.GetHashStr()))
 
-	if (*m).CurrentBlock != nil && (*block).ChainLength >= (*m).CurrentBlock.ChainLength {
+	// The engine's fork choice decides the head, so the search restarts whenever the head moved.
+	if (*m).CurrentBlock != nil && (*m).LastBlock != oldHead {
 		m.Print("Cutting over to new chain")
-		txSet := m.SyncTransaction(block)
+		txSet := m.SyncTransaction((*m).LastBlock)
 		m.StartNewSearch(txSet)
 	}
 
 	return block
 }
 
-func (m *Miner) ReceiveBlockBytes(bs []byte) *Block {
+func (m *Miner) ReceiveBlockBytes(from string, bs []byte) *Block {
 
 	block := BytesToBlock(bs)
-	return m.ReceiveBlock(*block)
+	if block == nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block")
+		return nil
+	}
+	(*m).Inventory.MarkKnown(from, block.GetHash())
+	return m.ReceiveBlock(from, *block)
 }
 
 /**
@@ -281,18 +557,88 @@ func (m *Miner) SyncTransaction(newBlock *Block) *utils.Set[*Transaction] {
 	return cbTxs
 }
 
+/**
+ * Moves the head of the blockchain to the specified block, returning the
+ * transactions of any disconnected blocks to the transaction queue.
+ */
+func (m *Miner) SetLastBlock(block *Block) {
+	reorg := FindReorg((*m).Blocks, (*m).LastBlock, block)
+	(*m).LastBlock = block
+	if reorg != nil {
+		if reorg.Depth() > 0 {
+			m.Print(fmt.Sprintf("Reorg of depth %d from fork point %v, %d transactions returned to mempool",
+				reorg.Depth(), reorg.ForkPoint.GetHashStr(), len(reorg.OrphanedTransactions())))
+			(*m).Net.ChainReorged((*m).Address, reorg.Depth())
+		}
+		for _, b := range reorg.Disconnected {
+			m.DisconnectBlock(b)
+		}
+		for _, b := range reorg.Connected {
+			m.ConnectBlock(b)
+		}
+	}
+	m.SetLastConfirmed()
+	m.VoteCheckpoint()
+}
+
+// Updates the pending transactions for a block joining the current chain.
+func (m *Miner) ConnectBlock(block *Block) {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i].Tx
+		(*m).Transactions.Remove(tx)
+		if tx.Pays((*m).Address) {
+			(*m).PendingReceivedTransactions[tx.Id()] = tx
+		}
+	}
+	go (*m).Emitter.Emit(BLOCK_CONNECTED, BlockToBytes(block))
+}
+
+// Returns the transactions of a block leaving the current chain to the mempool.
+func (m *Miner) DisconnectBlock(block *Block) {
+	for i := range block.Transactions {
+		tx := &block.Transactions[i].Tx
+		(*m).Transactions.Add(tx)
+		if tx.Info.From == (*m).Address {
+			(*m).PendingOutgoingTransactions[tx.Id()] = tx
+		}
+		if tx.Pays((*m).Address) {
+			(*m).PendingReceivedTransactions[tx.Id()] = tx
+		}
+	}
+	go (*m).Emitter.Emit(BLOCK_DISCONNECTED, BlockToBytes(block))
+}
+
 /**
  * Returns false if transaction is not accepted. Otherwise stores
  * the transaction to be added to the next block.*/
 func (m *Miner) AddTransaction(tx *Transaction) {
 	(*m).mu.Lock()
 	defer (*m).mu.Unlock()
+	txId := tx.Id()
+	(*m).Inventory.MarkSeen(txId)
+	(*m).Net.ItemSeen((*m).Address, txId)
+	if (*m).Transactions.ContainsKey(txId) {
+		return
+	}
 	(*m).Transactions.Add(tx)
+	if tx.Pays((*m).Address) {
+		(*m).PendingReceivedTransactions[txId] = tx
+	}
+	m.Announce(InvItem{Type: INV_TX, Id: txId})
 }
 
-func (m *Miner) AddTransactionBytes(data []byte) {
+func (m *Miner) AddTransactionBytes(from string, data []byte) {
 
 	tx := BytesToTransaction(data)
+	if tx == nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed transaction")
+		return
+	}
+	(*m).Inventory.MarkKnown(from, tx.Id())
+	if tx.Sig == nil || !tx.ValidSignature() {
+		m.Penalize(from, PENALTY_INVALID_SIGNATURE, fmt.Sprintf("invalid signature for transaction %v", tx.Id()))
+		return
+	}
 	m.AddTransaction(tx)
 }
 
@@ -301,7 +647,13 @@ func (m *Miner) ConfirmedBalance() uint32 {
 	return (*m).LastConfirmedBlock.BalanceOf((*m).Address)
 }
 
-// Any gold received in the last confirmed block or before
+// Mining rewards and fees earned by the miner that have not yet matured
+func (m *Miner) ImmatureBalance() uint32 {
+	return (*m).LastBlock.ImmatureBalanceOf((*m).Address)
+}
+
+// Any gold received in the last confirmed block or before, excluding
+// mining rewards that have not yet matured
 func (m *Miner) AvailableGold() uint32 {
 	var pendingSpent uint32 = 0
 	for _, tx := range (*m).PendingOutgoingTransactions {
@@ -310,7 +662,29 @@ func (m *Miner) AvailableGold() uint32 {
 	return m.ConfirmedBalance() - pendingSpent
 }
 
-func (m *Miner) PostTransaction(outputs []Output, fee uint32) {
+// Like AvailableGold, for callers that do not hold the miner's lock.
+func (m *Miner) SpendableGold() uint32 {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	return m.AvailableGold()
+}
+
+var ErrInsufficientGold = errors.New("account doesn't have enough balance for transaction")
+
+func (m *Miner) PostTransaction(outputs []Output, fee uint32) *Transaction {
+	tx, err := m.TryPostTransaction(outputs, fee)
+	if err != nil {
+		panic(`Account doesn't have enough balance for transaction`)
+	}
+	return tx
+}
+
+/**
+ * Like PostTransaction, but returns ErrInsufficientGold instead of
+ * panicking.  The balance is checked and the transaction made under the
+ * miner's lock, so concurrent callers cannot overspend.
+ */
+func (m *Miner) TryPostTransaction(outputs []Output, fee uint32) (*Transaction, error) {
 
 	(*m).mu.Lock()
 
@@ -319,8 +693,8 @@ func (m *Miner) PostTransaction(outputs []Output, fee uint32) {
 		total += output.Amount
 	}
 	if total > m.AvailableGold() {
-		// modify here
-		panic(`Account doesn't have enough balance for transaction`)
+		(*m).mu.Unlock()
+		return nil, ErrInsufficientGold
 	}
 	// add data to the constructor
 	tx := NewTransaction((*m).Address, (*m).Nonce, (*m).PubKey, nil, fee, outputs, nil)
@@ -328,36 +702,547 @@ func (m *Miner) PostTransaction(outputs []Output, fee uint32) {
 	tx.Sign((*m).PrivKey)
 	(*m).PendingOutgoingTransactions[tx.Id()] = tx
 	(*m).Nonce++
-	data := TransactionToBytes(tx)
-	(*m).Net.Broadcast(POST_TRANSACTION, data)
 	(*m).mu.Unlock()
 
 	m.AddTransaction(tx)
+	return tx, nil
 }
 
-// Request the previous block from the network.
-// convert []byte into string
-func (m *Miner) RequestMissingBlock(block *Block) {
-	m.Print(fmt.Sprintf("Asking for missing block: %v", block.PrevBlockHash))
-	var msg = Message{(*m).Address, (*block).PrevBlockHash}
+/**
+ * Locks gold as stake, so that the miner can lead slots under
+ * proof-of-stake.  Staked gold cannot be spent again.
+ */
+func (m *Miner) Stake(amount uint32, fee uint32) *Transaction {
+	return m.PostTransaction([]Output{{Address: STAKE_ADDRESS, Amount: amount}}, fee)
+}
+
+// Request a missing block from the network.
+func (m *Miner) RequestMissingBlock(blockId string) {
+	m.Print(fmt.Sprintf("Asking for missing block: %v", blockId))
+	var msg = Message{(*m).Address, blockId}
 	jsonByte, err := json.Marshal(msg)
 	if err != nil {
 		fmt.Println("RequestMissingBlock() Marshal Panic:")
 		panic(err)
 	}
-	(*m).Net.Broadcast(MISSING_BLOCK, jsonByte)
+	(*m).Messenger.Broadcast(MISSING_BLOCK, jsonByte)
+}
+
+// Drops expired orphans and asks again for missing blocks whose request timed out.
+func (m *Miner) RetryMissingBlocks() {
+	if expired := (*m).PendingBlocks.Expire(); expired > 0 {
+		m.Print(fmt.Sprintf("Dropped %d expired orphan blocks", expired))
+	}
+	for _, blockId := range (*m).PendingBlocks.DueRequests() {
+		m.RequestMissingBlock(blockId)
+	}
+	for _, blockId := range (*m).CompactBlocks.Expire() {
+		if peer, item, ok := (*m).Inventory.Expired(blockId); ok {
+			m.RequestData(peer, []InvItem{item})
+		}
+	}
+	if (*m).Sync.IsSyncing() {
+		m.RequestBlocks()
+	}
+}
+
+/**
+ * Registers a handler for a network message, ignoring messages from banned
+ * peers.  The handler is given the payload of the message once its
+ * envelope has been checked, and peers sending invalid envelopes are penalized.
+ */
+func (m *Miner) HandleMessage(msg string, handler func(from string, data []byte)) {
+	(*m).Emitter.On(msg, func(from string, data []byte) {
+		if (*m).Misbehavior.IsBanned(from) {
+			return
+		}
+		envelope, err := (*m).Messenger.Open(from, msg, data)
+		if err != nil {
+			m.Penalize(from, PENALTY_INVALID_ENVELOPE, fmt.Sprintf("%v message: %v", msg, err))
+			return
+		}
+		handler(envelope.Sender, envelope.Payload)
+	})
+}
+
+// Starts the handshake on a new connection by sending the versions this client supports.
+func (m *Miner) SendVersion(peer string) {
+	jsonByte, err := json.Marshal(VersionMessage{Version: PROTOCOL_VERSION, MinVersion: MIN_PROTOCOL_VERSION})
+	if err != nil {
+		fmt.Println("SendVersion() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(peer, VERSION, jsonByte)
+}
+
+// Answers a peer's handshake, using the highest version both sides support.
+func (m *Miner) ReceiveVersion(from string, data []byte) {
+	if version, ok := m.negotiateVersion(from, data); ok {
+		(*m).Messenger.SetVersion(from, version)
+		jsonByte, err := json.Marshal(VersionMessage{Version: version, MinVersion: MIN_PROTOCOL_VERSION})
+		if err != nil {
+			fmt.Println("ReceiveVersion() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Send(from, VERACK, jsonByte)
+	}
+}
+
+// Completes the handshake with the version chosen by the peer.
+func (m *Miner) ReceiveVerack(from string, data []byte) {
+	if version, ok := m.negotiateVersion(from, data); ok {
+		(*m).Messenger.SetVersion(from, version)
+		// Checkpoints finalized before the connection are learned from the peer.
+		if (*m).Finality != nil {
+			(*m).Messenger.Send(from, GET_CHECKPOINT, []byte{})
+		}
+	}
+}
+
+func (m *Miner) negotiateVersion(from string, data []byte) (uint32, bool) {
+	var theirs VersionMessage
+	if err := json.Unmarshal(data, &theirs); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed version message")
+		return 0, false
+	}
+	version, err := NegotiateVersion(theirs)
+	if err != nil {
+		m.Print(fmt.Sprintf("Disconnecting %v: %v", from, err))
+		m.disconnectPeer(from)
+		return 0, false
+	}
+	return version, true
+}
+
+/**
+ * Adds to the misbehavior score of a peer, disconnecting and banning
+ * the peer once the score reaches the threshold.
+ */
+func (m *Miner) Penalize(from string, penalty int, reason string) {
+	if from == (*m).Address {
+		return
+	}
+	if (*m).Misbehavior.Misbehaving(from, penalty, reason) {
+		m.Print(fmt.Sprintf("Banning %v: %v", from, reason))
+		m.disconnectPeer(from)
+	}
+}
+
+// Bans a peer for the given duration and disconnects from it.
+func (m *Miner) BanPeer(address string, duration time.Duration, reason string) {
+	(*m).Misbehavior.Ban(address, duration, reason)
+	m.disconnectPeer(address)
+}
+
+func (m *Miner) UnbanPeer(address string) {
+	(*m).Misbehavior.Unban(address)
+}
+
+func (m *Miner) BannedPeers() []BanEntry {
+	return (*m).Misbehavior.BanList()
+}
+
+func (m *Miner) disconnectPeer(address string) {
+	(*m).Net.Disconnect((*m).Address, address)
+	(*m).Messenger.Forget(address)
+	(*m).Peers.Remove(address)
+	(*m).Peers.Book.Remove(address)
+}
+
+/**
+ * Joins the network through the bootstrap peers, asking each peer that
+ * is connected to for more peers until the target number of outbound
+ * connections is reached.
+ */
+func (m *Miner) StartDiscovery(bootstrap ...PeerAddress) {
+	(*m).Peers.Bootstrap = append((*m).Peers.Bootstrap, bootstrap...)
+	for _, peer := range bootstrap {
+		(*m).Peers.Book.Add(peer)
+	}
+	m.FillOutbound()
+}
+
+// Opens outbound connections to the best peers in the address book.
+func (m *Miner) FillOutbound() {
+	missing := (*m).Peers.MissingOutbound()
+	if missing <= 0 {
+		return
+	}
+	exclude := (*m).Peers.Connected()
+	exclude[(*m).Address] = true
+	for _, ban := range (*m).Misbehavior.BanList() {
+		exclude[ban.Address] = true
+	}
+	for _, peer := range (*m).Peers.Book.Candidates(missing, exclude) {
+		address, err := (*m).Net.Connect((*m).Address, peer)
+		if err != nil {
+			m.Print(fmt.Sprintf("Could not connect to %v: %v", peer.Key(), err))
+			(*m).Peers.Book.Bad(peer.Key())
+			continue
+		}
+		if address != peer.Key() {
+			// Bootstrap peers may only be known by their endpoint.
+			(*m).Peers.Book.Remove(peer.Key())
+			(*m).Peers.Book.Add(PeerAddress{Address: address, Endpoint: peer.Endpoint})
+		}
+		(*m).Peers.AddOutbound(address)
+		(*m).Peers.Book.Good(address)
+		m.SendVersion(address)
+		jsonByte, err := json.Marshal(m.SelfAddress())
+		if err != nil {
+			fmt.Println("FillOutbound() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Send(address, GETADDR, jsonByte)
+	}
+}
+
+// This client's own peer address, which peers can pass on to others.
+func (m *Miner) SelfAddress() PeerAddress {
+	return PeerAddress{Address: (*m).Address, Endpoint: (*m).Net.Endpoint((*m).Address)}
+}
+
+/**
+ * Shares known peers, including this client, with a peer asking for them.
+ * Peers asking on a new connection are counted as inbound, and are
+ * disconnected if there are too many.  The request carries the peer's
+ * own address, which is added to the address book.
+ */
+func (m *Miner) ProvideAddresses(from string, data []byte) {
+	if !(*m).Peers.AddInbound(from) {
+		m.Print(fmt.Sprintf("Too many inbound peers, disconnecting %v", from))
+		(*m).Net.Disconnect((*m).Address, from)
+		return
+	}
+	peers := (*m).Peers.Book.Sample(MAX_ADDR_PER_MESSAGE - 1)
+	var requester PeerAddress
+	if err := json.Unmarshal(data, &requester); err == nil && requester.Address == from {
+		(*m).Peers.Book.Add(requester)
+	}
+	peers = append(peers, m.SelfAddress())
+	jsonByte, err := json.Marshal(peers)
+	if err != nil {
+		fmt.Println("ProvideAddresses() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, ADDR, jsonByte)
+}
+
+func (m *Miner) ReceiveAddresses(from string, data []byte) {
+	var peers []PeerAddress
+	if err := json.Unmarshal(data, &peers); err != nil {
+		m.Print(fmt.Sprintf("Invalid addresses from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed addresses")
+		return
+	}
+	if len(peers) > MAX_ADDR_PER_MESSAGE {
+		peers = peers[:MAX_ADDR_PER_MESSAGE]
+	}
+	for _, peer := range peers {
+		if peer.Address != "" && peer.Address != (*m).Address {
+			(*m).Peers.Book.Add(peer)
+		}
+	}
+	m.FillOutbound()
+}
+
+// Announces a transaction or block to every peer that does not know about it yet.
+func (m *Miner) Announce(item InvItem) {
+	jsonByte, err := json.Marshal([]InvItem{item})
+	if err != nil {
+		fmt.Println("Announce() Marshal Panic:")
+		panic(err)
+	}
+	for _, peer := range (*m).Inventory.PeersToAnnounce((*m).Net.Peers((*m).Address), item.Id) {
+		(*m).Messenger.Send(peer, INV, jsonByte)
+	}
+}
+
+// Requests the announced items that have not been seen yet from the peer.
+func (m *Miner) ReceiveInv(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		m.Print(fmt.Sprintf("Invalid inventory from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed inventory")
+		return
+	}
+	compact := (*m).Messenger.Version(from) >= COMPACT_BLOCKS_VERSION
+	wanted := make([]InvItem, 0)
+	for _, item := range items {
+		(*m).Inventory.MarkKnown(from, item.Id)
+		if !m.HasInventory(item) && (*m).Inventory.ShouldRequest(from, item) {
+			if item.Type == INV_BLOCK && compact {
+				item.Type = INV_CMPCT_BLOCK
+			}
+			wanted = append(wanted, item)
+		}
+	}
+	if len(wanted) > 0 {
+		m.RequestData(from, wanted)
+	}
+}
+
+// Asks a peer for items, falling back on other peers that announced them if they do not arrive in time.
+func (m *Miner) RequestData(peer string, items []InvItem) {
+	jsonByte, err := json.Marshal(items)
+	if err != nil {
+		fmt.Println("RequestData() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(peer, GETDATA, jsonByte)
+	time.AfterFunc(GETDATA_TIMEOUT, m.RetryRequests)
+}
+
+// Asks for the items whose request timed out again, from the next peers that announced them.
+func (m *Miner) RetryRequests() {
+	for peer, items := range (*m).Inventory.DueRetries() {
+		m.RequestData(peer, items)
+	}
+}
+
+// Sends the requested items to the peer, replying with NOTFOUND for any that are unknown.
+func (m *Miner) ProvideData(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		m.Print(fmt.Sprintf("Invalid data request from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed data request")
+		return
+	}
+	notFound := make([]InvItem, 0)
+	for _, item := range items {
+		if block, ok := (*m).Blocks[item.Id]; ok && item.Type == INV_BLOCK {
+			(*m).Messenger.Send(from, PROOF_FOUND, BlockToBytes(block))
+		} else if block, ok := (*m).Blocks[item.Id]; ok && item.Type == INV_CMPCT_BLOCK {
+			(*m).Messenger.Send(from, CMPCTBLOCK, CompactBlockToBytes(block))
+		} else if tx := m.FindTransaction(item.Id); tx != nil && item.Type == INV_TX {
+			(*m).Messenger.Send(from, POST_TRANSACTION, TransactionToBytes(tx))
+		} else {
+			notFound = append(notFound, item)
+			continue
+		}
+		(*m).Inventory.MarkKnown(from, item.Id)
+	}
+	if len(notFound) == 0 {
+		return
+	}
+	jsonByte, err := json.Marshal(notFound)
+	if err != nil {
+		fmt.Println("ProvideData() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, NOTFOUND, jsonByte)
+}
+
+func (m *Miner) ReceiveNotFound(from string, data []byte) {
+	var items []InvItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		m.Print(fmt.Sprintf("Invalid not found message from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed not found message")
+		return
+	}
+	retries := make(map[string][]InvItem)
+	for _, item := range items {
+		if peer, retry, ok := (*m).Inventory.NotFound(from, item.Id); ok {
+			retries[peer] = append(retries[peer], retry)
+		}
+	}
+	for peer, retry := range retries {
+		m.RequestData(peer, retry)
+	}
+}
+
+func (m *Miner) HasInventory(item InvItem) bool {
+	if item.Type == INV_BLOCK {
+		_, ok := (*m).Blocks[item.Id]
+		return ok || (*m).PendingBlocks.Contains(item.Id) || (*m).CompactBlocks.Waiting(item.Id)
+	}
+	return m.FindTransaction(item.Id) != nil
+}
+
+// Looks up a transaction that has not been confirmed yet by its ID.
+func (m *Miner) FindTransaction(txId string) *Transaction {
+	if tx, ok := (*m).Transactions.Get(txId); ok {
+		return tx
+	}
+	if tx, ok := (*m).PendingOutgoingTransactions[txId]; ok {
+		return tx
+	}
+	if (*m).CurrentBlock != nil {
+		if index := (*m).CurrentBlock.FindTransactionIndex(txId); index > -1 {
+			return &(*m).CurrentBlock.Transactions[index].Tx
+		}
+	}
+	return nil
+}
+
+/**
+ * Starts catching up with the network by asking all peers for their head.
+ * Headers are then downloaded from the first peer that is ahead, and the
+ * blocks are fetched from every peer that has them.
+ */
+func (m *Miner) StartSync() {
+	if !(*m).Sync.IsSyncing() {
+		time.AfterFunc(SYNC_CHECK_INTERVAL, m.CheckSync)
+	}
+	(*m).Sync.Start()
+	m.Print("Starting sync")
+	(*m).Messenger.Broadcast(GET_HEAD, []byte{})
+}
+
+// Keeps a sync going when peers stop answering, checking again until it is over.
+func (m *Miner) CheckSync() {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	if peer := (*m).Sync.CheckProgress((*m).LastBlock.ChainLength); peer != "" {
+		m.Print(fmt.Sprintf("Sync peer timed out, asking %v for headers", peer[0:10]))
+		m.RequestHeaders(peer)
+	}
+	if (*m).Sync.IsSyncing() {
+		m.RequestBlocks()
+		time.AfterFunc(SYNC_CHECK_INTERVAL, m.CheckSync)
+	}
+}
+
+// Replies to a peer with the header of the last block.
+func (m *Miner) ProvideHead(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	header := (*m).LastBlock.Header()
+	jsonByte, err := json.Marshal(&header)
+	if err != nil {
+		fmt.Println("ProvideHead() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, HEAD, jsonByte)
+}
+
+func (m *Miner) ReceiveHead(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var header BlockHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		m.Print(fmt.Sprintf("Invalid head from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed head")
+		return
+	}
+	if header.ChainLength > 0 && (*m).Engine.VerifyHeader(&header) != nil {
+		m.Print(fmt.Sprintf("Head from %v does not have a valid seal", from))
+		m.Penalize(from, PENALTY_INVALID_PROOF, "head without a valid seal")
+		return
+	}
+	if (*m).Sync.AddPeerHead(from, &header, (*m).LastBlock.ChainLength) {
+		m.RequestHeaders(from)
+	}
+}
+
+func (m *Miner) RequestHeaders(peer string) {
+	request := HeadersRequest{Locator: (*m).Sync.Locator((*m).Blocks, (*m).LastBlock)}
+	jsonByte, err := json.Marshal(request)
+	if err != nil {
+		fmt.Println("RequestHeaders() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(peer, GET_HEADERS, jsonByte)
+}
+
+// Sends a peer the headers that follow the locator on the current chain.
+func (m *Miner) ProvideHeaders(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var request HeadersRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		m.Print(fmt.Sprintf("Invalid headers request from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed headers request")
+		return
+	}
+	headers := HeadersAfter((*m).Blocks, (*m).LastBlock, request.Locator, MAX_HEADERS_BATCH)
+	jsonByte, err := json.Marshal(headers)
+	if err != nil {
+		fmt.Println("ProvideHeaders() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, HEADERS, jsonByte)
+}
+
+func (m *Miner) ReceiveHeaders(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var headers []BlockHeader
+	if err := json.Unmarshal(data, &headers); err != nil {
+		m.Print(fmt.Sprintf("Invalid headers from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed headers")
+		return
+	}
+	for i := range headers {
+		if err := (*m).Params.CheckBlock(headers[i].ChainLength, headers[i].GetHash(), headers[i].PrevBlockHash, (*m).Blocks); err != nil {
+			m.Print(fmt.Sprintf("Rejected headers from %v: %v", from, err))
+			m.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
+			return
+		}
+	}
+	more, err := (*m).Sync.AddHeaders(from, headers, (*m).Blocks, (*m).Engine)
+	if err == ErrNotSyncPeer {
+		return
+	}
+	if err != nil {
+		m.Print(fmt.Sprintf("Rejected headers from %v: %v", from, err))
+		m.Penalize(from, PENALTY_INVALID_HEADERS, err.Error())
+		return
+	}
+	if (*m).Params.AssumeValid != "" {
+		(*m).Sync.AssumeValid((*m).Params.AssumeValid)
+	}
+	m.Print(fmt.Sprintf("Received %d headers from %v", len(headers), from[0:10]))
+	if more {
+		m.RequestHeaders(from)
+	} else {
+		m.RequestBlocks()
+	}
+}
+
+// Asks peers for the next blocks to download during a sync.
+func (m *Miner) RequestBlocks() {
+	for peer, blockIds := range (*m).Sync.NextDownloads((*m).Blocks) {
+		jsonByte, err := json.Marshal(blockIds)
+		if err != nil {
+			fmt.Println("RequestBlocks() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Send(peer, GET_BLOCKS, jsonByte)
+	}
+}
+
+// Sends a peer each of the requested blocks that is known.
+func (m *Miner) ProvideBlocks(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var blockIds []string
+	if err := json.Unmarshal(data, &blockIds); err != nil {
+		m.Print(fmt.Sprintf("Invalid blocks request from %v", from))
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed blocks request")
+		return
+	}
+	for _, blockId := range blockIds {
+		if block, ok := (*m).Blocks[blockId]; ok {
+			(*m).Messenger.Send(from, PROOF_FOUND, BlockToBytes(block))
+		}
+	}
 }
 
 // Takes an object representing a request for a missing block
-func (m *Miner) ProvideMissingBlock(data []byte) {
+func (m *Miner) ProvideMissingBlock(from string, data []byte) {
 	(*m).mu.Lock()
 	defer (*m).mu.Unlock()
 
 	var msg Message
 	err := json.Unmarshal(data, &msg)
 	if err != nil {
-		fmt.Println("ProvideMissingBlock() unmarshal Panic:")
-		panic(err)
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed missing block request")
+		return
 	}
 	if val, received := (*m).Blocks[msg.PrevBlockHash]; received {
 		m.Print(fmt.Sprintf("Providing missing block %v", val.GetHashStr()))
@@ -366,7 +1251,7 @@ func (m *Miner) ProvideMissingBlock(data []byte) {
 			fmt.Println("ProvideMissingBlock() Marshal Panic:")
 			panic(err)
 		}
-		(*m).Net.SendMessage(msg.Address, PROOF_FOUND, data)
+		(*m).Messenger.Send(from, PROOF_FOUND, data)
 	}
 }
 
@@ -380,7 +1265,10 @@ func (m *Miner) ResendPendingTransactions() {
 			fmt.Println("ResendPendingTransactions() Marshal Panic:")
 			panic(err)
 		}
-		(*m).Net.Broadcast(POST_TRANSACTION, jsonByte)
+		for _, peer := range (*m).Net.Peers((*m).Address) {
+			(*m).Inventory.MarkKnown(peer, tx.Id())
+			(*m).Messenger.Send(peer, POST_TRANSACTION, jsonByte)
+		}
 	}
 }
 
@@ -389,18 +1277,208 @@ func (m *Miner) ResendPendingTransactions() {
 func (m *Miner) SetLastConfirmed() {
 	block := (*m).LastBlock
 	confirmedBlockHeight := uint32(0)
-	if (*block).ChainLength > CONFIRMED_DEPTH {
-		confirmedBlockHeight = (*block).ChainLength - CONFIRMED_DEPTH
+	if (*block).ChainLength > (*m).ConfirmedDepth {
+		confirmedBlockHeight = (*block).ChainLength - (*m).ConfirmedDepth
 	}
 	for (*block).ChainLength > confirmedBlockHeight {
 		block = (*m).Blocks[block.PrevBlockHash]
 	}
+	// A final checkpoint is confirmed even if it is not that deep yet.
+	if (*m).Finality != nil {
+		checkpointId, _ := (*m).Finality.Finalized()
+		if checkpoint, ok := (*m).Blocks[checkpointId]; ok && checkpoint.ChainLength > (*block).ChainLength && m.OnFinalChain((*m).LastBlock) {
+			block = checkpoint
+		}
+	}
 	(*m).LastConfirmedBlock = block
-	for id, tx := range (*m).PendingOutgoingTransactions {
-		if (*m).LastConfirmedBlock.Contains(tx) {
-			delete((*m).PendingOutgoingTransactions, id)
+	// The confirmed chain may have grown by several blocks at once, so all
+	// of it is checked, until no pending transactions are left.
+	for ; block != nil; block = (*m).Blocks[block.PrevBlockHash] {
+		if len((*m).PendingOutgoingTransactions) == 0 && len((*m).PendingReceivedTransactions) == 0 {
+			break
+		}
+		for _, v := range block.Transactions {
+			delete((*m).PendingOutgoingTransactions, v.Id)
+			delete((*m).PendingReceivedTransactions, v.Id)
+		}
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+}
+
+/**
+ * Turns on checkpoint finality, with the registered validators that vote
+ * on checkpoints.  If the miner is one of them, it votes as its chain grows.
+ */
+func (m *Miner) EnableFinality(validators []string) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	(*m).Finality = NewFinalityGadget(validators)
+}
+
+// Votes for the checkpoint of the current chain, unless the miner has already voted in its epoch.
+func (m *Miner) VoteCheckpoint() {
+	if (*m).Finality == nil || !(*m).Finality.IsValidator((*m).Address) {
+		return
+	}
+	height := CheckpointHeight((*m).LastBlock)
+	if height == 0 || !(*m).Finality.StartVote(height) {
+		return
+	}
+	checkpoint := (*m).LastBlock
+	for checkpoint.ChainLength > height {
+		checkpoint = (*m).Blocks[checkpoint.PrevBlockHash]
+	}
+	vote := NewCheckpointVote(checkpoint, (*m).PrivKey)
+	m.Print(fmt.Sprintf("voting for checkpoint %v at height %d", vote.Checkpoint, height))
+	m.addCheckpointVote((*m).Address, vote)
+}
+
+func (m *Miner) ReceiveCheckpointVote(from string, data []byte) {
+	var vote CheckpointVote
+	if err := json.Unmarshal(data, &vote); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed checkpoint vote")
+		return
+	}
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	if (*m).Finality == nil {
+		return
+	}
+	m.addCheckpointVote(from, &vote)
+}
+
+// Replies to a peer with the votes that made the latest checkpoint final.
+func (m *Miner) ProvideCheckpoint(from string, data []byte) {
+	if (*m).Finality == nil {
+		return
+	}
+	certificate := (*m).Finality.FinalCertificate()
+	if len(certificate) == 0 {
+		return
+	}
+	jsonByte, err := json.Marshal(certificate)
+	if err != nil {
+		fmt.Println("ProvideCheckpoint() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, CHECKPOINT, jsonByte)
+}
+
+func (m *Miner) ReceiveCheckpoint(from string, data []byte) {
+	var certificate []CheckpointVote
+	if err := json.Unmarshal(data, &certificate); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed checkpoint")
+		return
+	}
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	if (*m).Finality == nil {
+		return
+	}
+	for i := range certificate {
+		m.addCheckpointVote(from, &certificate[i])
+	}
+}
+
+// Records a checkpoint vote, relaying it to peers if it is new.
+func (m *Miner) addCheckpointVote(from string, vote *CheckpointVote) {
+	added, finalized, err := (*m).Finality.AddVote(vote, m.descendsFrom)
+	if err == ErrEquivocation {
+		m.Print(fmt.Sprintf("Validator %v voted for two checkpoints at height %d", vote.Validator, vote.Height))
+		return
+	} else if err != nil {
+		m.Penalize(from, PENALTY_INVALID_VOTE, err.Error())
+		return
+	}
+	if added {
+		jsonByte, err := json.Marshal(vote)
+		if err != nil {
+			fmt.Println("addCheckpointVote() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Broadcast(CHECKPOINT_VOTE, jsonByte)
+	}
+	if finalized {
+		m.Print(fmt.Sprintf("checkpoint %v at height %d is final", vote.Checkpoint, vote.Height))
+		m.ApplyFinality()
+	} else if added {
+		// Held checkpoints may only be missing their blocks.
+		for _, checkpointId := range (*m).Finality.Held() {
+			if _, ok := (*m).Blocks[checkpointId]; !ok && (*m).PendingBlocks.ShouldRequest(checkpointId) {
+				m.RequestMissingBlock(checkpointId)
+			}
+		}
+	}
+}
+
+// Determines whether the checkpoint is a known block with the ancestor at the ancestor's height.
+func (m *Miner) descendsFrom(checkpoint string, ancestor string, ancestorHeight uint32) bool {
+	block, ok := (*m).Blocks[checkpoint]
+	if !ok {
+		return false
+	}
+	for block.ChainLength > ancestorHeight {
+		block = (*m).Blocks[block.PrevBlockHash]
+		if block == nil {
+			return false
+		}
+	}
+	return block.ChainLength == ancestorHeight && block.GetHash() == ancestor
+}
+
+/**
+ * Moves the miner onto the chain of the final checkpoint, if it is not on
+ * it already, and confirms the checkpoint.  A checkpoint that has not been
+ * received yet is requested.
+ */
+func (m *Miner) ApplyFinality() {
+	checkpointId, _ := (*m).Finality.Finalized()
+	if checkpointId == "" {
+		return
+	}
+	checkpoint, ok := (*m).Blocks[checkpointId]
+	if !ok {
+		if (*m).PendingBlocks.ShouldRequest(checkpointId) {
+			m.RequestMissingBlock(checkpointId)
+		}
+		return
+	}
+	if m.OnFinalChain((*m).LastBlock) {
+		m.SetLastConfirmed()
+		return
+	}
+	best := checkpoint
+	for _, block := range (*m).Blocks {
+		if (*m).Engine.Weight(block).Cmp((*m).Engine.Weight(best)) > 0 && m.OnFinalChain(block) {
+			best = block
+		}
+	}
+	m.Print(fmt.Sprintf("Switching to the chain of final checkpoint %v", checkpointId))
+	m.SetLastBlock(best)
+	if (*m).CurrentBlock != nil {
+		txSet := m.SyncTransaction((*m).LastBlock)
+		m.StartNewSearch(txSet)
+	}
+}
+
+// Determines whether the chain ending at the block includes the final checkpoint, if there is one.
+func (m *Miner) OnFinalChain(block *Block) bool {
+	if (*m).Finality == nil {
+		return true
+	}
+	checkpointId, height := (*m).Finality.Finalized()
+	if checkpointId == "" {
+		return true
+	}
+	for block.ChainLength > height {
+		block = (*m).Blocks[block.PrevBlockHash]
+		if block == nil {
+			return false
 		}
 	}
+	return block.ChainLength == height && block.GetHash() == checkpointId
 }
 
 // Utility method that displays all confirmed balances for all clients
@@ -412,6 +1490,18 @@ func (m *Miner) ShowAllBalances() {
 		fmt.Printf("	%v", balance)
 		fmt.Println("")
 	}
+	for _, reward := range (*m).LastConfirmedBlock.ImmatureRewards {
+		fmt.Printf("	%v	%v (immature until %d)\n", reward.Id, reward.Amount, reward.Height+COINBASE_MATURITY)
+	}
+}
+
+// Print out the blocks that are waiting on a missing parent block.
+func (m *Miner) ShowOrphans() {
+	fmt.Println("ORPHANS:")
+	for _, orphan := range (*m).PendingBlocks.Contents() {
+		fmt.Printf("%v	height %d	parent %v	from %v	at %v\n", orphan.Id, orphan.ChainLength,
+			orphan.PrevBlockHash, orphan.Peer, orphan.Received.Format(time.RFC3339))
+	}
 }
 
 // Print out the blocks in the blockchain from the current head to the genesis block.
@@ -442,3 +1532,127 @@ func (m *Miner) GetAddress() string {
 func (m *Miner) GetEmitter() *emission.Emitter {
 	return (*m).Emitter
 }
+func (m *Miner) GetInbox() *Inbox {
+	return (*m).Inbox
+}
+
+/**
+ * Rebuilds a block sent in compact form from the transactions this node
+ * already has, asking the peer for any that are missing.  If the block
+ * cannot be rebuilt, the full block is requested instead.
+ */
+func (m *Miner) ReceiveCompactBlock(from string, data []byte) {
+	var compact CompactBlock
+	if err := json.Unmarshal(data, &compact); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed compact block")
+		return
+	}
+	blockId := compact.Header.GetHash()
+	(*m).Inventory.MarkKnown(from, blockId)
+	if err := (*m).Engine.VerifyHeader(&compact.Header); err != nil {
+		m.Penalize(from, PENALTY_INVALID_PROOF, fmt.Sprintf("compact block %v without a valid seal: %v", blockId, err))
+		return
+	}
+
+	(*m).mu.Lock()
+	_, received := (*m).Blocks[blockId]
+	known := m.knownTransactions()
+	(*m).mu.Unlock()
+	if received {
+		return
+	}
+
+	block, missing, err := (*m).CompactBlocks.Reconstruct(from, &compact, known)
+	if err != nil {
+		m.Print(fmt.Sprintf("Could not rebuild compact block %v: %v", blockId, err))
+		m.requestFullBlock(from, blockId)
+		return
+	}
+	if block == nil {
+		jsonByte, err := json.Marshal(BlockTxnRequest{BlockId: blockId, Indexes: missing})
+		if err != nil {
+			fmt.Println("ReceiveCompactBlock() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Send(from, GETBLOCKTXN, jsonByte)
+		return
+	}
+	m.ReceiveBlock(from, *block)
+}
+
+// Sends the transactions of a block that a peer could not find in its mempool.
+func (m *Miner) ProvideBlockTxn(from string, data []byte) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	var req BlockTxnRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block transactions request")
+		return
+	}
+	block, ok := (*m).Blocks[req.BlockId]
+	if !ok {
+		jsonByte, err := json.Marshal([]InvItem{{Type: INV_BLOCK, Id: req.BlockId}})
+		if err != nil {
+			fmt.Println("ProvideBlockTxn() Marshal Panic:")
+			panic(err)
+		}
+		(*m).Messenger.Send(from, NOTFOUND, jsonByte)
+		return
+	}
+	txn := BlockTxn{BlockId: req.BlockId, Transactions: make([]Transaction, 0, len(req.Indexes))}
+	for _, index := range req.Indexes {
+		if index < 0 || index >= len((*block).Transactions) {
+			m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "block transaction index out of range")
+			return
+		}
+		txn.Transactions = append(txn.Transactions, (*block).Transactions[index].Tx)
+	}
+	jsonByte, err := json.Marshal(txn)
+	if err != nil {
+		fmt.Println("ProvideBlockTxn() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(from, BLOCKTXN, jsonByte)
+}
+
+// Completes a compact block with the missing transactions sent by the peer.
+func (m *Miner) ReceiveBlockTxn(from string, data []byte) {
+	var txn BlockTxn
+	if err := json.Unmarshal(data, &txn); err != nil {
+		m.Penalize(from, PENALTY_MALFORMED_MESSAGE, "malformed block transactions")
+		return
+	}
+	if !(*m).CompactBlocks.Waiting(txn.BlockId) {
+		return
+	}
+	block, err := (*m).CompactBlocks.Fill(from, txn)
+	if err != nil {
+		m.Print(fmt.Sprintf("Could not complete compact block %v: %v", txn.BlockId, err))
+		m.requestFullBlock(from, txn.BlockId)
+		return
+	}
+	m.ReceiveBlock(from, *block)
+}
+
+func (m *Miner) requestFullBlock(peer string, blockId string) {
+	jsonByte, err := json.Marshal([]InvItem{{Type: INV_BLOCK, Id: blockId}})
+	if err != nil {
+		fmt.Println("requestFullBlock() Marshal Panic:")
+		panic(err)
+	}
+	(*m).Messenger.Send(peer, GETDATA, jsonByte)
+}
+
+// Transactions that blocks sent in compact form may refer to.
+func (m *Miner) knownTransactions() []*Transaction {
+	known := (*m).Transactions.ToArray()
+	for _, tx := range (*m).PendingOutgoingTransactions {
+		known = append(known, tx)
+	}
+	if (*m).CurrentBlock != nil {
+		for i := range (*m).CurrentBlock.Transactions {
+			known = append(known, &(*m).CurrentBlock.Transactions[i].Tx)
+		}
+	}
+	return known
+}
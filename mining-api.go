@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Templates handed out to external workers that are still accepted
+const MAX_BLOCK_TEMPLATES int = 16
+
+// How long a worker waits before asking again when the node cannot be reached
+const WORKER_RETRY time.Duration = time.Second
+
+/**
+ * The work handed to an external worker: the header of the block being
+ * mined, which only needs a Proof making its hash lower than the target.
+ * Workers that run out of proofs change the ExtraNonce of the header and
+ * start over, submitting the extra nonce along with the proof.
+ */
+type BlockTemplate struct {
+	TemplateId string
+	Header     BlockHeader
+}
+
+type SubmitBlockRequest struct {
+	TemplateId string
+	ExtraNonce uint32
+	Proof      uint32
+}
+
+type SubmitBlockResult struct {
+	Accepted bool
+	BlockId  string
+	Error    string
+}
+
+/**
+ * Hands out the header of the block the miner is working on.  The block
+ * is kept, so that a proof submitted for it later can be checked even if
+ * the miner has added transactions since.
+ */
+func (m *Miner) GetBlockTemplate() BlockTemplate {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+
+	header := (*m).CurrentBlock.Header()
+	header.Proof = 0
+	header.ExtraNonce = 0
+	templateId := header.GetHash()
+	if _, ok := (*m).templates[templateId]; !ok {
+		if len((*m).templateOrder) >= MAX_BLOCK_TEMPLATES {
+			delete((*m).templates, (*m).templateOrder[0])
+			(*m).templateOrder = (*m).templateOrder[1:]
+		}
+		block := *(*m).CurrentBlock
+		block.Transactions = append([]TransactionType{}, (*m).CurrentBlock.Transactions...)
+		(*m).templates[templateId] = &block
+		(*m).templateOrder = append((*m).templateOrder, templateId)
+	}
+	return BlockTemplate{TemplateId: templateId, Header: header}
+}
+
+// The header of a template handed out earlier, with its proof unset.
+func (m *Miner) TemplateHeader(templateId string) (BlockHeader, bool) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+	template, ok := (*m).templates[templateId]
+	if !ok {
+		return BlockHeader{}, false
+	}
+	header := template.Header()
+	header.Proof = 0
+	header.ExtraNonce = 0
+	return header, true
+}
+
+/**
+ * Accepts a proof found by an external worker for a template.  The block
+ * is announced like any block the miner found itself, as long as it still
+ * extends the chain the miner is working on.
+ */
+func (m *Miner) SubmitBlock(templateId string, extraNonce uint32, proof uint32) (string, error) {
+	(*m).mu.Lock()
+	defer (*m).mu.Unlock()
+
+	template, ok := (*m).templates[templateId]
+	if !ok {
+		return "", errors.New("unknown or expired template")
+	}
+	block := *template
+	block.ExtraNonce = extraNonce
+	block.Proof = proof
+	if !block.hasValidProof() {
+		return "", errors.New("proof does not meet the target")
+	}
+	if block.PrevBlockHash != (*m).CurrentBlock.PrevBlockHash {
+		return "", errors.New("stale template")
+	}
+
+	m.Print(fmt.Sprintf("external worker found proof for block %d: %d", block.ChainLength, proof))
+	// Stop our own search first, so it cannot seal over the worker's block.
+	if (*m).cancelSearch != nil {
+		(*m).cancelSearch()
+	}
+	(*m).CurrentBlock = &block
+	// Stored before it is announced, so that peers asking for it are given it.
+	m.receiveBlock((*m).Address, block)
+	return block.GetHash(), nil
+}
+
+/**
+ * Serves the miner's block templates over HTTP.  Workers GET /template
+ * for work and POST a SubmitBlockRequest to /submit with the proof.
+ */
+type MiningServer struct {
+	Miner  *Miner
+	server *http.Server
+}
+
+func NewMiningServer(m *Miner) *MiningServer {
+	var ms MiningServer
+	ms.Miner = m
+	mux := http.NewServeMux()
+	mux.HandleFunc("/template", ms.handleTemplate)
+	mux.HandleFunc("/submit", ms.handleSubmit)
+	ms.server = &http.Server{Handler: mux}
+	return &ms
+}
+
+// Serves requests on the address until the server is closed.
+func (ms *MiningServer) ListenAndServe(addr string) error {
+	(*ms).server.Addr = addr
+	err := (*ms).server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (ms *MiningServer) Close() error {
+	return (*ms).server.Close()
+}
+
+func (ms *MiningServer) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	template := (*ms).Miner.GetBlockTemplate()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&template)
+}
+
+func (ms *MiningServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req SubmitBlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed submission", http.StatusBadRequest)
+		return
+	}
+	var result SubmitBlockResult
+	blockId, err := (*ms).Miner.SubmitBlock(req.TemplateId, req.ExtraNonce, req.Proof)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Accepted = true
+		result.BlockId = blockId
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
+
+func FetchBlockTemplate(url string) (*BlockTemplate, error) {
+	resp, err := http.Get(url + "/template")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("template request failed: %v", resp.Status)
+	}
+	var template BlockTemplate
+	if err := json.NewDecoder(resp.Body).Decode(&template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func SubmitProof(url string, templateId string, extraNonce uint32, proof uint32) (*SubmitBlockResult, error) {
+	jsonByte, err := json.Marshal(SubmitBlockRequest{TemplateId: templateId, ExtraNonce: extraNonce, Proof: proof})
+	if err != nil {
+		fmt.Println("SubmitProof() Marshal Panic:")
+		panic(err)
+	}
+	resp, err := http.Post(url+"/submit", "application/json", bytes.NewReader(jsonByte))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result SubmitBlockResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+/**
+ * Mines for the node at url until the context is cancelled, asking for a
+ * new template after every batch of rounds so that new blocks and
+ * transactions are picked up.
+ */
+func RunMiningWorker(ctx context.Context, url string, workers int, rounds uint32) {
+	var cursor ProofCursor
+	for ctx.Err() == nil {
+		template, err := FetchBlockTemplate(url)
+		if err != nil {
+			fmt.Printf("Worker could not get a template: %v\n", err)
+			time.Sleep(WORKER_RETRY)
+			continue
+		}
+		cursor.Reset(template.TemplateId, 0, uint64(math.MaxUint32)+1)
+		header := template.Header
+		header.ExtraNonce = cursor.ExtraNonce
+		start, batch := cursor.Batch(rounds)
+		proof, found, _ := SearchProof(ctx, header, start, batch, workers)
+		cursor.Advance(uint64(batch))
+		if !found {
+			continue
+		}
+		result, err := SubmitProof(url, template.TemplateId, header.ExtraNonce, proof)
+		if err != nil {
+			fmt.Printf("Worker could not submit a proof: %v\n", err)
+		} else if !result.Accepted {
+			fmt.Printf("Proof %d rejected: %v\n", proof, result.Error)
+		} else {
+			fmt.Printf("Proof %d accepted for block %v\n", proof, result.BlockId)
+		}
+		cursor = ProofCursor{}
+	}
+}
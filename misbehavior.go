@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A peer whose misbehavior score reaches BAN_THRESHOLD is banned.
+const BAN_THRESHOLD int = 100
+const DEFAULT_BAN_DURATION time.Duration = 10 * time.Minute
+
+// Penalties for the ways a peer can misbehave
+const PENALTY_MALFORMED_MESSAGE int = 20
+const PENALTY_INVALID_ENVELOPE int = 50
+const PENALTY_INVALID_PROOF int = 100
+const PENALTY_INVALID_BLOCK int = 100
+const PENALTY_INVALID_SIGNATURE int = 100
+const PENALTY_INVALID_HEADERS int = 50
+const PENALTY_INVALID_VOTE int = 50
+
+type BanEntry struct {
+	Address string
+	Reason  string
+	Until   time.Time
+}
+
+/**
+ * Keeps a misbehavior score for each peer, keyed by the sender address.
+ * Once a peer's score reaches the threshold, it is banned for the ban
+ * duration and its score is reset.
+ */
+type MisbehaviorTracker struct {
+	Threshold   int
+	BanDuration time.Duration
+	scores      map[string]int
+	bans        map[string]*BanEntry
+	mu          sync.Mutex
+}
+
+func NewMisbehaviorTracker() *MisbehaviorTracker {
+	var t MisbehaviorTracker
+	t.Threshold = BAN_THRESHOLD
+	t.BanDuration = DEFAULT_BAN_DURATION
+	t.scores = make(map[string]int)
+	t.bans = make(map[string]*BanEntry)
+	return &t
+}
+
+// Adds to the score of a peer, returning true if the peer is now banned.
+func (t *MisbehaviorTracker) Misbehaving(peer string, penalty int, reason string) bool {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+
+	(*t).scores[peer] += penalty
+	if (*t).scores[peer] < (*t).Threshold {
+		return false
+	}
+	delete((*t).scores, peer)
+	(*t).bans[peer] = &BanEntry{Address: peer, Reason: reason, Until: time.Now().Add((*t).BanDuration)}
+	return true
+}
+
+func (t *MisbehaviorTracker) Score(peer string) int {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+	return (*t).scores[peer]
+}
+
+func (t *MisbehaviorTracker) Ban(peer string, duration time.Duration, reason string) {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+	(*t).bans[peer] = &BanEntry{Address: peer, Reason: reason, Until: time.Now().Add(duration)}
+}
+
+func (t *MisbehaviorTracker) Unban(peer string) {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+	delete((*t).bans, peer)
+}
+
+// Determines whether a peer is banned, lifting bans that have expired.
+func (t *MisbehaviorTracker) IsBanned(peer string) bool {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+	ban, ok := (*t).bans[peer]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete((*t).bans, peer)
+		return false
+	}
+	return true
+}
+
+// The peers that are currently banned, soonest to be unbanned first.
+func (t *MisbehaviorTracker) BanList() []BanEntry {
+	(*t).mu.Lock()
+	defer (*t).mu.Unlock()
+	now := time.Now()
+	list := make([]BanEntry, 0, len((*t).bans))
+	for peer, ban := range (*t).bans {
+		if now.After(ban.Until) {
+			delete((*t).bans, peer)
+			continue
+		}
+		list = append(list, *ban)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Until.Before(list[j].Until)
+	})
+	return list
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits on blocks whose parent is not known yet
+const MAX_ORPHAN_BLOCKS int = 200
+const MAX_ORPHANS_PER_PEER int = 50
+const ORPHAN_EXPIRY time.Duration = 2 * time.Minute
+
+// Missing blocks are requested again after MISSING_BLOCK_RETRY, doubling
+// the wait after every attempt, until MISSING_BLOCK_MAX_ATTEMPTS is reached.
+const MISSING_BLOCK_RETRY time.Duration = 500 * time.Millisecond
+const MISSING_BLOCK_MAX_ATTEMPTS int = 5
+
+// A block that could not be connected to the chain, with the peer that sent it.
+type OrphanBlock struct {
+	Block    *Block
+	Peer     string
+	Received time.Time
+}
+
+// Debugging view of an orphan block.
+type OrphanInfo struct {
+	Id            string
+	PrevBlockHash string
+	ChainLength   uint32
+	Peer          string
+	Received      time.Time
+}
+
+type missingBlockRequest struct {
+	LastSent time.Time
+	Attempts int
+}
+
+/**
+ * Holds blocks whose parent is unknown until the parent arrives.  The pool
+ * is bounded both overall and per peer, orphans expire after a while, and
+ * only one outstanding request is kept for each missing parent.
+ */
+type OrphanPool struct {
+	MaxSize    int
+	MaxPerPeer int
+	Expiry     time.Duration
+	orphans    map[string]*OrphanBlock
+	byParent   map[string]map[string]bool
+	requests   map[string]*missingBlockRequest
+	mu         sync.Mutex
+}
+
+func NewOrphanPool() *OrphanPool {
+	var p OrphanPool
+	p.MaxSize = MAX_ORPHAN_BLOCKS
+	p.MaxPerPeer = MAX_ORPHANS_PER_PEER
+	p.Expiry = ORPHAN_EXPIRY
+	p.orphans = make(map[string]*OrphanBlock)
+	p.byParent = make(map[string]map[string]bool)
+	p.requests = make(map[string]*missingBlockRequest)
+	return &p
+}
+
+/**
+ * Stores an orphan block.  Returns false if the block is already stored or
+ * if the peer has too many orphans in the pool.  If the pool is full, the
+ * oldest orphan is evicted to make room.
+ */
+func (p *OrphanPool) Add(block *Block, peer string) bool {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	blockId := block.GetHash()
+	if _, ok := (*p).orphans[blockId]; ok {
+		return false
+	}
+	if p.peerCount(peer) >= (*p).MaxPerPeer {
+		return false
+	}
+	if len((*p).orphans) >= (*p).MaxSize {
+		p.evictOldest()
+	}
+
+	(*p).orphans[blockId] = &OrphanBlock{Block: block, Peer: peer, Received: time.Now()}
+	children, ok := (*p).byParent[block.PrevBlockHash]
+	if !ok {
+		children = make(map[string]bool)
+		(*p).byParent[block.PrevBlockHash] = children
+	}
+	children[blockId] = true
+	return true
+}
+
+/**
+ * Determines whether a request for the missing block should be sent now.
+ * A request is only sent if none is outstanding, or if the previous one
+ * has timed out, in which case the wait before the next retry doubles.
+ */
+func (p *OrphanPool) ShouldRequest(parentHash string) bool {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	now := time.Now()
+	req, ok := (*p).requests[parentHash]
+	if !ok {
+		(*p).requests[parentHash] = &missingBlockRequest{LastSent: now, Attempts: 1}
+		return true
+	}
+	if req.Attempts >= MISSING_BLOCK_MAX_ATTEMPTS {
+		return false
+	}
+	if now.Sub(req.LastSent) < MISSING_BLOCK_RETRY<<(req.Attempts-1) {
+		return false
+	}
+	req.LastSent = now
+	req.Attempts++
+	return true
+}
+
+// Missing blocks that are still wanted and whose request has timed out.
+func (p *OrphanPool) DueRequests() []string {
+	(*p).mu.Lock()
+	parents := make([]string, 0)
+	for parentHash := range (*p).requests {
+		if _, ok := (*p).byParent[parentHash]; ok {
+			parents = append(parents, parentHash)
+		}
+	}
+	(*p).mu.Unlock()
+
+	due := make([]string, 0)
+	for _, parentHash := range parents {
+		if p.ShouldRequest(parentHash) {
+			due = append(due, parentHash)
+		}
+	}
+	return due
+}
+
+/**
+ * Removes and returns the orphans waiting on a block that has now been
+ * accepted, clearing any outstanding request for it.
+ */
+func (p *OrphanPool) RemoveChildren(parentHash string) []*OrphanBlock {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	delete((*p).requests, parentHash)
+	unstuck := make([]*OrphanBlock, 0)
+	for blockId := range (*p).byParent[parentHash] {
+		unstuck = append(unstuck, (*p).orphans[blockId])
+		delete((*p).orphans, blockId)
+	}
+	delete((*p).byParent, parentHash)
+	return unstuck
+}
+
+// Drops orphans that have been waiting longer than the expiry time.
+func (p *OrphanPool) Expire() int {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	expired := 0
+	now := time.Now()
+	for blockId, orphan := range (*p).orphans {
+		if now.Sub(orphan.Received) > (*p).Expiry {
+			p.remove(blockId)
+			expired++
+		}
+	}
+	return expired
+}
+
+func (p *OrphanPool) Contains(blockId string) bool {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	_, ok := (*p).orphans[blockId]
+	return ok
+}
+
+func (p *OrphanPool) Size() int {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	return len((*p).orphans)
+}
+
+// Lists the orphans in the pool, oldest first.
+func (p *OrphanPool) Contents() []OrphanInfo {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	contents := make([]OrphanInfo, 0, len((*p).orphans))
+	for blockId, orphan := range (*p).orphans {
+		contents = append(contents, OrphanInfo{
+			Id:            blockId,
+			PrevBlockHash: orphan.Block.PrevBlockHash,
+			ChainLength:   orphan.Block.ChainLength,
+			Peer:          orphan.Peer,
+			Received:      orphan.Received,
+		})
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		return contents[i].Received.Before(contents[j].Received)
+	})
+	return contents
+}
+
+func (p *OrphanPool) peerCount(peer string) int {
+	count := 0
+	for _, orphan := range (*p).orphans {
+		if orphan.Peer == peer {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *OrphanPool) evictOldest() {
+	oldestId := ""
+	var oldest time.Time
+	for blockId, orphan := range (*p).orphans {
+		if oldestId == "" || orphan.Received.Before(oldest) {
+			oldestId = blockId
+			oldest = orphan.Received
+		}
+	}
+	if oldestId != "" {
+		p.remove(oldestId)
+	}
+}
+
+func (p *OrphanPool) remove(blockId string) {
+	orphan := (*p).orphans[blockId]
+	delete((*p).orphans, blockId)
+	children := (*p).byParent[orphan.Block.PrevBlockHash]
+	delete(children, blockId)
+	if len(children) == 0 {
+		delete((*p).byParent, orphan.Block.PrevBlockHash)
+		delete((*p).requests, orphan.Block.PrevBlockHash)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"spartangold/utils"
+	"sync"
+	"time"
+)
+
+// Payout schemes for pool workers
+const PAYOUT_PPLNS string = "PPLNS"
+const PAYOUT_PPS string = "PPS"
+
+// Shares need this many fewer leading zeroes than blocks, so a block is
+// expected for every 2^POOL_SHARE_BITS shares.
+const POOL_SHARE_BITS uint32 = 6
+
+// For PPLNS, block rewards are split over the last POOL_PPLNS_WINDOW shares.
+const POOL_PPLNS_WINDOW int = 128
+
+// Each worker searches its own slice of the proofs, so workers never find
+// the same shares.  This limits the number of workers.
+const POOL_MAX_WORKERS int = 256
+
+// The pool keeps this percentage of rewards, and only pays workers once
+// they are owed at least POOL_MIN_PAYOUT gold.
+const POOL_FEE_PERCENT float64 = 2
+const POOL_MIN_PAYOUT uint32 = 5
+
+/**
+ * Work for a pool worker: a block template along with the easier share
+ * target, and the proofs in [ProofStart, ProofEnd) the worker should try.
+ * The end of the last slice is 2^32, which does not fit in a uint32.
+ */
+type PoolWork struct {
+	TemplateId  string
+	Header      BlockHeader
+	ShareTarget big.Int
+	ProofStart  uint32
+	ProofEnd    uint64
+}
+
+type ShareSubmission struct {
+	Worker     string
+	TemplateId string
+	ExtraNonce uint32
+	Proof      uint32
+}
+
+type ShareResult struct {
+	Accepted bool
+	Block    bool
+	BlockId  string
+	Error    string
+}
+
+// What the pool owes a worker, and has paid it so far.
+type WorkerBalance struct {
+	Worker string
+	Shares int
+	Owed   float64
+	Paid   uint32
+}
+
+type poolShare struct {
+	Worker string
+	Time   time.Time
+}
+
+/**
+ * A block found for the pool.  Window holds the share counts in the PPLNS
+ * window when it was found, if it was found by a worker, and Reward is the
+ * block's reward while it is on the main chain.
+ */
+type poolBlock struct {
+	Height    uint32
+	Window    map[string]int
+	Reward    uint32
+	Connected bool
+}
+
+/**
+ * A pool running on top of a miner.  Workers are handed the miner's block
+ * templates with an easier share target, and get credit for every share
+ * they find.  Shares that also meet the block target are submitted to the
+ * network through the miner.  Rewards earned by the pool's address are
+ * paid to workers with regular transactions, either splitting each block
+ * over the last shares (PPLNS) or at a fixed rate per share (PPS).
+ */
+type MiningPool struct {
+	Miner       *Miner
+	Mode        string
+	ShareTarget *big.Int
+	shares      []poolShare
+	seen        map[string]bool
+	slices      map[string]int
+	shareCounts map[string]int
+	owed        map[string]float64
+	paid        map[string]uint32
+	// Blocks found for the pool whose rewards have not matured yet, by block ID.
+	foundBlocks map[string]*poolBlock
+	server      *http.Server
+	mu          sync.Mutex
+	// Held for a whole payout, so blocks connected together are paid one at a time.
+	payMu sync.Mutex
+}
+
+func NewMiningPool(m *Miner, mode string) *MiningPool {
+	if mode != PAYOUT_PPLNS && mode != PAYOUT_PPS {
+		panic("NewMiningPool(...): unknown payout mode " + mode)
+	}
+	var p MiningPool
+	p.Miner = m
+	p.Mode = mode
+	p.ShareTarget = utils.CalcTarget(POW_LEADING_ZEROES-POOL_SHARE_BITS, POW_BASE_TARGET_STR)
+	p.shares = make([]poolShare, 0)
+	p.seen = make(map[string]bool)
+	p.slices = make(map[string]int)
+	p.shareCounts = make(map[string]int)
+	p.owed = make(map[string]float64)
+	p.paid = make(map[string]uint32)
+	p.foundBlocks = make(map[string]*poolBlock)
+
+	(*m).Emitter.On(BLOCK_CONNECTED, p.blockConnected)
+	(*m).Emitter.On(BLOCK_DISCONNECTED, p.blockDisconnected)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/work", p.handleWork)
+	mux.HandleFunc("/share", p.handleShare)
+	p.server = &http.Server{Handler: mux}
+	return &p
+}
+
+func (p *MiningPool) GetWork(worker string) (PoolWork, error) {
+	(*p).mu.Lock()
+	slice, ok := (*p).slices[worker]
+	if !ok {
+		if len((*p).slices) >= POOL_MAX_WORKERS {
+			(*p).mu.Unlock()
+			return PoolWork{}, errors.New("pool is full")
+		}
+		slice = len((*p).slices)
+		(*p).slices[worker] = slice
+	}
+	(*p).mu.Unlock()
+
+	start, end := proofSlice(slice)
+	template := (*p).Miner.GetBlockTemplate()
+	return PoolWork{
+		TemplateId:  template.TemplateId,
+		Header:      template.Header,
+		ShareTarget: *(*p).ShareTarget,
+		ProofStart:  uint32(start),
+		ProofEnd:    end,
+	}, nil
+}
+
+// The proofs [start, end) a worker searches, given its slice.
+func proofSlice(slice int) (uint64, uint64) {
+	sliceSize := uint64(1<<32) / uint64(POOL_MAX_WORKERS)
+	return uint64(slice) * sliceSize, uint64(slice+1) * sliceSize
+}
+
+/**
+ * Credits a worker for a share, submitting it as a block if it also meets
+ * the block target.  Shares for unknown templates, outside the worker's
+ * slice of the proofs, below the share target, or submitted before are
+ * rejected.
+ */
+func (p *MiningPool) SubmitShare(sub ShareSubmission) ShareResult {
+	(*p).mu.Lock()
+	slice, ok := (*p).slices[sub.Worker]
+	(*p).mu.Unlock()
+	if !ok {
+		return ShareResult{Error: "unknown worker"}
+	}
+	// Otherwise workers could claim shares found by others.
+	if start, end := proofSlice(slice); uint64(sub.Proof) < start || uint64(sub.Proof) >= end {
+		return ShareResult{Error: "proof outside the worker's slice"}
+	}
+
+	header, ok := (*p).Miner.TemplateHeader(sub.TemplateId)
+	if !ok {
+		return ShareResult{Error: "unknown or expired template"}
+	}
+	header.ExtraNonce = sub.ExtraNonce
+	header.Proof = sub.Proof
+	if !header.meetsTarget((*p).ShareTarget) {
+		return ShareResult{Error: "share does not meet the share target"}
+	}
+
+	(*p).mu.Lock()
+	key := fmt.Sprintf("%s:%d:%d", sub.TemplateId, sub.ExtraNonce, sub.Proof)
+	if (*p).seen[key] {
+		(*p).mu.Unlock()
+		return ShareResult{Error: "duplicate share"}
+	}
+	if len((*p).seen) >= MAX_KNOWN_INVENTORY {
+		(*p).seen = make(map[string]bool)
+	}
+	(*p).seen[key] = true
+	(*p).shareCounts[sub.Worker]++
+	if (*p).Mode == PAYOUT_PPS {
+		(*p).owed[sub.Worker] += p.shareValue()
+	}
+	(*p).shares = append((*p).shares, poolShare{Worker: sub.Worker, Time: time.Now()})
+	if len((*p).shares) > POOL_PPLNS_WINDOW {
+		(*p).shares = (*p).shares[len((*p).shares)-POOL_PPLNS_WINDOW:]
+	}
+	window := p.windowCounts()
+	(*p).mu.Unlock()
+
+	result := ShareResult{Accepted: true}
+	if !header.hasValidProof() {
+		return result
+	}
+	blockId, err := (*p).Miner.SubmitBlock(sub.TemplateId, sub.ExtraNonce, sub.Proof)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	(*p).mu.Lock()
+	(*p).foundBlocks[blockId] = &poolBlock{Height: header.ChainLength, Window: window}
+	(*p).mu.Unlock()
+	result.Block = true
+	result.BlockId = blockId
+	return result
+}
+
+/**
+ * Pays every worker owed at least the minimum payout, as far as the pool's
+ * balance allows, starting with the workers owed the most.
+ */
+func (p *MiningPool) PayOut() {
+	(*p).payMu.Lock()
+	defer (*p).payMu.Unlock()
+
+	available := (*p).Miner.SpendableGold()
+	if available <= DEFAULT_TX_FEE {
+		return
+	}
+	budget := available - DEFAULT_TX_FEE
+
+	(*p).mu.Lock()
+	workers := make([]string, 0, len((*p).owed))
+	for worker := range (*p).owed {
+		workers = append(workers, worker)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return (*p).owed[workers[i]] > (*p).owed[workers[j]]
+	})
+	outputs := make([]Output, 0)
+	for _, worker := range workers {
+		amount := uint32((*p).owed[worker])
+		if amount < POOL_MIN_PAYOUT || amount > budget {
+			continue
+		}
+		outputs = append(outputs, Output{Address: worker, Amount: amount})
+		(*p).owed[worker] -= float64(amount)
+		(*p).paid[worker] += amount
+		budget -= amount
+	}
+	(*p).mu.Unlock()
+
+	if len(outputs) == 0 {
+		return
+	}
+	(*p).Miner.Print(fmt.Sprintf("Paying %d pool workers", len(outputs)))
+	if _, err := (*p).Miner.TryPostTransaction(outputs, DEFAULT_TX_FEE); err != nil {
+		// The gold was spent elsewhere since the balance was read, so the
+		// workers are owed the payout until the next block.
+		(*p).Miner.Print(fmt.Sprintf("Could not pay pool workers: %v", err))
+		(*p).mu.Lock()
+		for _, output := range outputs {
+			(*p).owed[output.Address] += float64(output.Amount)
+			(*p).paid[output.Address] -= output.Amount
+		}
+		(*p).mu.Unlock()
+	}
+}
+
+func (p *MiningPool) Balances() []WorkerBalance {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	balances := make([]WorkerBalance, 0, len((*p).shareCounts))
+	for worker, count := range (*p).shareCounts {
+		balances = append(balances, WorkerBalance{
+			Worker: worker,
+			Shares: count,
+			Owed:   (*p).owed[worker],
+			Paid:   (*p).paid[worker],
+		})
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Worker < balances[j].Worker
+	})
+	return balances
+}
+
+// Serves work on the address until the pool is closed.
+func (p *MiningPool) ListenAndServe(addr string) error {
+	(*p).server.Addr = addr
+	err := (*p).server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (p *MiningPool) Close() error {
+	return (*p).server.Close()
+}
+
+// The expected reward for a single share, after the pool's fee.
+func (p *MiningPool) shareValue() float64 {
+	sharesPerBlock := float64(uint64(1) << POOL_SHARE_BITS)
+	return float64(COINBASE_AMT_ALLOWED) * (100 - POOL_FEE_PERCENT) / 100 / sharesPerBlock
+}
+
+func (p *MiningPool) windowCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, share := range (*p).shares {
+		counts[share.Worker]++
+	}
+	return counts
+}
+
+/**
+ * Keeps track of the pool's blocks on the main chain.  Once the reward of
+ * one of them matures, with PPLNS it is split between the workers in
+ * proportion to their shares in the window when it was found, and either
+ * way, workers are then paid what the pool can afford.  Until then the
+ * block may still be rolled back, and its reward cannot be spent.
+ */
+func (p *MiningPool) blockConnected(data []byte) {
+	block := BytesToBlock(data)
+	if block == nil {
+		return
+	}
+	blockId := block.GetHash()
+
+	(*p).mu.Lock()
+	if (*block).RewardAddr == (*p).Miner.GetAddress() {
+		found, ok := (*p).foundBlocks[blockId]
+		if !ok {
+			// Blocks the miner found itself are not credited to workers.
+			found = &poolBlock{Height: (*block).ChainLength}
+			(*p).foundBlocks[blockId] = found
+		}
+		found.Reward = block.TotalRewards()
+		found.Connected = true
+	}
+	matured := false
+	for id, found := range (*p).foundBlocks {
+		if (*block).ChainLength < found.Height+COINBASE_MATURITY {
+			continue
+		}
+		if found.Connected {
+			matured = true
+			if (*p).Mode == PAYOUT_PPLNS {
+				p.credit(found)
+			}
+		}
+		// Blocks that did not make it onto the main chain by now never will.
+		delete((*p).foundBlocks, id)
+	}
+	(*p).mu.Unlock()
+
+	if matured {
+		p.PayOut()
+	}
+}
+
+// Splits the reward of a block between the workers with shares in its window.
+func (p *MiningPool) credit(found *poolBlock) {
+	total := 0
+	for _, count := range found.Window {
+		total += count
+	}
+	reward := float64(found.Reward) * (100 - POOL_FEE_PERCENT) / 100
+	for worker, count := range found.Window {
+		(*p).owed[worker] += reward * float64(count) / float64(total)
+	}
+}
+
+// A block that is no longer on the main chain will not be credited, unless it is connected again.
+func (p *MiningPool) blockDisconnected(data []byte) {
+	block := BytesToBlock(data)
+	if block == nil {
+		return
+	}
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	if found, ok := (*p).foundBlocks[block.GetHash()]; ok {
+		found.Connected = false
+	}
+}
+
+func (p *MiningPool) handleWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("worker") == "" {
+		http.Error(w, "missing worker", http.StatusBadRequest)
+		return
+	}
+	work, err := p.GetWork(r.URL.Query().Get("worker"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&work)
+}
+
+func (p *MiningPool) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var sub ShareSubmission
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil || sub.Worker == "" {
+		http.Error(w, "malformed share", http.StatusBadRequest)
+		return
+	}
+	result := p.SubmitShare(sub)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&result)
+}
+
+/**
+ * Mines shares for the pool at url until the context is cancelled, to be
+ * paid to the worker address.  New work is fetched after every batch of
+ * rounds, and after every share found.
+ */
+func RunPoolWorker(ctx context.Context, url string, worker string, workers int, rounds uint32) {
+	var cursor ProofCursor
+	for ctx.Err() == nil {
+		work, err := fetchPoolWork(url, worker)
+		if err != nil {
+			fmt.Printf("Pool worker could not get work: %v\n", err)
+			time.Sleep(WORKER_RETRY)
+			continue
+		}
+		cursor.Reset(work.TemplateId, uint64(work.ProofStart), work.ProofEnd)
+		header := work.Header
+		header.ExtraNonce = cursor.ExtraNonce
+		start, batch := cursor.Batch(rounds)
+		proof, found, _ := SearchProofBelow(ctx, header, &work.ShareTarget, start, batch, workers)
+		if !found {
+			cursor.Advance(uint64(batch))
+			continue
+		}
+		// The next search starts right after the proof just found.
+		cursor.Advance(uint64(proof) - uint64(start) + 1)
+		sub := ShareSubmission{Worker: worker, TemplateId: work.TemplateId, ExtraNonce: header.ExtraNonce, Proof: proof}
+		result, err := submitPoolShare(url, sub)
+		if err != nil {
+			fmt.Printf("Pool worker could not submit a share: %v\n", err)
+		} else if !result.Accepted {
+			fmt.Printf("Share %d rejected: %v\n", proof, result.Error)
+		} else if result.Block {
+			fmt.Printf("Share %d was a block: %v\n", proof, result.BlockId)
+		}
+	}
+}
+
+func fetchPoolWork(url string, worker string) (*PoolWork, error) {
+	resp, err := http.Get(url + "/work?worker=" + neturl.QueryEscape(worker))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("work request failed: %v", resp.Status)
+	}
+	var work PoolWork
+	if err := json.NewDecoder(resp.Body).Decode(&work); err != nil {
+		return nil, err
+	}
+	return &work, nil
+}
+
+func submitPoolShare(url string, sub ShareSubmission) (*ShareResult, error) {
+	jsonByte, err := json.Marshal(sub)
+	if err != nil {
+		fmt.Println("submitPoolShare() Marshal Panic:")
+		panic(err)
+	}
+	resp, err := http.Post(url+"/share", "application/json", bytes.NewReader(jsonByte))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result ShareResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
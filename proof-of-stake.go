@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"spartangold/utils"
+	"time"
+)
+
+/**
+ * Proof-of-stake: time is split into slots, and the leaders of a slot are
+ * picked at random in proportion to the gold they have staked.  Leaders
+ * sign their blocks with their RSA key instead of finding a proof.
+ *
+ * Leaders are chosen with a verifiable random function.  A validator signs
+ * the slot and the randomness of the parent block; since RSA signatures are
+ * deterministic, the hash of the signature is a random number that only the
+ * validator can compute, but that anyone can check with the validator's
+ * public key.  The validator leads the slot if the number is below a
+ * threshold proportional to its share of the stake, so a slot may have no
+ * leader, or several competing ones.
+ */
+type PosEngine struct {
+	Genesis      time.Time
+	SlotDuration time.Duration
+}
+
+func NewPosEngine(genesis *Block) *PosEngine {
+	var e PosEngine
+	e.Genesis = (*genesis).Timestamp
+	e.SlotDuration = POS_SLOT_DURATION
+	return &e
+}
+
+// The slot of the current time.
+func (e *PosEngine) CurrentSlot() uint64 {
+	elapsed := time.Since((*e).Genesis)
+	if elapsed < 0 {
+		return 0
+	}
+	return uint64(elapsed / (*e).SlotDuration)
+}
+
+func (e *PosEngine) slotStart(slot uint64) time.Time {
+	return (*e).Genesis.Add(time.Duration(slot) * (*e).SlotDuration)
+}
+
+func (e *PosEngine) Prepare(block *Block, parent *Block) {
+	(*block).Target.SetInt64(0)
+	(*block).Proof = 0
+	(*block).ExtraNonce = 0
+	(*block).Slot = 0
+	(*block).LeaderKey = nil
+	(*block).VrfProof = nil
+	(*block).Signature = nil
+}
+
+/**
+ * Checks whether the miner leads the current slot, and signs the block if
+ * it does.  Each slot is only tried once, so the engine otherwise waits for
+ * the next slot to start.
+ */
+func (e *PosEngine) Seal(ctx context.Context, block *Block, parent *Block, key *rsa.PrivateKey) (bool, uint64) {
+	slot := e.CurrentSlot()
+	if parent == nil || slot <= (*block).Slot || slot <= (*parent).Slot {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(e.slotStart(slot + 1))):
+		}
+		return false, 0
+	}
+	(*block).Slot = slot
+
+	vrfProof := vrfProve(key, vrfInput(parent, slot))
+	if vrfProof == nil {
+		return false, 1
+	}
+	address := utils.CalcAddress(&key.PublicKey)
+	if !isSlotLeader(vrfProof, parent.StakeOf(address), parent.TotalStake()) {
+		return false, 1
+	}
+
+	(*block).RewardAddr = address
+	(*block).LeaderKey = &key.PublicKey
+	(*block).VrfProof = vrfProof
+	(*block).Timestamp = time.Now()
+	(*block).Signature = nil
+	header := block.Header()
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, header.sealHash())
+	if err != nil {
+		return false, 1
+	}
+	(*block).Signature = signature
+	return true, 1
+}
+
+func (e *PosEngine) VerifySeal(block *Block, parent *Block) error {
+	header := block.Header()
+	if err := e.VerifyHeader(&header); err != nil {
+		return err
+	}
+	if parent == nil {
+		return nil
+	}
+	if (*block).Slot <= (*parent).Slot {
+		return errors.New("block is not in a later slot than its parent")
+	}
+	if err := rsa.VerifyPKCS1v15((*block).LeaderKey, crypto.SHA256, vrfInput(parent, (*block).Slot), (*block).VrfProof); err != nil {
+		return errors.New("invalid leader election proof")
+	}
+	// Stake is taken from the parent, so a block's own staking transactions
+	// cannot make its validator the leader.
+	if !isSlotLeader((*block).VrfProof, parent.StakeOf((*block).RewardAddr), parent.TotalStake()) {
+		return errors.New("validator does not lead the slot")
+	}
+	return nil
+}
+
+func (e *PosEngine) VerifyHeader(header *BlockHeader) error {
+	if header.LeaderKey == nil || len(header.Signature) == 0 {
+		return errors.New("block is not signed by a slot leader")
+	}
+	if utils.CalcAddress(header.LeaderKey) != header.RewardAddr {
+		return errors.New("leader key does not match the reward address")
+	}
+	if header.Slot > e.CurrentSlot()+POS_MAX_CLOCK_DRIFT {
+		return errors.New("block is from a future slot")
+	}
+	if err := rsa.VerifyPKCS1v15(header.LeaderKey, crypto.SHA256, header.sealHash(), header.Signature); err != nil {
+		return errors.New("invalid leader signature")
+	}
+	return nil
+}
+
+// Like proof-of-work, the longest chain wins.
+func (e *PosEngine) Weight(block *Block) *big.Int {
+	return new(big.Int).SetUint64(uint64((*block).ChainLength))
+}
+
+// Hash of the header without its signature, which is what the leader signs.
+func (header *BlockHeader) sealHash() []byte {
+	unsigned := *header
+	unsigned.Signature = nil
+	hashed, err := hex.DecodeString(unsigned.GetHash())
+	if err != nil {
+		return nil
+	}
+	return hashed
+}
+
+/**
+ * The message signed to elect the leaders of a slot.  It chains the
+ * randomness of the parent block, rather than the parent's hash, so that
+ * leaders cannot pick transactions to influence who leads next.
+ */
+func vrfInput(parent *Block, slot uint64) []byte {
+	hasher := sha256.New()
+	if len((*parent).VrfProof) > 0 {
+		hasher.Write((*parent).VrfProof)
+	} else {
+		hasher.Write([]byte(parent.GetHash()))
+	}
+	slotBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(slotBytes, slot)
+	hasher.Write(slotBytes)
+	return hasher.Sum(nil)
+}
+
+func vrfProve(key *rsa.PrivateKey, input []byte) []byte {
+	proof, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, input)
+	if err != nil {
+		return nil
+	}
+	return proof
+}
+
+/**
+ * A validator leads a slot if the hash of its proof, read as a fraction of
+ * the largest hash, is below POS_ACTIVE_SLOT_PERCENT percent of its share
+ * of the stake.
+ */
+func isSlotLeader(vrfProof []byte, stake uint32, totalStake uint64) bool {
+	if stake == 0 || totalStake == 0 {
+		return false
+	}
+	output := sha256.Sum256(vrfProof)
+	value := new(big.Int).SetBytes(output[:])
+	value.Mul(value, new(big.Int).SetUint64(totalStake*100))
+
+	threshold := new(big.Int).Lsh(big.NewInt(1), 256)
+	threshold.Mul(threshold, new(big.Int).SetUint64(uint64(stake)*POS_ACTIVE_SLOT_PERCENT))
+	return value.Cmp(threshold) < 0
+}
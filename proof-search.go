@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hashrates are averaged over roughly this much mining time.
+const HASHRATE_WINDOW time.Duration = 5 * time.Second
+
+/**
+ * Searches for a proof for the header in [start, start+rounds), splitting
+ * the range between the workers so that worker i tries start+i,
+ * start+i+workers, and so on.  The search stops early once a proof is
+ * found or the context is cancelled.  Returns the proof found, if any,
+ * and the number of hashes computed.
+ */
+func SearchProof(ctx context.Context, header BlockHeader, start uint32, rounds uint32, workers int) (uint32, bool, uint64) {
+	return SearchProofBelow(ctx, header, &header.Target, start, rounds, workers)
+}
+
+// Like SearchProof, but looks for a hash below the given target instead of the header's.
+func SearchProofBelow(ctx context.Context, header BlockHeader, target *big.Int, start uint32, rounds uint32, workers int) (uint32, bool, uint64) {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashes uint64
+	var found atomic.Bool
+	var proof uint32
+	var once sync.Once
+	var wg sync.WaitGroup
+	end := uint64(start) + uint64(rounds)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			h := header
+			var count uint64 = 0
+			for candidate := uint64(start) + uint64(offset); candidate < end; candidate += uint64(workers) {
+				if ctx.Err() != nil {
+					break
+				}
+				h.Proof = uint32(candidate)
+				count++
+				if h.meetsTarget(target) {
+					once.Do(func() {
+						proof = h.Proof
+						found.Store(true)
+					})
+					cancel()
+					break
+				}
+			}
+			atomic.AddUint64(&hashes, count)
+		}(i)
+	}
+	wg.Wait()
+	return proof, found.Load(), atomic.LoadUint64(&hashes)
+}
+
+/**
+ * Measures a miner's hashrate as a moving average over recent batches of
+ * mining, along with the total number of hashes computed.
+ */
+type HashrateMeter struct {
+	Total   uint64
+	rate    float64
+	elapsed time.Duration
+	mu      sync.Mutex
+}
+
+func NewHashrateMeter() *HashrateMeter {
+	var hm HashrateMeter
+	return &hm
+}
+
+func (hm *HashrateMeter) Record(hashes uint64, elapsed time.Duration) {
+	(*hm).mu.Lock()
+	defer (*hm).mu.Unlock()
+	(*hm).Total += hashes
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(hashes) / elapsed.Seconds()
+	// Early batches count fully, later ones are weighted by their share of the window.
+	(*hm).elapsed += elapsed
+	weight := elapsed.Seconds() / HASHRATE_WINDOW.Seconds()
+	if (*hm).elapsed < HASHRATE_WINDOW {
+		weight = elapsed.Seconds() / (*hm).elapsed.Seconds()
+	}
+	if weight > 1 {
+		weight = 1
+	}
+	(*hm).rate += (rate - (*hm).rate) * weight
+}
+
+// Hashes per second.
+func (hm *HashrateMeter) Rate() float64 {
+	(*hm).mu.Lock()
+	defer (*hm).mu.Unlock()
+	return (*hm).rate
+}
+
+func (hm *HashrateMeter) TotalHashes() uint64 {
+	(*hm).mu.Lock()
+	defer (*hm).mu.Unlock()
+	return (*hm).Total
+}
+
+/**
+ * Walks an external worker through the proofs in [Start, End) of a
+ * template, moving on to the next extra nonce whenever they run out.
+ */
+type ProofCursor struct {
+	TemplateId string
+	ExtraNonce uint32
+	Start      uint64
+	End        uint64
+	Next       uint64
+}
+
+// Starts over if the template has changed since the last batch.
+func (pc *ProofCursor) Reset(templateId string, start uint64, end uint64) {
+	if templateId == (*pc).TemplateId && start == (*pc).Start && end == (*pc).End {
+		return
+	}
+	(*pc).TemplateId = templateId
+	(*pc).ExtraNonce = 0
+	(*pc).Start = start
+	(*pc).End = end
+	(*pc).Next = start
+}
+
+// The first proof and the number of proofs to try in the next batch.
+func (pc *ProofCursor) Batch(rounds uint32) (uint32, uint32) {
+	n := uint64(rounds)
+	if (*pc).End-(*pc).Next < n {
+		n = (*pc).End - (*pc).Next
+	}
+	return uint32((*pc).Next), uint32(n)
+}
+
+func (pc *ProofCursor) Advance(n uint64) {
+	(*pc).Next += n
+	if (*pc).Next >= (*pc).End {
+		(*pc).ExtraNonce++
+		(*pc).Next = (*pc).Start
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestProofCursor(t *testing.T) {
+	type step struct {
+		templateId string
+		start, end uint64
+		rounds     uint32
+		advance    uint64
+		wantFirst  uint32
+		wantCount  uint32
+		wantNonce  uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "batches cover the range in order",
+			steps: []step{
+				{"t1", 100, 250, 100, 100, 100, 100, 0},
+				{"t1", 100, 250, 100, 50, 200, 50, 0},
+			},
+		},
+		{
+			name: "rolls the extra nonce once the range is used up",
+			steps: []step{
+				{"t1", 0, 10, 10, 10, 0, 10, 0},
+				{"t1", 0, 10, 10, 0, 0, 10, 1},
+			},
+		},
+		{
+			name: "advancing past a found proof resumes after it",
+			steps: []step{
+				{"t1", 0, 1000, 100, 43, 0, 100, 0},
+				{"t1", 0, 1000, 100, 0, 43, 100, 0},
+			},
+		},
+		{
+			name: "a new template starts over",
+			steps: []step{
+				{"t1", 0, 10, 10, 10, 0, 10, 0},
+				{"t2", 0, 10, 4, 0, 0, 4, 0},
+			},
+		},
+		{
+			name: "a new range for the same template starts over",
+			steps: []step{
+				{"t1", 0, 10, 5, 5, 0, 5, 0},
+				{"t1", 20, 30, 5, 0, 20, 5, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cursor ProofCursor
+			for i, s := range tt.steps {
+				cursor.Reset(s.templateId, s.start, s.end)
+				first, count := cursor.Batch(s.rounds)
+				if first != s.wantFirst || count != s.wantCount || cursor.ExtraNonce != s.wantNonce {
+					t.Fatalf("step %d: got batch (%d, %d) with extra nonce %d, want (%d, %d) with %d",
+						i, first, count, cursor.ExtraNonce, s.wantFirst, s.wantCount, s.wantNonce)
+				}
+				cursor.Advance(s.advance)
+			}
+		})
+	}
+}
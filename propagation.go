@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long a transaction or block took to reach the nodes of the network.
+type PropagationStats struct {
+	Id      string
+	Origin  string
+	Created time.Time
+	Reached int
+	Median  time.Duration
+	P90     time.Duration
+	Max     time.Duration
+}
+
+/**
+ * Records when each node first sees each transaction or block.  The first
+ * node to see an item is taken to be its origin, and delays are measured
+ * from that moment.
+ */
+type PropagationTracker struct {
+	firstSeen map[string]map[string]time.Time
+	origin    map[string]string
+	created   map[string]time.Time
+	mu        sync.Mutex
+}
+
+func NewPropagationTracker() *PropagationTracker {
+	var p PropagationTracker
+	p.firstSeen = make(map[string]map[string]time.Time)
+	p.origin = make(map[string]string)
+	p.created = make(map[string]time.Time)
+	return &p
+}
+
+func (p *PropagationTracker) Seen(node string, id string) {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	now := time.Now()
+	nodes, ok := (*p).firstSeen[id]
+	if !ok {
+		nodes = make(map[string]time.Time)
+		(*p).firstSeen[id] = nodes
+		(*p).origin[id] = node
+		(*p).created[id] = now
+	}
+	if _, ok := nodes[node]; !ok {
+		nodes[node] = now
+	}
+}
+
+func (p *PropagationTracker) Stats(id string) PropagationStats {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	return p.stats(id)
+}
+
+// When an item was first seen anywhere on the network.
+func (p *PropagationTracker) FirstSeen(id string) (time.Time, bool) {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+	created, ok := (*p).created[id]
+	return created, ok
+}
+
+// Propagation of every item seen so far, oldest first.
+func (p *PropagationTracker) AllStats() []PropagationStats {
+	(*p).mu.Lock()
+	defer (*p).mu.Unlock()
+
+	all := make([]PropagationStats, 0, len((*p).firstSeen))
+	for id := range (*p).firstSeen {
+		all = append(all, p.stats(id))
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Created.Before(all[j].Created)
+	})
+	return all
+}
+
+func (p *PropagationTracker) stats(id string) PropagationStats {
+	stats := PropagationStats{Id: id, Origin: (*p).origin[id], Created: (*p).created[id]}
+	delays := make([]time.Duration, 0, len((*p).firstSeen[id]))
+	for _, seen := range (*p).firstSeen[id] {
+		delays = append(delays, seen.Sub(stats.Created))
+	}
+	if len(delays) == 0 {
+		return stats
+	}
+	sort.Slice(delays, func(i, j int) bool {
+		return delays[i] < delays[j]
+	})
+	stats.Reached = len(delays)
+	stats.Median = delays[len(delays)/2]
+	stats.P90 = delays[len(delays)*9/10]
+	stats.Max = delays[len(delays)-1]
+	return stats
+}
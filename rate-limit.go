@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A rate in messages per second, with a burst allowance.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Limits applied to all messages from a single peer
+var DEFAULT_PEER_RATE_LIMIT = RateLimit{Rate: 500, Burst: 1000}
+
+// Limits for each peer on each type of message.  Types not listed are
+// only subject to the overall limit for the peer.
+func DefaultRateLimits() map[string]RateLimit {
+	return map[string]RateLimit{
+		POST_TRANSACTION: {Rate: 50, Burst: 100},
+		MISSING_BLOCK:    {Rate: 10, Burst: 20},
+		PROOF_FOUND:      {Rate: 50, Burst: 100},
+		INV:              {Rate: 100, Burst: 200},
+		GETDATA:          {Rate: 100, Burst: 200},
+		GET_HEAD:         {Rate: 5, Burst: 10},
+		GET_HEADERS:      {Rate: 10, Burst: 20},
+		GET_BLOCKS:       {Rate: 20, Burst: 40},
+		GETADDR:          {Rate: 2, Burst: 5},
+		ADDR:             {Rate: 5, Burst: 10},
+	}
+}
+
+/**
+ * A token bucket holding up to Burst tokens, refilled at Rate tokens per
+ * second.  Each message takes one token, and is refused if there is none.
+ */
+type TokenBucket struct {
+	Limit  RateLimit
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+func NewTokenBucket(limit RateLimit) *TokenBucket {
+	var b TokenBucket
+	b.Limit = limit
+	b.tokens = limit.Burst
+	b.last = time.Now()
+	return &b
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+func (b *TokenBucket) AllowN(n float64) bool {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	b.refill()
+	if (*b).tokens < n {
+		return false
+	}
+	(*b).tokens -= n
+	return true
+}
+
+// Determines whether n tokens are available, without taking them.
+func (b *TokenBucket) Has(n float64) bool {
+	(*b).mu.Lock()
+	defer (*b).mu.Unlock()
+	b.refill()
+	return (*b).tokens >= n
+}
+
+// Waits until n tokens are available, then takes them.
+func (b *TokenBucket) WaitN(n float64) {
+	for {
+		(*b).mu.Lock()
+		b.refill()
+		if (*b).tokens >= n {
+			(*b).tokens -= n
+			(*b).mu.Unlock()
+			return
+		}
+		wait := time.Duration((n - (*b).tokens) / (*b).Limit.Rate * float64(time.Second))
+		(*b).mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+func (b *TokenBucket) refill() {
+	now := time.Now()
+	(*b).tokens += now.Sub((*b).last).Seconds() * (*b).Limit.Rate
+	if (*b).tokens > (*b).Limit.Burst {
+		(*b).tokens = (*b).Limit.Burst
+	}
+	(*b).last = now
+}
+
+/**
+ * Keeps a token bucket for every peer, and for every peer and message
+ * type that has a limit.  A message is allowed only if both buckets
+ * have a token.
+ */
+type RateLimiter struct {
+	PeerLimit   RateLimit
+	TypeLimits  map[string]RateLimit
+	peerBuckets map[string]*TokenBucket
+	typeBuckets map[string]map[string]*TokenBucket
+	mu          sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	var l RateLimiter
+	l.PeerLimit = DEFAULT_PEER_RATE_LIMIT
+	l.TypeLimits = DefaultRateLimits()
+	l.peerBuckets = make(map[string]*TokenBucket)
+	l.typeBuckets = make(map[string]map[string]*TokenBucket)
+	return &l
+}
+
+func (l *RateLimiter) Allow(peer string, msg string) bool {
+	(*l).mu.Lock()
+	defer (*l).mu.Unlock()
+	peerBucket, ok := (*l).peerBuckets[peer]
+	if !ok {
+		peerBucket = NewTokenBucket((*l).PeerLimit)
+		(*l).peerBuckets[peer] = peerBucket
+	}
+	var typeBucket *TokenBucket
+	if limit, ok := (*l).TypeLimits[msg]; ok {
+		if (*l).typeBuckets[peer] == nil {
+			(*l).typeBuckets[peer] = make(map[string]*TokenBucket)
+		}
+		typeBucket, ok = (*l).typeBuckets[peer][msg]
+		if !ok {
+			typeBucket = NewTokenBucket(limit)
+			(*l).typeBuckets[peer][msg] = typeBucket
+		}
+	}
+
+	// A token is only taken once both buckets have one, so that messages
+	// refused by one bucket do not drain the other.  The limiter's lock
+	// keeps other messages from taking the tokens in between.
+	if (typeBucket != nil && !typeBucket.Has(1)) || !peerBucket.Has(1) {
+		return false
+	}
+	if typeBucket != nil {
+		typeBucket.Allow()
+	}
+	return peerBucket.Allow()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+)
+
+/**
+ * Describes how a node's view of the blockchain changes when its head
+ * moves from one block to another.  Blocks on the abandoned branch are
+ * disconnected, newest first, and blocks on the new branch are connected,
+ * oldest first.  When the new head simply extends the old one, no blocks
+ * are disconnected.
+ */
+type Reorg struct {
+	ForkPoint    *Block
+	Disconnected []*Block
+	Connected    []*Block
+}
+
+/**
+ * Walks back from both heads until they meet at their common ancestor.
+ * Returns nil if the two branches cannot be connected with the blocks
+ * that are known.
+ */
+func FindReorg(blocks map[string]*Block, oldHead *Block, newHead *Block) *Reorg {
+	var reorg Reorg
+	oldBlock := oldHead
+	newBlock := newHead
+
+	for newBlock.ChainLength > oldBlock.ChainLength {
+		reorg.Connected = append(reorg.Connected, newBlock)
+		newBlock = blocks[newBlock.PrevBlockHash]
+		if newBlock == nil {
+			return nil
+		}
+	}
+	for oldBlock.ChainLength > newBlock.ChainLength {
+		reorg.Disconnected = append(reorg.Disconnected, oldBlock)
+		oldBlock = blocks[oldBlock.PrevBlockHash]
+		if oldBlock == nil {
+			return nil
+		}
+	}
+	for oldBlock.GetHash() != newBlock.GetHash() {
+		reorg.Disconnected = append(reorg.Disconnected, oldBlock)
+		reorg.Connected = append(reorg.Connected, newBlock)
+		oldBlock = blocks[oldBlock.PrevBlockHash]
+		newBlock = blocks[newBlock.PrevBlockHash]
+		if oldBlock == nil || newBlock == nil {
+			return nil
+		}
+	}
+	reorg.ForkPoint = oldBlock
+
+	// Blocks were collected walking backwards; connect them oldest first.
+	for i, j := 0, len(reorg.Connected)-1; i < j; i, j = i+1, j-1 {
+		reorg.Connected[i], reorg.Connected[j] = reorg.Connected[j], reorg.Connected[i]
+	}
+	return &reorg
+}
+
+// The number of blocks rolled back from the old head.
+func (r *Reorg) Depth() int {
+	return len((*r).Disconnected)
+}
+
+/**
+ * Transactions from the disconnected blocks that are not included again
+ * in any of the connected blocks.  These need to go back to the mempool,
+ * oldest first, so that each sender's transactions keep their nonce order.
+ */
+func (r *Reorg) OrphanedTransactions() []*Transaction {
+	included := make(map[string]bool)
+	for _, block := range (*r).Connected {
+		for _, v := range block.Transactions {
+			included[v.Id] = true
+		}
+	}
+	orphaned := make([]*Transaction, 0)
+	// Disconnected blocks are newest first.
+	for j := len((*r).Disconnected) - 1; j >= 0; j-- {
+		block := (*r).Disconnected[j]
+		for i := range block.Transactions {
+			if !included[block.Transactions[i].Id] {
+				orphaned = append(orphaned, &block.Transactions[i].Tx)
+			}
+		}
+	}
+	return orphaned
+}
+
+// Counts the reorgs nodes go through, by depth, for measuring how often forks are resolved.
+type ReorgTracker struct {
+	depths map[int]int
+	mu     sync.Mutex
+}
+
+func NewReorgTracker() *ReorgTracker {
+	var r ReorgTracker
+	r.depths = make(map[int]int)
+	return &r
+}
+
+func (r *ReorgTracker) Reorged(depth int) {
+	(*r).mu.Lock()
+	defer (*r).mu.Unlock()
+	(*r).depths[depth]++
+}
+
+// The number of reorgs of each depth seen so far.
+func (r *ReorgTracker) Depths() map[int]int {
+	(*r).mu.Lock()
+	defer (*r).mu.Unlock()
+	depths := make(map[int]int, len((*r).depths))
+	for depth, count := range (*r).depths {
+		depths[depth] = count
+	}
+	return depths
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The blocks on a chain mined by one address, and the rewards earned for them.
+type RewardShare struct {
+	Address     string
+	Blocks      int
+	Rewards     uint32
+	BlockShare  float64
+	RewardShare float64
+}
+
+/**
+ * Tallies the blocks of the chain ending at head by their reward address,
+ * along with the coinbase rewards and fees each address earned.  The
+ * genesis block is not counted.
+ */
+func RewardShares(blocks map[string]*Block, head *Block) map[string]*RewardShare {
+	shares := make(map[string]*RewardShare)
+	totalBlocks := 0
+	var totalRewards uint32 = 0
+	for block := head; block != nil && !block.IsGenesisBlock(); block = blocks[block.PrevBlockHash] {
+		share, ok := shares[block.RewardAddr]
+		if !ok {
+			share = &RewardShare{Address: block.RewardAddr}
+			shares[block.RewardAddr] = share
+		}
+		share.Blocks++
+		share.Rewards += block.TotalRewards()
+		totalBlocks++
+		totalRewards += block.TotalRewards()
+	}
+	for _, share := range shares {
+		share.BlockShare = float64(share.Blocks) / float64(totalBlocks)
+		if totalRewards > 0 {
+			share.RewardShare = float64(share.Rewards) / float64(totalRewards)
+		}
+	}
+	return shares
+}
+
+/**
+ * Runs miners whose simulated hashrates split totalHashrate according to
+ * powerShares, for the given duration, and prints the share of the rewards
+ * each one earned on the final chain next to its share of the hashing power.
+ * With enough blocks the two should converge.
+ */
+func SimulateHashrateShares(powerShares []float64, totalHashrate float64, duration time.Duration) map[string]*RewardShare {
+	net := NewFakeNet()
+	miners := make([]*Miner, 0, len(powerShares))
+	balances := make(map[string]uint32)
+	for i := range powerShares {
+		miner := NewMiner(fmt.Sprintf("Miner%d", i+1), net, NUM_ROUNDS_MINING, nil)
+		miners = append(miners, miner)
+		balances[miner.GetAddress()] = 0
+	}
+	genesis := MakeGenesisDefault(balances)
+	for i, miner := range miners {
+		miner.SetGenesisBlock(genesis)
+		miner.SetHashrate(totalHashrate * powerShares[i])
+		net.Register(miner)
+	}
+	for _, miner := range miners {
+		miner.Initialize()
+	}
+	time.Sleep(duration)
+
+	// Every miner is asked for its view, and the longest chain is reported.
+	var best *Miner
+	for _, miner := range miners {
+		if best == nil || miner.LastBlock.ChainLength > best.LastBlock.ChainLength {
+			best = miner
+		}
+	}
+	shares := best.RewardShares()
+
+	fmt.Printf("Chain of length %d after %v, from %s's perspective:\n", best.LastBlock.ChainLength, duration, best.Name)
+	order := make([]int, len(miners))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return powerShares[order[i]] < powerShares[order[j]]
+	})
+	for _, i := range order {
+		miner := miners[i]
+		share, ok := shares[miner.GetAddress()]
+		if !ok {
+			share = &RewardShare{Address: miner.GetAddress()}
+		}
+		fmt.Printf("%s: %.0f%% of the hashrate (%.0f hashes/s measured), %d blocks, %.1f%% of the rewards\n",
+			miner.Name, powerShares[i]*100, miner.HashesPerSecond(), share.Blocks, share.RewardShare*100)
+	}
+	return shares
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// Network topologies a scenario can ask for
+const TOPOLOGY_FULL string = "full"
+const TOPOLOGY_DISCOVERY string = "discovery"
+const TOPOLOGY_REGULAR string = "regular"
+const TOPOLOGY_SMALL_WORLD string = "small-world"
+
+// Kinds of assertions on the final state of a scenario
+const ASSERT_BALANCE string = "balance"
+const ASSERT_CHAIN_LENGTH string = "chain-length"
+const ASSERT_CONFIRMED string = "confirmed"
+const ASSERT_AGREE string = "agree"
+
+// The scenario run when no other run is asked for.
+const DEFAULT_SCENARIO string = "scenarios/demo.json"
+
+// A duration written in scenario files as a string such as "1.5s".
+type ScenarioDuration time.Duration
+
+func (d *ScenarioDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ScenarioDuration(parsed)
+	return nil
+}
+
+func (d ScenarioDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+/**
+ * A simulation described in a scenario file: who takes part, how they are
+ * connected, what they do and when, and what should hold once the
+ * scenario has run for its duration.
+ */
+type Scenario struct {
+	Name         string
+	Consensus    string
+	Duration     ScenarioDuration
+	Network      NetworkConditions
+	Participants []Participant
+	Transactions []ScheduledTransaction
+	Assertions   []Assertion
+}
+
+// How the participants are linked, and how slow the links are.
+type NetworkConditions struct {
+	Topology   string
+	Degree     int
+	Rewire     float64
+	Seed       int64
+	LinkDelay  ScenarioDuration
+	LinkJitter ScenarioDuration
+}
+
+/**
+ * A client or miner taking part in a scenario.  Miners without a hashrate
+ * mine as fast as they can.  Participants that join late sync with the
+ * network when they do, and participants that leave stop mining and are
+ * cut off from the network.
+ */
+type Participant struct {
+	Name     string
+	Miner    bool
+	Hashrate float64
+	Balance  uint32
+	Stake    uint32
+	JoinAt   ScenarioDuration
+	LeaveAt  ScenarioDuration
+}
+
+// A transfer made by a participant at a given time, labeled so that assertions can refer to it.
+type ScheduledTransaction struct {
+	Label  string
+	At     ScenarioDuration
+	From   string
+	To     string
+	Amount uint32
+	Fee    uint32
+}
+
+/**
+ * A check on the final state.  Node names the participant whose view is
+ * checked; if empty, every participant still online is checked.
+ *
+ * - balance: the balance of Of lies between Min and Max.
+ * - chain-length: the length of the chain lies between Min and Max.
+ * - confirmed: the transaction labeled Transaction is confirmed.
+ * - agree: the confirmed chains of the nodes do not conflict.
+ */
+type Assertion struct {
+	Kind        string
+	Node        string
+	Of          string
+	Transaction string
+	Min         *uint32
+	Max         *uint32
+}
+
+// The outcome of running a scenario.
+type ScenarioResult struct {
+	Name     string
+	Passed   bool
+	Failures []string
+	Metrics  *SimulationMetrics
+}
+
+// Reads and validates a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return &s, nil
+}
+
+// Checks that a scenario only refers to participants and transactions it declares.
+func (s *Scenario) Validate() error {
+	if len(s.Participants) == 0 {
+		return errors.New("scenario has no participants")
+	}
+	if s.Duration <= 0 {
+		return errors.New("scenario needs a positive duration")
+	}
+	if s.Consensus != "" && s.Consensus != CONSENSUS_POW && s.Consensus != CONSENSUS_POS {
+		return fmt.Errorf("unknown consensus %q", s.Consensus)
+	}
+	switch s.Network.Topology {
+	case "", TOPOLOGY_FULL, TOPOLOGY_DISCOVERY, TOPOLOGY_REGULAR, TOPOLOGY_SMALL_WORLD:
+	default:
+		return fmt.Errorf("unknown topology %q", s.Network.Topology)
+	}
+
+	names := make(map[string]bool)
+	founders := 0
+	for _, p := range s.Participants {
+		if p.Name == "" || names[p.Name] {
+			return fmt.Errorf("participant names must be unique and not empty, got %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.LeaveAt > 0 && p.LeaveAt <= p.JoinAt {
+			return fmt.Errorf("%v leaves before joining", p.Name)
+		}
+		if p.JoinAt == 0 {
+			founders++
+		}
+	}
+	if founders == 0 {
+		return errors.New("at least one participant must be there from the start")
+	}
+	// The topology links the participants there from the start.
+	switch s.Network.Topology {
+	case TOPOLOGY_REGULAR:
+		if s.Network.Degree < 1 || s.Network.Degree >= founders || founders*s.Network.Degree%2 != 0 {
+			return fmt.Errorf("no regular topology of degree %d between %d participants", s.Network.Degree, founders)
+		}
+	case TOPOLOGY_SMALL_WORLD:
+		if s.Network.Degree < 2 || s.Network.Degree%2 != 0 || s.Network.Degree >= founders {
+			return fmt.Errorf("small-world degree must be even, at least 2 and below the %d participants, got %d", founders, s.Network.Degree)
+		}
+		if s.Network.Rewire < 0 || s.Network.Rewire > 1 {
+			return fmt.Errorf("rewiring probability must be between 0 and 1, got %v", s.Network.Rewire)
+		}
+	}
+
+	labels := make(map[string]bool)
+	for _, tx := range s.Transactions {
+		if !names[tx.From] || !names[tx.To] {
+			return fmt.Errorf("transaction %q is between unknown participants", tx.Label)
+		}
+		if tx.Label != "" {
+			if labels[tx.Label] {
+				return fmt.Errorf("transaction label %q is used twice", tx.Label)
+			}
+			labels[tx.Label] = true
+		}
+	}
+
+	for _, a := range s.Assertions {
+		if a.Node != "" && !names[a.Node] {
+			return fmt.Errorf("%v assertion on unknown participant %q", a.Kind, a.Node)
+		}
+		switch a.Kind {
+		case ASSERT_BALANCE:
+			if !names[a.Of] {
+				return fmt.Errorf("balance assertion of unknown participant %q", a.Of)
+			}
+		case ASSERT_CONFIRMED:
+			if !labels[a.Transaction] {
+				return fmt.Errorf("confirmed assertion on unknown transaction %q", a.Transaction)
+			}
+		case ASSERT_CHAIN_LENGTH, ASSERT_AGREE:
+		default:
+			return fmt.Errorf("unknown assertion %q", a.Kind)
+		}
+	}
+	return nil
+}
+
+// A participant while the scenario runs, which is either a client or a miner.
+type scenarioNode struct {
+	Participant
+	client *Client
+	miner  *Miner
+	online bool
+	joined bool
+}
+
+func (n *scenarioNode) netClient() NetClient {
+	if n.miner != nil {
+		return n.miner
+	}
+	return n.client
+}
+
+func (n *scenarioNode) address() string {
+	return n.netClient().GetAddress()
+}
+
+func (n *scenarioNode) lastBlock() *Block {
+	if n.miner != nil {
+		return n.miner.LastBlock
+	}
+	return n.client.LastBlock
+}
+
+func (n *scenarioNode) lastConfirmedBlock() *Block {
+	if n.miner != nil {
+		return n.miner.LastConfirmedBlock
+	}
+	return n.client.LastConfirmedBlock
+}
+
+func (n *scenarioNode) spendableGold() uint32 {
+	if n.miner != nil {
+		return n.miner.SpendableGold()
+	}
+	return n.client.SpendableGold()
+}
+
+func (n *scenarioNode) postTransaction(outputs []Output, fee uint32) *Transaction {
+	if n.miner != nil {
+		return n.miner.PostTransaction(outputs, fee)
+	}
+	return n.client.PostTransaction(outputs, fee)
+}
+
+func (n *scenarioNode) chainContains(tx *Transaction, confirmed bool) bool {
+	if n.miner != nil {
+		return n.miner.ChainContains(tx, confirmed)
+	}
+	return n.client.ChainContains(tx, confirmed)
+}
+
+func (n *scenarioNode) onConfirmedChain(blockId string) bool {
+	if n.miner != nil {
+		return n.miner.OnConfirmedChain(blockId)
+	}
+	return n.client.OnConfirmedChain(blockId)
+}
+
+func (n *scenarioNode) chainView() ChainView {
+	if n.miner != nil {
+		return n.miner.ChainView()
+	}
+	return n.client.ChainView()
+}
+
+func (n *scenarioNode) setEngine(engine ConsensusEngine) {
+	if n.miner != nil {
+		n.miner.Engine = engine
+	} else {
+		n.client.Engine = engine
+	}
+}
+
+func (n *scenarioNode) start(genesis *Block, bootstrap *PeerAddress, sync bool) {
+	if n.miner != nil {
+		n.miner.SetGenesisBlock(genesis)
+		if bootstrap != nil {
+			n.miner.StartDiscovery(*bootstrap)
+		}
+		n.miner.Initialize()
+		if sync {
+			n.miner.StartSync()
+		}
+		return
+	}
+	n.client.SetGenesisBlock(genesis)
+	if bootstrap != nil {
+		n.client.StartDiscovery(*bootstrap)
+	}
+	if sync {
+		n.client.StartSync()
+	}
+}
+
+// Something the runner does at a given time after the scenario starts.
+type scenarioEvent struct {
+	At time.Duration
+	Do func()
+}
+
+/**
+ * Runs a scenario on a fake network and checks its assertions once it
+ * has run for its duration, measuring the run along the way.  Transactions that cannot be made, because
+ * their sender is offline or short of gold, count as failures.
+ */
+func RunScenario(s *Scenario) ScenarioResult {
+	result := ScenarioResult{Name: s.Name}
+	failf := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+	// Scenarios that were not loaded from a file are checked here.
+	if err := s.Validate(); err != nil {
+		failf("invalid scenario: %v", err)
+		return result
+	}
+
+	net := NewFakeNet()
+	net.LinkDelay = time.Duration(s.Network.LinkDelay)
+	net.LinkJitter = time.Duration(s.Network.LinkJitter)
+
+	nodes := make([]*scenarioNode, 0, len(s.Participants))
+	byName := make(map[string]*scenarioNode)
+	for _, p := range s.Participants {
+		node := &scenarioNode{Participant: p}
+		if p.Miner {
+			node.miner = NewMiner(p.Name, net, NUM_ROUNDS_MINING, nil)
+			if p.Hashrate > 0 {
+				node.miner.SetHashrate(p.Hashrate)
+			}
+		} else {
+			node.client = NewClient(p.Name, net, nil)
+		}
+		nodes = append(nodes, node)
+		byName[p.Name] = node
+	}
+
+	balances := make(map[string]uint32)
+	stakes := make(map[string]uint32)
+	for _, node := range nodes {
+		balances[node.address()] = node.Balance
+		if node.Stake > 0 {
+			stakes[node.address()] = node.Stake
+		}
+	}
+	genesis := MakeGenesisStaked(balances, stakes)
+	if s.Consensus == CONSENSUS_POS {
+		for _, node := range nodes {
+			node.setEngine(NewPosEngine(genesis))
+		}
+	}
+
+	founders := make([]*scenarioNode, 0)
+	for _, node := range nodes {
+		if node.JoinAt == 0 {
+			founders = append(founders, node)
+		}
+	}
+	addrs := make([]string, 0, len(founders))
+	for _, node := range founders {
+		addrs = append(addrs, node.address())
+	}
+	rng := rand.New(rand.NewSource(s.Network.Seed))
+	switch s.Network.Topology {
+	case TOPOLOGY_DISCOVERY:
+		net.SetTopology([]Edge{})
+	case TOPOLOGY_REGULAR:
+		net.SetTopology(RandomRegularTopology(addrs, s.Network.Degree, rng))
+	case TOPOLOGY_SMALL_WORLD:
+		net.SetTopology(SmallWorldTopology(addrs, s.Network.Degree, s.Network.Rewire, rng))
+	}
+
+	// Late joiners, and everyone when nodes find each other, start from the first founder.
+	bootstrap := PeerAddress{Address: founders[0].address()}
+	for _, node := range founders {
+		net.Register(node.netClient())
+	}
+	for i, node := range founders {
+		var peer *PeerAddress
+		if s.Network.Topology == TOPOLOGY_DISCOVERY && i > 0 {
+			peer = &bootstrap
+		}
+		node.start(genesis, peer, false)
+		node.online = true
+		node.joined = true
+	}
+
+	events := make([]scenarioEvent, 0)
+	for _, node := range nodes {
+		node := node
+		if node.JoinAt > 0 {
+			events = append(events, scenarioEvent{time.Duration(node.JoinAt), func() {
+				net.Register(node.netClient())
+				node.start(genesis, &bootstrap, true)
+				node.online = true
+				node.joined = true
+			}})
+		}
+		if node.LeaveAt > 0 {
+			events = append(events, scenarioEvent{time.Duration(node.LeaveAt), func() {
+				if node.miner != nil {
+					node.miner.Stop()
+				}
+				net.Unregister(node.address())
+				node.online = false
+			}})
+		}
+	}
+	posted := make(map[string]*Transaction)
+	for _, tx := range s.Transactions {
+		tx := tx
+		events = append(events, scenarioEvent{time.Duration(tx.At), func() {
+			from, to := byName[tx.From], byName[tx.To]
+			if !from.online {
+				failf("transaction %q: %v is offline", tx.Label, tx.From)
+				return
+			}
+			if tx.Amount+tx.Fee > from.spendableGold() {
+				failf("transaction %q: %v cannot spend %d gold", tx.Label, tx.From, tx.Amount+tx.Fee)
+				return
+			}
+			posted[tx.Label] = from.postTransaction([]Output{{Address: to.address(), Amount: tx.Amount}}, tx.Fee)
+		}})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+
+	began := time.Now()
+	for _, event := range events {
+		if event.At > time.Duration(s.Duration) {
+			break
+		}
+		time.Sleep(event.At - time.Since(began))
+		event.Do()
+	}
+	time.Sleep(time.Duration(s.Duration) - time.Since(began))
+	for _, node := range nodes {
+		if node.miner != nil && node.online {
+			node.miner.Stop()
+		}
+	}
+	views := make([]ChainView, 0, len(nodes))
+	for _, node := range nodes {
+		if node.joined {
+			views = append(views, node.chainView())
+		}
+	}
+	result.Metrics = CollectMetrics(views, net.Propagation, net.Reorgs, time.Since(began))
+
+	for _, a := range s.Assertions {
+		checked := make([]*scenarioNode, 0)
+		if a.Node != "" {
+			checked = append(checked, byName[a.Node])
+		} else {
+			for _, node := range nodes {
+				if node.online {
+					checked = append(checked, node)
+				}
+			}
+		}
+		switch a.Kind {
+		case ASSERT_BALANCE:
+			of := byName[a.Of]
+			for _, node := range checked {
+				balance := node.lastBlock().BalanceOf(of.address())
+				if !inRange(balance, a.Min, a.Max) {
+					failf("%v sees %v with %d gold, expected %v", node.Name, a.Of, balance, rangeString(a.Min, a.Max))
+				}
+			}
+		case ASSERT_CHAIN_LENGTH:
+			for _, node := range checked {
+				length := node.lastBlock().ChainLength
+				if !inRange(length, a.Min, a.Max) {
+					failf("%v has a chain of length %d, expected %v", node.Name, length, rangeString(a.Min, a.Max))
+				}
+			}
+		case ASSERT_CONFIRMED:
+			tx, ok := posted[a.Transaction]
+			for _, node := range checked {
+				if !ok || !node.chainContains(tx, true) {
+					failf("%v has not confirmed transaction %q", node.Name, a.Transaction)
+				}
+			}
+		case ASSERT_AGREE:
+			// Every confirmed chain must be a prefix of the longest one.
+			var longest *scenarioNode
+			for _, node := range checked {
+				if longest == nil || node.lastConfirmedBlock().ChainLength > longest.lastConfirmedBlock().ChainLength {
+					longest = node
+				}
+			}
+			for _, node := range checked {
+				if !longest.onConfirmedChain(node.lastConfirmedBlock().GetHash()) {
+					failf("%v confirmed a block at height %d that %v did not",
+						node.Name, node.lastConfirmedBlock().ChainLength, longest.Name)
+				}
+			}
+		}
+	}
+	result.Passed = len(result.Failures) == 0
+	return result
+}
+
+func inRange(value uint32, min *uint32, max *uint32) bool {
+	return (min == nil || value >= *min) && (max == nil || value <= *max)
+}
+
+func rangeString(min *uint32, max *uint32) string {
+	switch {
+	case min != nil && max != nil && *min == *max:
+		return fmt.Sprintf("%d", *min)
+	case min != nil && max != nil:
+		return fmt.Sprintf("between %d and %d", *min, *max)
+	case min != nil:
+		return fmt.Sprintf("at least %d", *min)
+	case max != nil:
+		return fmt.Sprintf("at most %d", *max)
+	}
+	return "any value"
+}
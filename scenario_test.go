@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Five participants there from the start, and one joining later.
+func testScenario() *Scenario {
+	return &Scenario{
+		Name:     "test",
+		Duration: ScenarioDuration(10 * time.Second),
+		Participants: []Participant{
+			{Name: "Minnie", Miner: true},
+			{Name: "Mickey", Miner: true},
+			{Name: "Alice", Balance: 100},
+			{Name: "Bob"},
+			{Name: "Cindy"},
+			{Name: "Donald", Miner: true, JoinAt: ScenarioDuration(2 * time.Second)},
+		},
+		Transactions: []ScheduledTransaction{
+			{Label: "pay", From: "Alice", To: "Bob", Amount: 10, Fee: 1},
+		},
+		Assertions: []Assertion{
+			{Kind: ASSERT_CONFIRMED, Transaction: "pay"},
+			{Kind: ASSERT_BALANCE, Node: "Minnie", Of: "Bob"},
+			{Kind: ASSERT_AGREE},
+		},
+	}
+}
+
+func TestScenarioValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(s *Scenario)
+		wantErr bool
+	}{
+		{"a valid scenario", func(s *Scenario) {}, false},
+		{"no participants", func(s *Scenario) { s.Participants = nil }, true},
+		{"no duration", func(s *Scenario) { s.Duration = 0 }, true},
+		{"unknown consensus", func(s *Scenario) { s.Consensus = "pow2" }, true},
+		{"proof-of-stake", func(s *Scenario) { s.Consensus = CONSENSUS_POS }, false},
+		{"unknown topology", func(s *Scenario) { s.Network.Topology = "star" }, true},
+		{"duplicate names", func(s *Scenario) { s.Participants[1].Name = "Minnie" }, true},
+		{"empty name", func(s *Scenario) { s.Participants[2].Name = "" }, true},
+		{"leaving before joining", func(s *Scenario) { s.Participants[5].LeaveAt = ScenarioDuration(time.Second) }, true},
+		{"nobody there from the start", func(s *Scenario) {
+			for i := range s.Participants {
+				s.Participants[i].JoinAt = ScenarioDuration(time.Second)
+			}
+		}, true},
+		{"transaction to an unknown participant", func(s *Scenario) { s.Transactions[0].To = "Eve" }, true},
+		{"a label used twice", func(s *Scenario) { s.Transactions = append(s.Transactions, s.Transactions[0]) }, true},
+		{"assertion on an unknown node", func(s *Scenario) { s.Assertions[1].Node = "Eve" }, true},
+		{"balance of an unknown participant", func(s *Scenario) { s.Assertions[1].Of = "Eve" }, true},
+		{"confirmation of an unknown transaction", func(s *Scenario) { s.Assertions[0].Transaction = "refund" }, true},
+		{"unknown assertion", func(s *Scenario) { s.Assertions[2].Kind = "rich" }, true},
+		{"regular topology", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_REGULAR, Degree: 2} }, false},
+		{"regular topology of degree zero", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_REGULAR} }, true},
+		{"regular topology with an odd number of link ends", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_REGULAR, Degree: 3} }, true},
+		{"regular topology denser than the founders", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_REGULAR, Degree: 6} }, true},
+		{"small-world topology", func(s *Scenario) {
+			s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD, Degree: 2, Rewire: 0.5}
+		}, false},
+		{"small-world topology of odd degree", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD, Degree: 3} }, true},
+		{"small-world topology of degree zero", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD} }, true},
+		{"small-world topology denser than the founders", func(s *Scenario) { s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD, Degree: 6} }, true},
+		{"small-world rewiring above one", func(s *Scenario) {
+			s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD, Degree: 2, Rewire: 1.5}
+		}, true},
+		{"small-world rewiring below zero", func(s *Scenario) {
+			s.Network = NetworkConditions{Topology: TOPOLOGY_SMALL_WORLD, Degree: 2, Rewire: -0.1}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testScenario()
+			tt.change(s)
+			if err := s.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadScenarioDemo(t *testing.T) {
+	if _, err := LoadScenario(DEFAULT_SCENARIO); err != nil {
+		t.Fatalf("LoadScenario(%q) = %v", DEFAULT_SCENARIO, err)
+	}
+}
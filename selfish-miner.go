@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**
+ * Decides when a miner publishes its blocks.  Miners without a strategy
+ * publish every block as soon as it is found.
+ */
+type MiningStrategy interface {
+	// Takes a block the miner sealed, returning the blocks to publish now.
+	BlockFound(block *Block) []*Block
+
+	// Takes a block found by another miner, after the miner has accepted
+	// it, returning the blocks to publish now.
+	BlockReceived(block *Block) []*Block
+
+	// Determines whether the miner is keeping one of its blocks from the network.
+	Withholds(blockId string) bool
+}
+
+/**
+ * The selfish mining strategy of Eyal and Sirer.  Blocks found are kept
+ * on a private branch, and only published to waste the work of the honest
+ * miners: when they catch up to within one block the whole branch is
+ * released, and while the lead is larger one block is released for each
+ * block they find.  With a lead of one, a block from the honest miners
+ * starts a race, in which the attacker publishes its block and hopes the
+ * honest miners build on it.
+ *
+ * The lead is measured by height, comparing the tip of the private branch
+ * with the highest block seen from other miners.
+ */
+type SelfishMiner struct {
+	Miner         *Miner
+	Found         int
+	Published     int
+	Races         int
+	Abandoned     int
+	withheld      []*Block
+	privateHeight uint32
+	publicHeight  uint32
+	racing        bool
+	mu            sync.Mutex
+}
+
+// Makes the miner mine selfishly.  It must be called before the miner starts mining.
+func NewSelfishMiner(m *Miner) *SelfishMiner {
+	var sm SelfishMiner
+	sm.Miner = m
+	sm.withheld = make([]*Block, 0)
+	m.Strategy = &sm
+	return &sm
+}
+
+func (sm *SelfishMiner) BlockFound(block *Block) []*Block {
+	(*sm).mu.Lock()
+	defer (*sm).mu.Unlock()
+
+	(*sm).Found++
+	(*sm).withheld = append((*sm).withheld, block)
+	(*sm).privateHeight = (*block).ChainLength
+
+	// Winning a race: the branch is now longer than the public chain.
+	if (*sm).racing {
+		(*sm).racing = false
+		return sm.releaseUpTo((*sm).privateHeight)
+	}
+	return nil
+}
+
+func (sm *SelfishMiner) BlockReceived(block *Block) []*Block {
+	(*sm).mu.Lock()
+	defer (*sm).mu.Unlock()
+
+	if (*block).ChainLength <= (*sm).publicHeight {
+		return nil
+	}
+	(*sm).publicHeight = (*block).ChainLength
+	(*sm).racing = false
+	if len((*sm).withheld) == 0 {
+		return nil
+	}
+
+	lead := int((*sm).privateHeight) - int((*sm).publicHeight)
+	switch {
+	case lead < 0:
+		// The honest miners overtook the branch, which the miner gives up on.
+		(*sm).Abandoned += len((*sm).withheld)
+		(*sm).withheld = make([]*Block, 0)
+		return nil
+	case lead == 0:
+		// The lead was one: publish the branch and race.
+		(*sm).racing = true
+		(*sm).Races++
+		return sm.releaseUpTo((*sm).privateHeight)
+	case lead == 1:
+		// The lead was two: publish the branch, which overrides the public chain.
+		return sm.releaseUpTo((*sm).privateHeight)
+	default:
+		// Keep ahead, matching the public chain's height.
+		return sm.releaseUpTo((*sm).publicHeight)
+	}
+}
+
+func (sm *SelfishMiner) Withholds(blockId string) bool {
+	(*sm).mu.Lock()
+	defer (*sm).mu.Unlock()
+	for _, block := range (*sm).withheld {
+		if block.GetHash() == blockId {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the withheld blocks up to the height from the private branch, oldest first.
+func (sm *SelfishMiner) releaseUpTo(height uint32) []*Block {
+	released := make([]*Block, 0)
+	for len((*sm).withheld) > 0 && (*sm).withheld[0].ChainLength <= height {
+		released = append(released, (*sm).withheld[0])
+		(*sm).withheld = (*sm).withheld[1:]
+	}
+	(*sm).Published += len(released)
+	return released
+}
+
+// The number of blocks on the private branch.
+func (sm *SelfishMiner) Lead() int {
+	(*sm).mu.Lock()
+	defer (*sm).mu.Unlock()
+	return len((*sm).withheld)
+}
+
+/**
+ * The relative revenue Eyal and Sirer expect for a selfish miner with a
+ * share alpha of the hashrate, when a share gamma of the honest miners
+ * builds on the attacker's block during a race.  Selfish mining pays off
+ * once this is above alpha.
+ */
+func SelfishMiningRevenue(alpha float64, gamma float64) float64 {
+	numerator := alpha*(1-alpha)*(1-alpha)*(4*alpha+gamma*(1-2*alpha)) - alpha*alpha*alpha
+	denominator := 1 - alpha*(1+(2-alpha)*alpha)
+	return numerator / denominator
+}
+
+/**
+ * Runs a selfish miner with the share alpha of totalHashrate against two
+ * honest miners splitting the rest, for the given duration, and prints the
+ * attacker's share of the rewards on the final chain next to its share of
+ * the hashrate and the revenue Eyal and Sirer predict.
+ */
+func SimulateSelfishMining(alpha float64, totalHashrate float64, duration time.Duration) *RewardShare {
+	net := NewFakeNet()
+	attacker := NewMiner("Selfish", net, NUM_ROUNDS_MINING, nil)
+	honest := []*Miner{
+		NewMiner("Honest1", net, NUM_ROUNDS_MINING, nil),
+		NewMiner("Honest2", net, NUM_ROUNDS_MINING, nil),
+	}
+	miners := append([]*Miner{attacker}, honest...)
+	balances := make(map[string]uint32)
+	for _, miner := range miners {
+		balances[miner.GetAddress()] = 0
+	}
+	genesis := MakeGenesisDefault(balances)
+	selfish := NewSelfishMiner(attacker)
+	attacker.SetGenesisBlock(genesis)
+	attacker.SetHashrate(totalHashrate * alpha)
+	for _, miner := range honest {
+		miner.SetGenesisBlock(genesis)
+		miner.SetHashrate(totalHashrate * (1 - alpha) / float64(len(honest)))
+	}
+	for _, miner := range miners {
+		net.Register(miner)
+	}
+	for _, miner := range miners {
+		miner.Initialize()
+	}
+	time.Sleep(duration)
+
+	// The public chain is the one the honest miners agree on.
+	var view *Miner
+	for _, miner := range honest {
+		if view == nil || miner.LastBlock.ChainLength > view.LastBlock.ChainLength {
+			view = miner
+		}
+	}
+	shares := view.RewardShares()
+	share, ok := shares[attacker.GetAddress()]
+	if !ok {
+		share = &RewardShare{Address: attacker.GetAddress()}
+	}
+
+	fmt.Printf("Public chain of length %d after %v, from %s's perspective:\n", view.LastBlock.ChainLength, duration, view.Name)
+	fmt.Printf("Selfish miner found %d blocks, published %d, abandoned %d, raced %d times, and has %d withheld\n",
+		selfish.Found, selfish.Published, selfish.Abandoned, selfish.Races, selfish.Lead())
+	fmt.Printf("Selfish miner: %.0f%% of the hashrate (%.0f hashes/s measured), %d blocks, %.1f%% of the rewards (%.1f%% to %.1f%% expected)\n",
+		alpha*100, attacker.HashesPerSecond(), share.Blocks, share.RewardShare*100, SelfishMiningRevenue(alpha, 0)*100, SelfishMiningRevenue(alpha, 1)*100)
+	for _, miner := range honest {
+		honestShare, ok := shares[miner.GetAddress()]
+		if !ok {
+			honestShare = &RewardShare{Address: miner.GetAddress()}
+		}
+		fmt.Printf("%s: %.0f%% of the hashrate (%.0f hashes/s measured), %d blocks, %.1f%% of the rewards\n",
+			miner.Name, (1-alpha)/float64(len(honest))*100, miner.HashesPerSecond(), honestShare.Blocks, honestShare.RewardShare*100)
+	}
+	return share
+}
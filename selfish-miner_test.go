@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSelfishMinerTransitions(t *testing.T) {
+	type event struct {
+		found        bool
+		height       uint32
+		wantReleased []uint32
+	}
+	tests := []struct {
+		name          string
+		events        []event
+		wantLead      int
+		wantRaces     int
+		wantAbandoned int
+	}{
+		{
+			name:     "blocks found are withheld",
+			events:   []event{{true, 1, nil}, {true, 2, nil}},
+			wantLead: 2,
+		},
+		{
+			name:      "a lead of one races when the honest miners catch up",
+			events:    []event{{true, 1, nil}, {false, 1, []uint32{1}}},
+			wantRaces: 1,
+		},
+		{
+			name:      "the next block found after a race is published at once",
+			events:    []event{{true, 1, nil}, {false, 1, []uint32{1}}, {true, 2, []uint32{2}}},
+			wantRaces: 1,
+		},
+		{
+			name:   "a lead of two publishes the whole branch",
+			events: []event{{true, 1, nil}, {true, 2, nil}, {false, 1, []uint32{1, 2}}},
+		},
+		{
+			name:     "a larger lead releases one block per honest block",
+			events:   []event{{true, 1, nil}, {true, 2, nil}, {true, 3, nil}, {true, 4, nil}, {false, 1, []uint32{1}}},
+			wantLead: 3,
+		},
+		{
+			name:   "the branch is published once its lead falls to two",
+			events: []event{{true, 1, nil}, {true, 2, nil}, {true, 3, nil}, {false, 1, []uint32{1}}, {false, 2, []uint32{2, 3}}},
+		},
+		{
+			name:          "a branch the honest miners overtake is abandoned",
+			events:        []event{{true, 1, nil}, {false, 2, nil}},
+			wantAbandoned: 1,
+		},
+		{
+			name:     "blocks no higher than the public chain change nothing",
+			events:   []event{{true, 1, nil}, {true, 2, nil}, {true, 3, nil}, {false, 1, []uint32{1}}, {false, 1, nil}},
+			wantLead: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &SelfishMiner{withheld: make([]*Block, 0)}
+			for i, e := range tt.events {
+				block := &Block{ChainLength: e.height}
+				var released []*Block
+				if e.found {
+					released = sm.BlockFound(block)
+				} else {
+					block.ExtraNonce = 1
+					released = sm.BlockReceived(block)
+				}
+				if len(released) != len(e.wantReleased) {
+					t.Fatalf("event %d: released %d blocks, want %d", i, len(released), len(e.wantReleased))
+				}
+				for j, b := range released {
+					if b.ChainLength != e.wantReleased[j] {
+						t.Fatalf("event %d: released block %d at height %d, want %d", i, j, b.ChainLength, e.wantReleased[j])
+					}
+				}
+			}
+			if sm.Lead() != tt.wantLead || sm.Races != tt.wantRaces || sm.Abandoned != tt.wantAbandoned {
+				t.Fatalf("lead %d, races %d, abandoned %d, want %d, %d, %d",
+					sm.Lead(), sm.Races, sm.Abandoned, tt.wantLead, tt.wantRaces, tt.wantAbandoned)
+			}
+		})
+	}
+}
+
+func TestSelfishMiningRevenue(t *testing.T) {
+	tests := []struct {
+		alpha, gamma float64
+		want         float64
+	}{
+		// The thresholds from the paper, where selfish mining breaks even.
+		{1.0 / 3, 0, 1.0 / 3},
+		{0.25, 0.5, 0.25},
+		{0, 0, 0},
+		// With half the hashrate, the attacker gets every reward.
+		{0.5, 0, 1},
+		{0.5, 1, 1},
+	}
+	for _, tt := range tests {
+		if got := SelfishMiningRevenue(tt.alpha, tt.gamma); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("SelfishMiningRevenue(%v, %v) = %v, want %v", tt.alpha, tt.gamma, got, tt.want)
+		}
+	}
+
+	// Below the threshold selfish mining does not pay, and above it, it does.
+	if got := SelfishMiningRevenue(0.3, 0); got >= 0.3 {
+		t.Errorf("SelfishMiningRevenue(0.3, 0) = %v, want less than 0.3", got)
+	}
+	if got := SelfishMiningRevenue(0.4, 0); got <= 0.4 {
+		t.Errorf("SelfishMiningRevenue(0.4, 0) = %v, want more than 0.4", got)
+	}
+}
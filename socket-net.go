@@ -0,0 +1,269 @@
+package main
+
+// Connect clients over TCP, so that they can run in separate processes
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Every connection starts with both sides sending a hello with their address.
+const SOCKET_HELLO string = "SOCKET_HELLO"
+const SOCKET_DIAL_TIMEOUT time.Duration = 5 * time.Second
+
+type socketFrame struct {
+	From string
+	Msg  string
+	Data []byte
+}
+
+type socketConn struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	mu      sync.Mutex
+}
+
+func newSocketConn(conn net.Conn) *socketConn {
+	var sc socketConn
+	sc.conn = conn
+	sc.encoder = json.NewEncoder(conn)
+	return &sc
+}
+
+func (sc *socketConn) send(frame socketFrame) error {
+	(*sc).mu.Lock()
+	defer (*sc).mu.Unlock()
+	return (*sc).encoder.Encode(frame)
+}
+
+/**
+ * A transport where each connection between two clients is a TCP stream
+ * of JSON frames.  The sender of a message is the address announced in
+ * the hello at the start of the connection, not anything in the frame.
+ */
+type SocketNet struct {
+	Clients     map[string]NetClient
+	Propagation *PropagationTracker
+	Reorgs      *ReorgTracker
+	listeners   map[string]net.Listener
+	endpoints   map[string]string
+	conns       map[string]map[string]*socketConn
+	mu          sync.Mutex
+}
+
+func NewSocketNet() *SocketNet {
+	var s SocketNet
+	s.Clients = make(map[string]NetClient)
+	s.Propagation = NewPropagationTracker()
+	s.Reorgs = NewReorgTracker()
+	s.listeners = make(map[string]net.Listener)
+	s.endpoints = make(map[string]string)
+	s.conns = make(map[string]map[string]*socketConn)
+	return &s
+}
+
+// Registers clients that only open outbound connections.
+func (s *SocketNet) Register(clientList ...NetClient) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	for _, client := range clientList {
+		s.Clients[client.GetAddress()] = client
+		if s.conns[client.GetAddress()] == nil {
+			s.conns[client.GetAddress()] = make(map[string]*socketConn)
+		}
+	}
+}
+
+/**
+ * Registers a client and accepts connections for it on the endpoint.
+ * Use port 0 to pick any free port; Endpoint returns the one chosen.
+ */
+func (s *SocketNet) Listen(client NetClient, endpoint string) error {
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return err
+	}
+	s.Register(client)
+
+	(*s).mu.Lock()
+	s.listeners[client.GetAddress()] = listener
+	s.endpoints[client.GetAddress()] = listener.Addr().String()
+	(*s).mu.Unlock()
+
+	go s.acceptLoop(client.GetAddress(), listener)
+	return nil
+}
+
+// Dials the peer's endpoint and exchanges hellos, returning the peer's address.
+func (s *SocketNet) Connect(from string, peer PeerAddress) (string, error) {
+	if peer.Endpoint == "" {
+		return "", errors.New("peer has no endpoint")
+	}
+	conn, err := net.DialTimeout("tcp", peer.Endpoint, SOCKET_DIAL_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	sc := newSocketConn(conn)
+	if err := sc.send(socketFrame{From: from, Msg: SOCKET_HELLO}); err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	decoder := json.NewDecoder(conn)
+	var hello socketFrame
+	conn.SetReadDeadline(time.Now().Add(SOCKET_DIAL_TIMEOUT))
+	if err := decoder.Decode(&hello); err != nil || hello.Msg != SOCKET_HELLO {
+		conn.Close()
+		return "", errors.New("peer did not say hello")
+	}
+	conn.SetReadDeadline(time.Time{})
+	if peer.Address != "" && hello.From != peer.Address {
+		conn.Close()
+		return "", errors.New("peer has a different address than expected")
+	}
+
+	s.addConn(from, hello.From, sc)
+	go s.readLoop(from, hello.From, sc, decoder)
+	return hello.From, nil
+}
+
+func (s *SocketNet) Broadcast(from string, msg string, data []byte) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	for _, sc := range s.conns[from] {
+		go sc.send(socketFrame{From: from, Msg: msg, Data: data})
+	}
+}
+
+func (s *SocketNet) SendMessage(from string, addr string, msg string, data []byte) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if sc, ok := s.conns[from][addr]; ok {
+		go sc.send(socketFrame{From: from, Msg: msg, Data: data})
+	}
+}
+
+func (s *SocketNet) Peers(addr string) []string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	peers := make([]string, 0, len(s.conns[addr]))
+	for peer := range s.conns[addr] {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *SocketNet) Disconnect(a string, b string) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if sc, ok := s.conns[a][b]; ok {
+		sc.conn.Close()
+		delete(s.conns[a], b)
+	}
+	if sc, ok := s.conns[b][a]; ok {
+		sc.conn.Close()
+		delete(s.conns[b], a)
+	}
+}
+
+func (s *SocketNet) Endpoint(addr string) string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return s.endpoints[addr]
+}
+
+func (s *SocketNet) ItemSeen(addr string, id string) {
+	(*s).Propagation.Seen(addr, id)
+}
+
+// Records that a client's head moved to another branch, rolling back depth blocks.
+func (s *SocketNet) ChainReorged(addr string, depth int) {
+	(*s).Reorgs.Reorged(depth)
+}
+
+// Stops listening and closes every connection.
+func (s *SocketNet) Close() {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for _, peers := range s.conns {
+		for _, sc := range peers {
+			sc.conn.Close()
+		}
+	}
+	s.listeners = make(map[string]net.Listener)
+	s.conns = make(map[string]map[string]*socketConn)
+}
+
+func (s *SocketNet) acceptLoop(local string, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.accept(local, conn)
+	}
+}
+
+func (s *SocketNet) accept(local string, conn net.Conn) {
+	decoder := json.NewDecoder(conn)
+	var hello socketFrame
+	conn.SetReadDeadline(time.Now().Add(SOCKET_DIAL_TIMEOUT))
+	if err := decoder.Decode(&hello); err != nil || hello.Msg != SOCKET_HELLO || hello.From == "" {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sc := newSocketConn(conn)
+	if err := sc.send(socketFrame{From: local, Msg: SOCKET_HELLO}); err != nil {
+		conn.Close()
+		return
+	}
+	s.addConn(local, hello.From, sc)
+	s.readLoop(local, hello.From, sc, decoder)
+}
+
+func (s *SocketNet) addConn(local string, remote string, sc *socketConn) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if old, ok := s.conns[local][remote]; ok {
+		old.conn.Close()
+	}
+	if s.conns[local] == nil {
+		s.conns[local] = make(map[string]*socketConn)
+	}
+	s.conns[local][remote] = sc
+}
+
+func (s *SocketNet) removeConn(local string, remote string, sc *socketConn) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if s.conns[local][remote] == sc {
+		delete(s.conns[local], remote)
+	}
+	sc.conn.Close()
+}
+
+// Delivers frames from the peer to the local client until the connection closes.
+func (s *SocketNet) readLoop(local string, remote string, sc *socketConn, decoder *json.Decoder) {
+	for {
+		var frame socketFrame
+		if err := decoder.Decode(&frame); err != nil {
+			s.removeConn(local, remote, sc)
+			return
+		}
+		(*s).mu.Lock()
+		client, ok := s.Clients[local]
+		(*s).mu.Unlock()
+		if ok {
+			// Waits a little for room when the inbox is full, holding back reads
+			// from the peer, and drops the frame if the inbox stays full.
+			client.GetInbox().Deliver(remote, frame.Msg, frame.Data)
+		}
+	}
+}
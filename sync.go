@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Constants for headers-first synchronization
+const MAX_HEADERS_BATCH uint32 = 20
+const MAX_BLOCKS_IN_FLIGHT int = 16
+const BLOCKS_PER_REQUEST int = 4
+const BLOCK_DOWNLOAD_TIMEOUT time.Duration = 2 * time.Second
+const HEADERS_TIMEOUT time.Duration = 2 * time.Second
+const SYNC_HEAD_TIMEOUT time.Duration = 2 * time.Second
+const SYNC_CHECK_INTERVAL time.Duration = 500 * time.Millisecond
+
+// Headers can arrive late from a peer that was the sync peer, which is not the peer's fault.
+var ErrNotSyncPeer = errors.New("headers from a peer that is not the sync peer")
+
+// Asks a peer for the headers following the first locator hash it knows.
+type HeadersRequest struct {
+	Locator []string
+}
+
+type blockDownload struct {
+	Peer string
+	Sent time.Time
+}
+
+/**
+ * Tracks the progress of a node catching up with the network.  The node
+ * first learns the heads of its peers, then downloads and validates the
+ * headers of the best chain from one peer, and finally fetches the block
+ * bodies from all peers that have them.
+ */
+type ChainSync struct {
+	Syncing     bool
+	SyncPeer    string
+	HeadersDone bool
+	PeerHeights map[string]uint32
+	Headers     map[string]*BlockHeader
+	BestHeader  *BlockHeader
+	ToFetch     []string
+	InFlight    map[string]*blockDownload
+	// Blocks known from their headers to be ancestors of the assume-valid block.
+	assumedValid map[string]bool
+	// When the sync started and when headers were last asked for, and the
+	// peers that did not answer in time.
+	started      time.Time
+	headersAsked time.Time
+	timedOut     map[string]bool
+	mu           sync.Mutex
+}
+
+func NewChainSync() *ChainSync {
+	var s ChainSync
+	s.PeerHeights = make(map[string]uint32)
+	s.Headers = make(map[string]*BlockHeader)
+	s.ToFetch = make([]string, 0)
+	s.InFlight = make(map[string]*blockDownload)
+	s.assumedValid = make(map[string]bool)
+	s.timedOut = make(map[string]bool)
+	return &s
+}
+
+func (s *ChainSync) Start() {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	(*s).Syncing = true
+	(*s).SyncPeer = ""
+	(*s).HeadersDone = false
+	(*s).started = time.Now()
+	(*s).timedOut = make(map[string]bool)
+}
+
+/**
+ * Records the head announced by a peer.  Returns true if headers should
+ * be requested from that peer, which happens for the first peer found
+ * to be ahead of us while syncing.
+ */
+func (s *ChainSync) AddPeerHead(peer string, header *BlockHeader, ourHeight uint32) bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	(*s).PeerHeights[peer] = header.ChainLength
+	if !(*s).Syncing || (*s).SyncPeer != "" || (*s).timedOut[peer] {
+		return false
+	}
+	if (*s).BestHeader != nil && (*s).BestHeader.ChainLength > ourHeight {
+		ourHeight = (*s).BestHeader.ChainLength
+	}
+	if header.ChainLength <= ourHeight {
+		return false
+	}
+	(*s).SyncPeer = peer
+	(*s).headersAsked = time.Now()
+	return true
+}
+
+/**
+ * Checks on a sync in progress.  If the sync peer has not sent headers
+ * within HEADERS_TIMEOUT, the peer furthest ahead of us that has not
+ * timed out yet takes its place, and is returned so that headers can be
+ * asked from it.  The headers stage ends if no peer is left to ask, or if
+ * no peer turned out to be ahead within SYNC_HEAD_TIMEOUT, and the sync
+ * ends once the blocks already queued have arrived.
+ */
+func (s *ChainSync) CheckProgress(ourHeight uint32) string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	if !(*s).Syncing {
+		return ""
+	}
+	if (*s).HeadersDone {
+		s.endHeaders()
+		return ""
+	}
+	now := time.Now()
+	if (*s).SyncPeer == "" {
+		if now.Sub((*s).started) > SYNC_HEAD_TIMEOUT {
+			s.endHeaders()
+		}
+		return ""
+	}
+	if now.Sub((*s).headersAsked) <= HEADERS_TIMEOUT {
+		return ""
+	}
+
+	(*s).timedOut[(*s).SyncPeer] = true
+	if (*s).BestHeader != nil && (*s).BestHeader.ChainLength > ourHeight {
+		ourHeight = (*s).BestHeader.ChainLength
+	}
+	next := ""
+	for peer, height := range (*s).PeerHeights {
+		if height > ourHeight && !(*s).timedOut[peer] && (next == "" || height > (*s).PeerHeights[next]) {
+			next = peer
+		}
+	}
+	if next == "" {
+		s.endHeaders()
+		return ""
+	}
+	(*s).SyncPeer = next
+	(*s).headersAsked = now
+	return next
+}
+
+// Stops asking for headers, finishing the sync if no blocks are left to download.
+func (s *ChainSync) endHeaders() {
+	(*s).HeadersDone = true
+	if len((*s).InFlight) == 0 && len((*s).ToFetch) == 0 {
+		(*s).Syncing = false
+		(*s).SyncPeer = ""
+	}
+}
+
+/**
+ * Builds the locator to send with a headers request, starting from the
+ * best header downloaded so far if it is ahead of the blocks we have.
+ */
+func (s *ChainSync) Locator(blocks map[string]*Block, head *Block) []string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	locator := make([]string, 0)
+	if (*s).BestHeader != nil && (*s).BestHeader.ChainLength > head.ChainLength {
+		locator = append(locator, (*s).BestHeader.GetHash())
+	}
+	return append(locator, BlockLocator(blocks, head)...)
+}
+
+/**
+ * Validates a batch of headers from the sync peer and queues their bodies
+ * for download.  Headers must connect to a known block or header, follow
+ * each other in order, and have a seal the consensus engine accepts.
+ * Returns true if the peer may have more headers to send.
+ */
+func (s *ChainSync) AddHeaders(peer string, headers []BlockHeader, blocks map[string]*Block, engine ConsensusEngine) (bool, error) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	if peer != (*s).SyncPeer {
+		return false, ErrNotSyncPeer
+	}
+	if len(headers) == 0 {
+		(*s).HeadersDone = true
+		return false, nil
+	}
+
+	prevHash := headers[0].PrevBlockHash
+	var prevHeight uint32
+	if block, ok := blocks[prevHash]; ok {
+		prevHeight = block.ChainLength
+	} else if header, ok := (*s).Headers[prevHash]; ok {
+		prevHeight = header.ChainLength
+	} else {
+		return false, errors.New("headers do not connect to a known block")
+	}
+
+	for i := range headers {
+		header := &headers[i]
+		if header.PrevBlockHash != prevHash || header.ChainLength != prevHeight+1 {
+			return false, errors.New("headers are not in order")
+		}
+		if err := engine.VerifyHeader(header); err != nil {
+			return false, err
+		}
+		prevHash = header.GetHash()
+		prevHeight = header.ChainLength
+	}
+
+	for i := range headers {
+		header := &headers[i]
+		headerId := header.GetHash()
+		(*s).Headers[headerId] = header
+		if _, ok := blocks[headerId]; !ok {
+			(*s).ToFetch = append((*s).ToFetch, headerId)
+		}
+	}
+	(*s).BestHeader = &headers[len(headers)-1]
+	more := uint32(len(headers)) == MAX_HEADERS_BATCH
+	(*s).HeadersDone = !more
+	(*s).headersAsked = time.Now()
+	return more, nil
+}
+
+/**
+ * Picks the next blocks to download, spreading them over the peers whose
+ * head is high enough to have them.  Downloads that timed out are handed
+ * to another peer.  Returns the block IDs to request from each peer.
+ */
+func (s *ChainSync) NextDownloads(blocks map[string]*Block) map[string][]string {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	now := time.Now()
+	stalled := make([]string, 0)
+	for blockId, download := range (*s).InFlight {
+		if _, ok := blocks[blockId]; ok {
+			delete((*s).InFlight, blockId)
+		} else if now.Sub(download.Sent) > BLOCK_DOWNLOAD_TIMEOUT {
+			delete((*s).InFlight, blockId)
+			stalled = append(stalled, blockId)
+		}
+	}
+	queue := make([]string, 0, len(stalled)+len((*s).ToFetch))
+	for _, blockId := range append(stalled, (*s).ToFetch...) {
+		if _, ok := blocks[blockId]; !ok {
+			queue = append(queue, blockId)
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		return (*s).Headers[queue[i]].ChainLength < (*s).Headers[queue[j]].ChainLength
+	})
+
+	peers := make([]string, 0, len((*s).PeerHeights))
+	for peer := range (*s).PeerHeights {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	downloads := make(map[string][]string)
+	next := 0
+	for len(queue) > 0 && len((*s).InFlight) < MAX_BLOCKS_IN_FLIGHT {
+		blockId := queue[0]
+		height := (*s).Headers[blockId].ChainLength
+		assigned := false
+		for tries := 0; tries < len(peers) && !assigned; tries++ {
+			peer := peers[(next+tries)%len(peers)]
+			if (*s).PeerHeights[peer] >= height && len(downloads[peer]) < BLOCKS_PER_REQUEST {
+				downloads[peer] = append(downloads[peer], blockId)
+				(*s).InFlight[blockId] = &blockDownload{Peer: peer, Sent: now}
+				next = (next + tries + 1) % len(peers)
+				assigned = true
+			}
+		}
+		if !assigned {
+			break
+		}
+		queue = queue[1:]
+	}
+	(*s).ToFetch = queue
+	return downloads
+}
+
+// Marks a downloaded block as received, finishing the sync once nothing is left.
+func (s *ChainSync) BlockReceived(blockId string) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+
+	delete((*s).InFlight, blockId)
+	delete((*s).Headers, blockId)
+	delete((*s).assumedValid, blockId)
+	if (*s).Syncing && (*s).HeadersDone && len((*s).InFlight) == 0 && len((*s).ToFetch) == 0 {
+		(*s).Syncing = false
+		(*s).SyncPeer = ""
+	}
+}
+
+// Determines whether a block is expected to arrive as part of the sync.
+func (s *ChainSync) Expects(blockId string) bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	_, ok := (*s).Headers[blockId]
+	return ok
+}
+
+/**
+ * Once the header of the assume-valid block has been downloaded, marks it
+ * and the headers of its ancestors, so that their blocks can skip
+ * signature checks when they arrive.
+ */
+func (s *ChainSync) AssumeValid(blockId string) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	if (*s).assumedValid[blockId] {
+		return
+	}
+	header, ok := (*s).Headers[blockId]
+	for ok {
+		(*s).assumedValid[blockId] = true
+		blockId = header.PrevBlockHash
+		header, ok = (*s).Headers[blockId]
+	}
+}
+
+func (s *ChainSync) IsAssumedValid(blockId string) bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return (*s).assumedValid[blockId]
+}
+
+func (s *ChainSync) IsSyncing() bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	return (*s).Syncing
+}
+
+/**
+ * Lists block IDs from the head back to the genesis block, with the gaps
+ * between them doubling after the first ten, so that a peer can find the
+ * fork point with few hashes.
+ */
+func BlockLocator(blocks map[string]*Block, head *Block) []string {
+	locator := make([]string, 0)
+	step := 1
+	block := head
+	for block != nil {
+		locator = append(locator, block.GetHash())
+		if block.IsGenesisBlock() {
+			break
+		}
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		for i := 0; i < step && block != nil && !block.IsGenesisBlock(); i++ {
+			block = blocks[block.PrevBlockHash]
+		}
+	}
+	return locator
+}
+
+/**
+ * Returns up to max headers of the chain ending at head, starting after
+ * the first locator hash found on that chain.  If none is found, the
+ * headers start after the genesis block.
+ */
+func HeadersAfter(blocks map[string]*Block, head *Block, locator []string, max uint32) []BlockHeader {
+	chain := make([]*Block, head.ChainLength+1)
+	positions := make(map[string]int)
+	for block := head; block != nil; block = blocks[block.PrevBlockHash] {
+		if int(block.ChainLength) >= len(chain) {
+			break
+		}
+		chain[block.ChainLength] = block
+		positions[block.GetHash()] = int(block.ChainLength)
+		if block.IsGenesisBlock() {
+			break
+		}
+	}
+
+	start := 0
+	for _, blockId := range locator {
+		if position, ok := positions[blockId]; ok {
+			start = position
+			break
+		}
+	}
+
+	headers := make([]BlockHeader, 0)
+	for i := start + 1; i < len(chain) && uint32(len(headers)) < max; i++ {
+		if chain[i] == nil {
+			break
+		}
+		headers = append(headers, chain[i].Header())
+	}
+	return headers
+}
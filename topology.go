@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Random pairings tried before building a random regular graph by edge swaps instead
+const MAX_PAIRING_ATTEMPTS int = 100
+
+// The network used when comparing how topologies affect forks.  Blocks
+// come every couple of seconds, a few times slower than they propagate.
+const TOPOLOGY_SIM_NODES int = 12
+const TOPOLOGY_SIM_HASHRATE float64 = 15000
+const TOPOLOGY_SIM_LINK_DELAY time.Duration = 100 * time.Millisecond
+const TOPOLOGY_SIM_LINK_JITTER time.Duration = 100 * time.Millisecond
+
+// An undirected link between the addresses of two clients.
+type Edge [2]string
+
+/**
+ * Connects every node to exactly degree others, chosen at random.  Nodes
+ * are paired off from a shuffled list of stubs, retrying until no node is
+ * paired with itself or twice with the same neighbor.  Dense graphs rarely
+ * come out right this way, so after MAX_PAIRING_ATTEMPTS the graph is
+ * built by shuffling the links of a ring lattice instead.  Requires that
+ * len(addrs)*degree is even and that degree < len(addrs).
+ */
+func RandomRegularTopology(addrs []string, degree int, rng *rand.Rand) []Edge {
+	if degree >= len(addrs) || (len(addrs)*degree)%2 != 0 {
+		panic("RandomRegularTopology(...): no regular graph with this degree")
+	}
+	for attempt := 0; attempt < MAX_PAIRING_ATTEMPTS; attempt++ {
+		stubs := make([]string, 0, len(addrs)*degree)
+		for _, addr := range addrs {
+			for i := 0; i < degree; i++ {
+				stubs = append(stubs, addr)
+			}
+		}
+		rng.Shuffle(len(stubs), func(i, j int) {
+			stubs[i], stubs[j] = stubs[j], stubs[i]
+		})
+
+		edges := make([]Edge, 0, len(stubs)/2)
+		seen := make(map[Edge]bool)
+		valid := true
+		for i := 0; i < len(stubs); i += 2 {
+			edge := normalizeEdge(stubs[i], stubs[i+1])
+			if edge[0] == edge[1] || seen[edge] {
+				valid = false
+				break
+			}
+			seen[edge] = true
+			edges = append(edges, edge)
+		}
+		if valid {
+			return edges
+		}
+	}
+	return swappedRegularTopology(addrs, degree, rng)
+}
+
+/**
+ * Builds a regular graph as a ring lattice, where every node is linked to
+ * its degree/2 nearest neighbors on each side, and to the opposite node
+ * when degree is odd.  The links are then randomized by repeatedly taking
+ * two links a-b and c-d and replacing them with a-d and c-b, which keeps
+ * every node's degree.
+ */
+func swappedRegularTopology(addrs []string, degree int, rng *rand.Rand) []Edge {
+	n := len(addrs)
+	shuffled := make([]string, n)
+	for i, j := range rng.Perm(n) {
+		shuffled[i] = addrs[j]
+	}
+	seen := make(map[Edge]bool)
+	for i := 0; i < n; i++ {
+		for j := 1; j <= degree/2; j++ {
+			seen[normalizeEdge(shuffled[i], shuffled[(i+j)%n])] = true
+		}
+		if degree%2 != 0 {
+			seen[normalizeEdge(shuffled[i], shuffled[(i+n/2)%n])] = true
+		}
+	}
+	edges := make([]Edge, 0, len(seen))
+	for edge := range seen {
+		edges = append(edges, edge)
+	}
+	if len(edges) < 2 {
+		return edgesFromSet(addrs, seen)
+	}
+	for swap := 0; swap < 10*len(edges); swap++ {
+		i, j := rng.Intn(len(edges)), rng.Intn(len(edges))
+		a, b := edges[i][0], edges[i][1]
+		c, d := edges[j][0], edges[j][1]
+		if rng.Intn(2) == 0 {
+			c, d = d, c
+		}
+		first, second := normalizeEdge(a, d), normalizeEdge(c, b)
+		if a == d || c == b || first == second || seen[first] || seen[second] {
+			continue
+		}
+		delete(seen, edges[i])
+		delete(seen, edges[j])
+		seen[first] = true
+		seen[second] = true
+		edges[i], edges[j] = first, second
+	}
+	return edgesFromSet(addrs, seen)
+}
+
+/**
+ * Builds a Watts-Strogatz small-world graph: a ring where every node is
+ * linked to its k nearest neighbors (k even), after which each link is
+ * rewired to a random node with probability beta.
+ */
+func SmallWorldTopology(addrs []string, k int, beta float64, rng *rand.Rand) []Edge {
+	n := len(addrs)
+	if k%2 != 0 || k >= n {
+		panic("SmallWorldTopology(...): k must be even and smaller than the number of nodes")
+	}
+	seen := make(map[Edge]bool)
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k/2; j++ {
+			seen[normalizeEdge(addrs[i], addrs[(i+j)%n])] = true
+		}
+	}
+	for i := 0; i < n; i++ {
+		for j := 1; j <= k/2; j++ {
+			edge := normalizeEdge(addrs[i], addrs[(i+j)%n])
+			if !seen[edge] || rng.Float64() >= beta {
+				continue
+			}
+			target := addrs[rng.Intn(n)]
+			rewired := normalizeEdge(addrs[i], target)
+			if target == addrs[i] || seen[rewired] {
+				continue
+			}
+			delete(seen, edge)
+			seen[rewired] = true
+		}
+	}
+	return edgesFromSet(addrs, seen)
+}
+
+/**
+ * Builds a Barabasi-Albert scale-free graph.  The first m+1 nodes are
+ * fully connected, and every later node links to m existing nodes chosen
+ * with probability proportional to their degree.
+ */
+func ScaleFreeTopology(addrs []string, m int, rng *rand.Rand) []Edge {
+	if m < 1 || m >= len(addrs) {
+		panic("ScaleFreeTopology(...): m must be between 1 and the number of nodes")
+	}
+	seen := make(map[Edge]bool)
+	// Each node appears once per link it has, so picking uniformly from
+	// this list picks nodes in proportion to their degree.
+	endpoints := make([]string, 0)
+	for i := 0; i <= m; i++ {
+		for j := 0; j < i; j++ {
+			seen[normalizeEdge(addrs[i], addrs[j])] = true
+			endpoints = append(endpoints, addrs[i], addrs[j])
+		}
+	}
+	for i := m + 1; i < len(addrs); i++ {
+		targets := make(map[string]bool)
+		for len(targets) < m {
+			targets[endpoints[rng.Intn(len(endpoints))]] = true
+		}
+		for target := range targets {
+			seen[normalizeEdge(addrs[i], target)] = true
+			endpoints = append(endpoints, addrs[i], target)
+		}
+	}
+	return edgesFromSet(addrs, seen)
+}
+
+// Connects every pair of nodes.
+func FullTopology(addrs []string) []Edge {
+	edges := make([]Edge, 0)
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			edges = append(edges, normalizeEdge(addrs[i], addrs[j]))
+		}
+	}
+	return edges
+}
+
+func normalizeEdge(a string, b string) Edge {
+	if a > b {
+		return Edge{b, a}
+	}
+	return Edge{a, b}
+}
+
+// Lists the edges of a set in a stable order, following the order of addrs.
+func edgesFromSet(addrs []string, set map[Edge]bool) []Edge {
+	edges := make([]Edge, 0, len(set))
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			edge := normalizeEdge(addrs[i], addrs[j])
+			if set[edge] {
+				edges = append(edges, edge)
+			}
+		}
+	}
+	return edges
+}
+
+// How often blocks were orphaned on a network with a given topology.
+type TopologyResult struct {
+	Topology         string
+	Edges            int
+	BlocksSeen       int
+	StaleRate        float64
+	Reorgs           int
+	BlockPropagation float64
+}
+
+/**
+ * Runs the same network of miners over a full mesh, a random regular
+ * graph, a small world and a scale-free graph, with slow links, and prints
+ * the share of blocks that ended up off the longest chain in each one.
+ * The further blocks have to be relayed, the more often miners work on
+ * stale blocks and the more forks there are.
+ */
+func SimulateTopologies(totalHashrate float64, duration time.Duration, seed int64) []TopologyResult {
+	rng := rand.New(rand.NewSource(seed))
+	topologies := []struct {
+		name  string
+		build func(addrs []string) []Edge
+	}{
+		{"full", FullTopology},
+		{"random regular (degree 3)", func(addrs []string) []Edge { return RandomRegularTopology(addrs, 3, rng) }},
+		{"small world (k=4, beta=0.1)", func(addrs []string) []Edge { return SmallWorldTopology(addrs, 4, 0.1, rng) }},
+		{"scale free (m=1)", func(addrs []string) []Edge { return ScaleFreeTopology(addrs, 1, rng) }},
+	}
+
+	results := make([]TopologyResult, 0, len(topologies))
+	for _, topology := range topologies {
+		net := NewFakeNet()
+		net.LinkDelay = TOPOLOGY_SIM_LINK_DELAY
+		net.LinkJitter = TOPOLOGY_SIM_LINK_JITTER
+		miners := make([]*Miner, 0, TOPOLOGY_SIM_NODES)
+		addrs := make([]string, 0, TOPOLOGY_SIM_NODES)
+		for i := 0; i < TOPOLOGY_SIM_NODES; i++ {
+			miner := NewMiner(fmt.Sprintf("Miner%d", i+1), net, NUM_ROUNDS_MINING, nil)
+			miners = append(miners, miner)
+			addrs = append(addrs, miner.GetAddress())
+		}
+		genesis := MakeGenesisDefault(make(map[string]uint32))
+		edges := topology.build(addrs)
+		net.SetTopology(edges)
+		for _, miner := range miners {
+			miner.SetGenesisBlock(genesis)
+			miner.SetHashrate(totalHashrate / float64(len(miners)))
+			net.Register(miner)
+		}
+		for _, miner := range miners {
+			miner.Initialize()
+		}
+		time.Sleep(duration)
+
+		views := make([]ChainView, 0, len(miners))
+		for _, miner := range miners {
+			miner.Stop()
+			views = append(views, miner.ChainView())
+		}
+		metrics := CollectMetrics(views, net.Propagation, net.Reorgs, duration)
+		reorgs := 0
+		for _, count := range metrics.ReorgDepths {
+			reorgs += count
+		}
+		result := TopologyResult{
+			Topology:         topology.name,
+			Edges:            len(edges),
+			BlocksSeen:       metrics.BlocksSeen,
+			StaleRate:        metrics.StaleRate,
+			Reorgs:           reorgs,
+			BlockPropagation: metrics.Summary["block_propagation"].Median,
+		}
+		results = append(results, result)
+		fmt.Printf("%s, %d links: %d blocks, %.1f%% stale, %d reorgs, blocks reached half the nodes in %.0fms\n",
+			result.Topology, result.Edges, result.BlocksSeen, result.StaleRate*100, result.Reorgs, result.BlockPropagation*1000)
+	}
+	return results
+}
@@ -161,3 +161,13 @@ func (tx *Transaction) TotalOutput() uint32 {
 	amount += (*tx).Info.Fee
 	return amount
 }
+
+// Determines whether any of the outputs of the transaction go to the address.
+func (tx *Transaction) Pays(address string) bool {
+	for _, v := range (*tx).Info.Outputs {
+		if v.Address == address {
+			return true
+		}
+	}
+	return false
+}
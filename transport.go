@@ -0,0 +1,34 @@
+package main
+
+/**
+ * A network that clients use to talk to each other.  FakeNet simulates
+ * one within the process, while SocketNet sends messages over TCP.
+ * Listeners receive the address of the sender along with the data.
+ * Connect returns the address of the peer, which is only known in advance
+ * if the peer address includes it.
+ */
+type Transport interface {
+	Register(clientList ...NetClient)
+	Broadcast(from string, msg string, data []byte)
+	SendMessage(from string, addr string, msg string, data []byte)
+	Peers(addr string) []string
+	Connect(from string, peer PeerAddress) (string, error)
+	Disconnect(a string, b string)
+	Endpoint(addr string) string
+	ItemSeen(addr string, id string)
+	ChainReorged(addr string, depth int)
+}
+
+// A client's address together with where it can be reached on the transport.
+type PeerAddress struct {
+	Address  string
+	Endpoint string
+}
+
+// Identifies a peer in the address book, by its endpoint until its address is known.
+func (p PeerAddress) Key() string {
+	if p.Address != "" {
+		return p.Address
+	}
+	return p.Endpoint
+}
@@ -67,3 +67,17 @@ func (s *Set[T]) Clear() {
 	defer (*s).mu.Unlock()
 	(*s).items = make(map[string]T)
 }
+
+func (s *Set[T]) ContainsKey(hashStr string) bool {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	_, c := (*s).items[hashStr]
+	return c
+}
+
+func (s *Set[T]) Get(hashStr string) (T, bool) {
+	(*s).mu.Lock()
+	defer (*s).mu.Unlock()
+	v, c := (*s).items[hashStr]
+	return v, c
+}